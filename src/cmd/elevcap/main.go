@@ -0,0 +1,182 @@
+package main
+
+import (
+	"../../comm/conn"
+	"../../comm/dissect"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+)
+
+// Packet capture and dissector for the broadcast port
+//   elevcap record -bport=20010 -out=capture.jsonl
+//   elevcap decode -in=capture.jsonl
+//   elevcap analyze -in=capture.jsonl
+// record writes every packet with receive time and sender address until
+// interrupted. decode pretty-prints the packets, analyze reconstructs the
+// lifecycle of each order across the nodes and flags missing acks and
+// duplicates.
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: elevcap record|decode|analyze [flags], see elevcap <command> -h")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	commonPort_ptr := flags.Int("bport", 20010, "Port for all broadcasts")
+	outFile_ptr := flags.String("out", "capture.jsonl", "File to record to")
+	inFile_ptr := flags.String("in", "capture.jsonl", "Recorded capture")
+	heartbeats_ptr := flags.Bool("heartbeats", false, "Also print peers heartbeats, beacons, deltas, acks and resync requests")
+	problemsOnly_ptr := flags.Bool("problems", false, "Only print lifecycles with problems")
+	flags.Parse(os.Args[2:])
+
+	var err error
+	switch os.Args[1] {
+	case "record":
+		err = record(*commonPort_ptr, *outFile_ptr)
+	case "decode":
+		err = decode(*inFile_ptr, *heartbeats_ptr)
+	case "analyze":
+		err = analyze(*inFile_ptr, *problemsOnly_ptr)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func record(port int, outFile string) error {
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	capture := dissect.NewCaptureWriter(f)
+
+	interruptCh := make(chan os.Signal, 1)
+	signal.Notify(interruptCh, os.Interrupt)
+
+	// packets are written here, the reader only receives them
+	recordCh := make(chan dissect.Record, 64)
+	errCh := make(chan error, 1)
+	go func() {
+		var buf [conn.MaxPacketSize]byte
+		c := conn.DialBroadcastUDP(port)
+		for {
+			n, addr, err := c.ReadFrom(buf[0:])
+			if err != nil {
+				errCh <- err
+				return
+			}
+			record := dissect.Record{Time: time.Now(), Data: append([]byte(nil), buf[:n]...)}
+			if addr != nil {
+				record.Source = addr.String()
+			}
+			recordCh <- record
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "recording port %v to %v, interrupt to stop\n", port, outFile)
+	count := 0
+	for {
+		select {
+		case record := <-recordCh:
+			if err := capture.Write(record); err != nil {
+				return err
+			}
+			count++
+		case <-interruptCh:
+			fmt.Fprintf(os.Stderr, "recorded %v packets\n", count)
+			return nil
+		case err := <-errCh:
+			return err
+		}
+	}
+}
+
+func readPackets(inFile string) ([]dissect.Packet, error) {
+	f, err := os.Open(inFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := dissect.ReadCapture(f)
+	if err != nil {
+		return nil, err
+	}
+	packets := make([]dissect.Packet, len(records))
+	for i, record := range records {
+		packets[i], _ = dissect.DecodeRecord(record)
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].Time.Before(packets[j].Time) })
+	return packets, nil
+}
+
+func decode(inFile string, heartbeats bool) error {
+	packets, err := readPackets(inFile)
+	if err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if (p.Kind == dissect.KIND_Heartbeat || p.Kind == dissect.KIND_Beacon) && !heartbeats {
+			continue
+		}
+		fmt.Printf("%v %-21v %v\n", p.Time.Format("15:04:05.000"), p.Source, p.Summary())
+	}
+	return nil
+}
+
+func analyze(inFile string, problemsOnly bool) error {
+	packets, err := readPackets(inFile)
+	if err != nil {
+		return err
+	}
+	lifecycles := dissect.Analyze(packets)
+
+	withProblems, open := 0, 0
+	for _, lc := range lifecycles {
+		if len(lc.Problems) > 0 {
+			withProblems++
+		}
+		if !lc.Completed() {
+			open++
+		}
+		if problemsOnly && len(lc.Problems) == 0 {
+			continue
+		}
+
+		fmt.Printf("order %v %v floor %v (master %v) %v\n", lc.Order.ID, dissect.ButtonName(lc.Order.Type),
+			lc.Order.Floor, lc.Order.MasterID, lc.Start.Format("15:04:05.000"))
+		for _, t := range lc.Transmissions {
+			receiver := t.ReceiverID
+			if receiver == "" {
+				receiver = "all"
+			}
+			copies := ""
+			if len(t.Times) > 1 {
+				copies = fmt.Sprintf("x%v", len(t.Times))
+			}
+			fmt.Printf("  %+8.3fs  %-12v %v -> %-6v %v\n", t.Times[0].Sub(lc.Start).Seconds(), t.Step,
+				t.SenderID, receiver, copies)
+		}
+		if !lc.Completed() {
+			fmt.Println("  open at the end of the capture")
+		}
+		for _, problem := range lc.Problems {
+			fmt.Printf("  ! %v\n", problem)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%v packets, %v order lifecycles, %v open, %v with problems\n",
+		len(packets), len(lifecycles), open, withProblems)
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"../../comm/dissect"
+	"../../commhandler"
+	"../../elevio"
+	"../../fsm"
+	"../../orderhandler"
+	"../../statusapi"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command-line client of a node's status and control api (-http)
+//   elevctl -node=localhost:8080 place hall-up 2
+//   elevctl -node=localhost:8080 orders
+// Orders are placed, completed and cancelled on the node as if it was done on
+// its panel or by its elevator, so the normal protocol distributes them.
+
+var node_ptr = flag.String("node", "localhost:8080", "Address of the node's status and control api")
+
+const requestTimeout = 3 * time.Second
+
+var client = &http.Client{Timeout: requestTimeout}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: elevctl [-node=host:port] <command>
+commands:
+  place <button> <floor>     place an order, button is hall-up, hall-down or cab
+  complete <button> <floor>  complete an order of the node's elevator as if it was served
+  cancel cab <floor>         drop a cab order of the node's elevator without serving it
+  orders                     list the orders known by the node
+  peers                      list the peers seen by the node
+  status                     print the full status as JSON
+`)
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	var err error
+	switch args[0] {
+	case "place", "complete", "cancel":
+		if len(args) != 3 {
+			usage()
+		}
+		err = orderCommand(args[0], args[1], args[2])
+	case "orders":
+		err = listOrders()
+	case "peers":
+		err = listPeers()
+	case "status":
+		var body []byte
+		if body, err = get("/status"); err == nil {
+			os.Stdout.Write(body)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func url(path string) string {
+	return "http://" + *node_ptr + path
+}
+
+func checkResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func get(path string) ([]byte, error) {
+	resp, err := client.Get(url(path))
+	if err != nil {
+		return nil, err
+	}
+	return checkResponse(resp)
+}
+
+func post(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url(path), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_, err = checkResponse(resp)
+	return err
+}
+
+func orderCommand(command string, button string, floorArg string) error {
+	buttonType, err := statusapi.ParseButton(button)
+	if err != nil {
+		return err
+	}
+	floor, err := strconv.Atoi(floorArg)
+	if err != nil {
+		return fmt.Errorf("invalid floor %q", floorArg)
+	}
+	path := "/orders"
+	if command != "place" {
+		path += "/" + command
+
+		// only the elevator serving an order can remove it, the api does not
+		// wait for the fsm to tell
+		body, err := get("/status/fsm")
+		if err != nil {
+			return err
+		}
+		var elevator fsm.Elevator
+		if err := json.Unmarshal(body, &elevator); err != nil {
+			return err
+		}
+		if floor >= 0 && floor < fsm.N_FLOORS && !elevator.Orders[floor][buttonType] {
+			return fmt.Errorf("the elevator has no %v order at floor %v, see orders for the elevator serving it", button, floor)
+		}
+	}
+	return post(path, statusapi.OrderRequest{Floor: floor, Button: button})
+}
+
+func listOrders() error {
+	body, err := get("/status")
+	if err != nil {
+		return err
+	}
+	var status statusapi.Status
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+
+	fmt.Printf("elevator %v at floor %v\n", status.NodeID, status.FSM.Floor)
+	for floor := fsm.N_FLOORS - 1; floor >= 0; floor-- {
+		for button := 0; button < fsm.N_BUTTONS; button++ {
+			if status.FSM.Orders[floor][button] {
+				fmt.Printf("  %-9v floor %v  light %v\n", dissect.ButtonName(elevio.ButtonType(button)), floor,
+					status.FSM.Lights[floor][button])
+			}
+		}
+	}
+
+	fmt.Printf("\n%-20v %-9v %-5v %-16v %-8v %-8v %-8v\n", "id", "button", "floor", "state", "master", "sender", "receiver")
+	ids := make([]string, 0, len(status.CommHandler.AllOrders))
+	for id := range status.CommHandler.AllOrders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		stampedOrder := status.CommHandler.AllOrders[id]
+		order := stampedOrder.OrderMsg.Order
+		fmt.Printf("%-20v %-9v %-5v %-16v %-8v %-8v %-8v\n", id, dissect.ButtonName(order.Type), order.Floor,
+			stampedOrder.OrderState, order.MasterID, stampedOrder.OrderMsg.SenderID, stampedOrder.OrderMsg.ReceiverID)
+	}
+
+	if len(status.OrderHandler.ChosenElevatorForOrder) > 0 {
+		fmt.Println("\nassigned by this node")
+		ids = ids[:0]
+		for id := range status.OrderHandler.ChosenElevatorForOrder {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Printf("  order %v -> elevator %v", id, status.OrderHandler.ChosenElevatorForOrder[id])
+			if escalation, exists := status.OrderHandler.Escalations[id]; exists && escalation.Step != orderhandler.ESC_None {
+				fmt.Printf("  %v since %v", escalation.Step, escalation.Since.Format("15:04:05"))
+			}
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+func listPeers() error {
+	body, err := get("/peers")
+	if err != nil {
+		return err
+	}
+	var peers []commhandler.PeerStatus
+	if err := json.Unmarshal(body, &peers); err != nil {
+		return err
+	}
+	fmt.Printf("%-8v %-6v %-9v %-5v %v\n", "id", "alive", "suspected", "phi", "last seen")
+	for _, p := range peers {
+		fmt.Printf("%-8v %-6v %-9v %-5.1f %v ago\n", p.ID, p.Alive, p.Suspected, p.Phi,
+			time.Since(p.LastSeen).Round(time.Millisecond))
+	}
+	return nil
+}
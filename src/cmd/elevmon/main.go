@@ -0,0 +1,212 @@
+package main
+
+import (
+	"../../comm/conn"
+	"../../comm/dissect"
+	"../../comm/peers"
+	"../../elevio"
+	"../../fsm"
+	"../../msgs"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Terminal monitor of the elevator bank. Listens passively on the broadcast
+// port and draws the shafts of all elevators from their heartbeats, followed
+// by a scrolling log of order messages and acks
+//   elevmon -bport=20010
+// In a car column [#] is the car, [ ] the car with the door open. The three
+// button columns are hall up, hall down and cab: upper case when the light is
+// on, lower case for an order without light. Heartbeat deltas are applied
+// when the monitor has their base version, as it cannot ask for a missed one
+// the shafts may lag until the next full heartbeat.
+
+var commonPort_ptr = flag.Int("bport", 20010, "Port for all broadcasts")
+var logLines_ptr = flag.Int("loglines", 15, "Number of order messages shown")
+var lostTimeout_ptr = flag.Duration("lost", 2*time.Second, "Time without heartbeats before an elevator is shown as lost")
+var plain_ptr = flag.Bool("plain", false, "Print every order message on its own line instead of drawing the shafts")
+
+const refreshPeriod = 200 * time.Millisecond
+const columnWidth = 18
+
+type elevator struct {
+	heartbeat msgs.Heartbeat
+	source    string
+	lastSeen  time.Time
+}
+
+func main() {
+	flag.Parse()
+
+	packetCh := make(chan dissect.Packet, 64)
+	go receive(*commonPort_ptr, packetCh)
+
+	elevators := make(map[string]*elevator)
+	var log []string
+	heartbeatCount, messageCount, unknownCount := 0, 0, 0
+
+	ticker := time.NewTicker(refreshPeriod)
+	for {
+		select {
+		case p := <-packetCh:
+			switch p.Kind {
+			case dissect.KIND_Heartbeat:
+				heartbeatCount++
+				heartbeat := p.Message.(msgs.Heartbeat)
+				elevators[heartbeat.SenderID] = &elevator{heartbeat: heartbeat, source: p.Source, lastSeen: p.Time}
+			case dissect.KIND_Beacon:
+				heartbeatCount++
+				switch m := p.Message.(type) {
+				case msgs.Beacon:
+					if e := elevators[m.SenderID]; e != nil {
+						e.lastSeen = p.Time
+					}
+				case msgs.HeartbeatDelta:
+					if e := elevators[m.SenderID]; e != nil && e.heartbeat.Boot == m.Boot && e.heartbeat.Version == m.Base {
+						e.heartbeat = peers.ApplyDelta(e.heartbeat, m)
+						e.lastSeen = p.Time
+					}
+				}
+			case dissect.KIND_Message:
+				messageCount++
+				line := p.Time.Format("15:04:05.000") + " " + p.Summary()
+				if *plain_ptr {
+					fmt.Println(line)
+				}
+				log = append(log, line)
+				if len(log) > *logLines_ptr {
+					log = log[len(log)-*logLines_ptr:]
+				}
+			default:
+				unknownCount++
+			}
+
+		case <-ticker.C:
+			if !*plain_ptr {
+				fmt.Print(render(elevators, log, heartbeatCount, messageCount, unknownCount))
+			}
+		}
+	}
+}
+
+func receive(port int, packetCh chan<- dissect.Packet) {
+	var buf [conn.MaxPacketSize]byte
+	c := conn.DialBroadcastUDP(port)
+	for {
+		n, addr, err := c.ReadFrom(buf[0:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		p, _ := dissect.Decode(buf[:n])
+		if addr != nil {
+			p.Source = addr.String()
+		}
+		packetCh <- p
+	}
+}
+
+func render(elevators map[string]*elevator, log []string, heartbeatCount, messageCount, unknownCount int) string {
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "elevmon  port %v  %v  heartbeats %v  messages %v  unknown %v\n\n",
+		*commonPort_ptr, time.Now().Format("15:04:05"), heartbeatCount, messageCount, unknownCount)
+
+	ids := make([]string, 0, len(elevators))
+	for id := range elevators {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		b.WriteString("no heartbeats yet\n")
+	}
+
+	if len(ids) > 0 {
+		b.WriteString("        ")
+		for _, id := range ids {
+			e := elevators[id]
+			header := fmt.Sprintf("%v %v", id, stateName(e.heartbeat.Status))
+			if time.Since(e.lastSeen) > *lostTimeout_ptr {
+				header = fmt.Sprintf("%v LOST", id)
+			}
+			fmt.Fprintf(&b, "%-*v", columnWidth, header)
+		}
+		b.WriteString("\n")
+
+		for floor := fsm.N_FLOORS - 1; floor >= 0; floor-- {
+			fmt.Fprintf(&b, "floor %v ", floor)
+			for _, id := range ids {
+				fmt.Fprintf(&b, "%-*v", columnWidth, floorCell(elevators[id].heartbeat.Status, floor))
+			}
+			b.WriteString("\n")
+		}
+
+		b.WriteString("\n")
+		for _, id := range ids {
+			heartbeat := elevators[id].heartbeat
+			fmt.Fprintf(&b, "%v (%v): accepted %v  chosen %v  taken %v\n", id, elevators[id].source,
+				orderList(heartbeat.AcceptedOrders), heartbeat.ChosenElevatorForOrder, orderList(heartbeat.TakenOrders))
+		}
+	}
+
+	b.WriteString("\norder messages\n")
+	for _, line := range log {
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func stateName(status fsm.Elevator) string {
+	switch status.State {
+	case fsm.ST_Idle:
+		return "idle"
+	case fsm.ST_DoorOpen:
+		return "door open"
+	}
+	switch status.Dir {
+	case elevio.MD_Up:
+		return "moving up"
+	case elevio.MD_Down:
+		return "moving down"
+	}
+	return "moving"
+}
+
+func floorCell(status fsm.Elevator, floor int) string {
+	car := "| |"
+	if status.Floor == floor {
+		car = "[#]"
+		if status.State == fsm.ST_DoorOpen {
+			car = "[ ]"
+		}
+	}
+	buttons := ""
+	for button, symbol := range "udc" {
+		switch {
+		case status.Lights[floor][button]:
+			buttons += strings.ToUpper(string(symbol))
+		case status.Orders[floor][button]:
+			buttons += string(symbol)
+		default:
+			buttons += "."
+		}
+	}
+	return car + " " + buttons
+}
+
+func orderList(orders map[string]msgs.Order) string {
+	ids := make([]string, 0, len(orders))
+	for id := range orders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var names []string
+	for _, id := range ids {
+		names = append(names, fmt.Sprintf("%v:%v@%v", id, dissect.ButtonName(orders[id].Type), orders[id].Floor))
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"../../elevio"
+	"../../eventlog"
+	"../../fsm"
+	"../../go-nonblockingchan"
+	"../../msgs"
+	"../../orderhandler"
+	"../../raft"
+	"../../sim"
+	"../../spec"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Feeds the messages a module received in a captured event log (-eventlog)
+// back into a fresh instance of the module, and writes the messages it sends
+// as a new event log to -out
+//   replay -log=events.jsonl -module=orderhandler
+//   replay -log=events.jsonl -module=fsm -simport=20199
+// The FSM is connected to a simulated elevator. Hall buttons are pressed when
+// the captured log shows the FSM reporting them, cab buttons are not captured.
+
+var logFile_ptr = flag.String("log", "", "Captured event log")
+var module_ptr = flag.String("module", "orderhandler", "Module to replay: orderhandler or fsm")
+var nodeID_ptr = flag.String("node", "", "Node to replay, defaults to the node of the first entry")
+var speed_ptr = flag.Float64("speed", 1.0, "Replay speed relative to the capture")
+var outFile_ptr = flag.String("out", "replay.jsonl", "File for the replayed event log")
+var redundancy_ptr = flag.String("redundancy", "lenient", "Redundancy policy of the replayed node, persisted orders are kept in a temporary dir")
+var assign_ptr = flag.String("assign", "master", "Who assigns hall orders on the replayed node: master or leader")
+var deadline_ptr = flag.Duration("deadline", 20*time.Second, "Service deadline of the replayed node, see -deadline of the elevator")
+var simPort_ptr = flag.Int("simport", 20199, "Port of the simulated elevator when replaying the fsm")
+
+const minGap = 5 * time.Millisecond // keeps messages on different channels in order
+const drainTime = 1 * time.Second
+
+var channelTypes = map[string]reflect.Type{
+	"elevatorStatus":              reflect.TypeOf(fsm.Elevator{}),
+	"placedHallOrder":             reflect.TypeOf(fsm.OrderEvent{}),
+	"completedHallOrdersThisElev": reflect.TypeOf([]fsm.OrderEvent{}),
+	"addHallOrder":                reflect.TypeOf(fsm.OrderEvent{}),
+	"deleteHallOrder":             reflect.TypeOf(fsm.OrderEvent{}),
+	"updateLights":                reflect.TypeOf([fsm.N_FLOORS][fsm.N_BUTTONS]bool{}),
+	"assignOrder":                 reflect.TypeOf(msgs.TakeOrderMsg{}),
+	"placedOrder":                 reflect.TypeOf(msgs.Order{}),
+	"completedOrder":              reflect.TypeOf(msgs.Order{}),
+	"rescueOrder":                 reflect.TypeOf(msgs.Order{}),
+	"thisElevatorHeartbeat":       reflect.TypeOf(msgs.Heartbeat{}),
+	"allElevatorsHeartbeat":       reflect.TypeOf([]msgs.Heartbeat{}),
+	"redundantOrder":              reflect.TypeOf(msgs.RedundantOrderMsg{}),
+	"ignoredOrder":                reflect.TypeOf(msgs.Order{}),
+	"takeOrder":                   reflect.TypeOf(msgs.TakeOrderMsg{}),
+	"downedElevators":             reflect.TypeOf([]msgs.Heartbeat{}),
+	"completedHallOrderOtherElev": reflect.TypeOf(msgs.Order{}),
+	"lastKnownOrders":             reflect.TypeOf([fsm.N_FLOORS][fsm.N_BUTTONS]bool{}),
+	"rejoinedElevator":            reflect.TypeOf(msgs.Heartbeat{}),
+	"suspectedElevators":          reflect.TypeOf([]string{}),
+	"proposeEntry":                reflect.TypeOf(msgs.RaftEntry{}),
+	"committedEntry":              reflect.TypeOf(msgs.RaftEntry{}),
+	"raftStatus":                  reflect.TypeOf(raft.Status{}),
+	"injectButton":                reflect.TypeOf(elevio.ButtonEvent{}),
+	"orderCommand":                reflect.TypeOf(fsm.OrderCommand{}),
+	"cabOrders":                   reflect.TypeOf([fsm.N_FLOORS]bool{}),
+	"backedUpCabOrders":           reflect.TypeOf([fsm.N_FLOORS]bool{}),
+}
+
+type module struct {
+	inputs  map[string]*nbc.NonBlockingChan
+	outputs map[string]*nbc.NonBlockingChan
+}
+
+func newChannels(names ...string) map[string]*nbc.NonBlockingChan {
+	chans := make(map[string]*nbc.NonBlockingChan)
+	for _, name := range names {
+		chans[name] = nbc.New()
+	}
+	return chans
+}
+
+func decode(entry eventlog.Entry) (interface{}, error) {
+	T, exists := channelTypes[entry.Channel]
+	if !exists {
+		return nil, fmt.Errorf("unknown channel %v", entry.Channel)
+	}
+	v := reflect.New(T)
+	if err := json.Unmarshal(entry.Payload, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+func main() {
+	flag.Parse()
+
+	f, err := os.Open(*logFile_ptr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	entries, err := eventlog.Read(f)
+	f.Close()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		fmt.Println("Empty event log")
+		os.Exit(1)
+	}
+	if *nodeID_ptr == "" {
+		*nodeID_ptr = entries[0].NodeID
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var m module
+	var elevator *sim.Elevator
+
+	switch *module_ptr {
+	case "orderhandler":
+		redundancy, err := msgs.ParseRedundancy(*redundancy_ptr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		stateDir, err := ioutil.TempDir("", "replay")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(stateDir)
+		m.inputs = newChannels("placedHallOrder", "redundantOrder", "ignoredOrder", "takeOrder",
+			"completedHallOrdersThisElev", "completedHallOrderOtherElev", "downedElevators",
+			"elevatorStatus", "allElevatorsHeartbeat", "lastKnownOrders", "rejoinedElevator",
+			"suspectedElevators")
+		m.outputs = newChannels("placedOrder", "assignOrder", "addHallOrder", "completedOrder",
+			"rescueOrder", "deleteHallOrder", "thisElevatorHeartbeat", "updateLights")
+		go orderhandler.OrderHandler(*nodeID_ptr, redundancy, *assign_ptr == "leader", stateDir, *deadline_ptr,
+			m.inputs["placedHallOrder"], m.inputs["redundantOrder"], m.inputs["ignoredOrder"], m.inputs["takeOrder"],
+			m.inputs["completedHallOrdersThisElev"], m.inputs["completedHallOrderOtherElev"],
+			m.inputs["downedElevators"], m.inputs["elevatorStatus"], m.inputs["allElevatorsHeartbeat"],
+			m.inputs["lastKnownOrders"], m.inputs["rejoinedElevator"],
+			m.inputs["suspectedElevators"], nbc.New(),
+			m.outputs["placedOrder"], m.outputs["assignOrder"], m.outputs["addHallOrder"], m.outputs["completedOrder"],
+			m.outputs["rescueOrder"], m.outputs["deleteHallOrder"], m.outputs["thisElevatorHeartbeat"], m.outputs["updateLights"], &wg)
+
+	case "fsm":
+		eventCh := make(chan spec.Event)
+		go func() {
+			for range eventCh {
+			}
+		}()
+		elevator = sim.New(*nodeID_ptr, fsm.N_FLOORS, eventCh)
+		for _, entry := range entries {
+			if entry.NodeID == *nodeID_ptr && entry.Channel == "elevatorStatus" {
+				status, err := decode(entry)
+				if err == nil {
+					elevator.SetFloor(status.(fsm.Elevator).Floor)
+				}
+				break
+			}
+		}
+		simAddr := fmt.Sprintf("localhost:%d", *simPort_ptr)
+		go func() {
+			fmt.Fprintln(os.Stderr, elevator.ListenAndServe(simAddr))
+			os.Exit(1)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		m.inputs = newChannels("addHallOrder", "deleteHallOrder", "updateLights", "injectButton", "orderCommand",
+			"backedUpCabOrders")
+		m.outputs = newChannels("placedHallOrder", "completedHallOrdersThisElev", "elevatorStatus", "cabOrders")
+		go fsm.FSM(simAddr,
+			m.inputs["addHallOrder"], m.inputs["deleteHallOrder"], m.inputs["updateLights"],
+			m.inputs["injectButton"], nbc.New(), m.inputs["orderCommand"], m.inputs["backedUpCabOrders"],
+			m.outputs["placedHallOrder"], m.outputs["completedHallOrdersThisElev"], m.outputs["elevatorStatus"],
+			m.outputs["cabOrders"], &wg)
+
+	default:
+		fmt.Printf("Unknown module %v\n", *module_ptr)
+		os.Exit(1)
+	}
+
+	// replayed output is logged like the capture
+	out, err := os.Create(*outFile_ptr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer out.Close()
+	replayLog := eventlog.New(out, *nodeID_ptr)
+	var countMtx sync.Mutex
+	replayedCount := make(map[string]int)
+	for name, ch := range m.outputs {
+		go func(name string, ch *nbc.NonBlockingChan) {
+			for msg := range ch.Recv {
+				replayLog.Log(name, *module_ptr, "replay", msg)
+				countMtx.Lock()
+				replayedCount[name]++
+				countMtx.Unlock()
+			}
+		}(name, ch)
+	}
+
+	recordedCount := make(map[string]int)
+	start := time.Now()
+	var firstTime time.Time
+	for _, entry := range entries {
+		if entry.NodeID != *nodeID_ptr {
+			continue
+		}
+		if firstTime.IsZero() {
+			firstTime = entry.Time
+		}
+		if entry.From == *module_ptr {
+			recordedCount[entry.Channel]++
+		}
+
+		var deliver func()
+		if ch, isInput := m.inputs[entry.Channel]; isInput && entry.To == *module_ptr {
+			msg, err := decode(entry)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %v: %v\n", entry.Channel, err)
+				continue
+			}
+			deliver = func() { ch.Send <- msg }
+		} else if elevator != nil && entry.Channel == "placedHallOrder" {
+			msg, err := decode(entry)
+			if err != nil {
+				continue
+			}
+			order := msg.(fsm.OrderEvent)
+			deliver = func() { elevator.Press(order.Floor, order.Button) }
+		} else {
+			continue
+		}
+
+		offset := time.Duration(float64(entry.Time.Sub(firstTime)) / *speed_ptr)
+		wait := offset - time.Since(start)
+		if wait < minGap {
+			wait = minGap
+		}
+		time.Sleep(wait)
+		deliver()
+	}
+	time.Sleep(drainTime)
+
+	names := make([]string, 0, len(m.outputs))
+	for name := range m.outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	countMtx.Lock()
+	defer countMtx.Unlock()
+	fmt.Fprintf(os.Stderr, "%-30v %10v %10v\n", "channel", "captured", "replayed")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "%-30v %10v %10v\n", name, recordedCount[name], replayedCount[name])
+	}
+}
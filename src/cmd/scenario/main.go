@@ -0,0 +1,66 @@
+package main
+
+import (
+	"../../scenario"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Runs scenario files against simulated elevators
+//   scenario -node=./elevator.out scenarios/*.scn
+
+var nodeExec_ptr = flag.String("node", "./elevator.out", "Elevator executable")
+var commonPort_ptr = flag.Int("bport", 20110, "Broadcast port used by the nodes")
+var simBasePort_ptr = flag.Int("simport", 20120, "Node n connects to its simulated elevator on simport+n")
+var logDir_ptr = flag.String("logdir", "", "Directory for node output")
+var warmup_ptr = flag.Duration("warmup", 3*time.Second, "Time for nodes to initialize before t=0")
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Println("Specify scenario files")
+		os.Exit(1)
+	}
+
+	config := scenario.Config{NodeExec: *nodeExec_ptr,
+		BroadcastPort: *commonPort_ptr,
+		SimBasePort:   *simBasePort_ptr,
+		LogDir:        *logDir_ptr,
+		Warmup:        *warmup_ptr}
+
+	failed := 0
+	for _, fileName := range flag.Args() {
+		f, err := os.Open(fileName)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		sc, err := scenario.Parse(fileName, f)
+		f.Close()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		result, err := scenario.Run(sc, config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if result.Passed() {
+			fmt.Printf("PASS %v\n", fileName)
+		} else {
+			failed++
+			fmt.Printf("FAIL %v\n", fileName)
+			for _, failure := range result.Failures {
+				fmt.Printf("    %v\n", failure)
+			}
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"../../spec"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Specification monitor. Either checks a recorded trace
+//   specmon -check=trace.jsonl
+// or runs live as a proxy in front of each elevator server
+//   specmon -proxy=1,localhost:20021,localhost:20011 -proxy=2,localhost:20022,localhost:20012 -trace=trace.jsonl
+// where the nodes are started with -addr pointing to the proxy port.
+
+type proxyList []string
+
+func (p *proxyList) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *proxyList) Set(value string) error {
+	if len(strings.Split(value, ",")) != 3 {
+		return fmt.Errorf("expected id,listenaddr,upstreamaddr got %v", value)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+var proxies proxyList
+var checkFile_ptr = flag.String("check", "", "Recorded trace to check")
+var traceFile_ptr = flag.String("trace", "", "File to record the live trace to")
+var numFloors_ptr = flag.Int("floors", 4, "Number of floors")
+var serviceTimeout_ptr = flag.Duration("servicetimeout", 60*time.Second, "Time limit for serving accepted orders")
+
+const tickPeriod = 100 * time.Millisecond
+
+func main() {
+	flag.Var(&proxies, "proxy", "id,listenaddr,upstreamaddr of an elevator to monitor (repeatable)")
+	flag.Parse()
+
+	Info := log.New(os.Stdout, "[spec]: ", 0)
+
+	config := spec.DefaultConfig(*numFloors_ptr)
+	config.ServiceTimeout = *serviceTimeout_ptr
+
+	if *checkFile_ptr != "" {
+		f, err := os.Open(*checkFile_ptr)
+		if err != nil {
+			Info.Fatal(err)
+		}
+		events, err := spec.ReadTrace(f)
+		f.Close()
+		if err != nil {
+			Info.Fatal(err)
+		}
+		violations := spec.CheckTrace(config, events)
+		for _, v := range violations {
+			Info.Println(v)
+		}
+		Info.Printf("%v events, %v violations\n", len(events), len(violations))
+		if len(violations) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(proxies) == 0 {
+		fmt.Println("Specify -check or at least one -proxy")
+		os.Exit(1)
+	}
+
+	var trace *spec.TraceWriter
+	if *traceFile_ptr != "" {
+		f, err := os.Create(*traceFile_ptr)
+		if err != nil {
+			Info.Fatal(err)
+		}
+		defer f.Close()
+		trace = spec.NewTraceWriter(f)
+	}
+
+	eventCh := make(chan spec.Event, 64)
+	for _, p := range proxies {
+		fields := strings.Split(p, ",")
+		id, listenAddr, upstreamAddr := fields[0], fields[1], fields[2]
+		go func() {
+			err := spec.Proxy(listenAddr, upstreamAddr, id, eventCh)
+			Info.Fatalf("proxy for %v: %v\n", id, err)
+		}()
+		Info.Printf("monitoring elevator %v on %v -> %v\n", id, listenAddr, upstreamAddr)
+	}
+
+	checker := spec.NewChecker(config)
+	for {
+		var violations []spec.Violation
+		select {
+		case ev := <-eventCh:
+			if trace != nil {
+				trace.Write(ev)
+			}
+			violations = checker.Feed(ev)
+		case <-time.After(tickPeriod):
+			violations = checker.Tick(time.Now())
+		}
+		for _, v := range violations {
+			Info.Println(v)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package bcast
 
 import (
+	"../../metrics"
 	"../conn"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"strings"
 )
 
+var decodeFailures = metrics.NewCounter("elevator_bcast_decode_failures_total",
+	"Received messages that could not be decoded, by message type", "type")
+
 // Encodes received values from `chans` into type-tagged JSON, then broadcasts
 // it on `port`
 func Transmitter(port int, chans ...interface{}) {
@@ -43,16 +47,19 @@ func Transmitter(port int, chans ...interface{}) {
 func Receiver(port int, chans ...interface{}) {
 	checkArgs(chans...)
 
-	var buf [1024]byte
+	var buf [conn.MaxPacketSize]byte
 	conn := conn.DialBroadcastUDP(port)
 	for {
 		n, _, _ := conn.ReadFrom(buf[0:])
 		for _, ch := range chans {
 			T := reflect.TypeOf(ch).Elem()
 			typeName := T.String()
-			if strings.HasPrefix(string(buf[0:n])+"{", typeName) {
+			if strings.HasPrefix(string(buf[0:n]), typeName+"{") {
 				v := reflect.New(T)
-				json.Unmarshal(buf[len(typeName):n], v.Interface())
+				if err := json.Unmarshal(buf[len(typeName):n], v.Interface()); err != nil {
+					decodeFailures.Inc(typeName)
+					continue
+				}
 
 				reflect.Select([]reflect.SelectCase{{
 					Dir:  reflect.SelectSend,
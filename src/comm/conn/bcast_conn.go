@@ -32,5 +32,8 @@ func DialBroadcastUDP(port int) net.PacketConn {
 	conn, _ := net.FilePacketConn(f)
 	f.Close()
 
+	if emulateLoss {
+		return lossyPacketConn{conn}
+	}
 	return conn
 }
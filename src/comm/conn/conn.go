@@ -0,0 +1,8 @@
+package conn
+
+// Receive buffer size for the broadcast port. Heartbeats grow with the number
+// of outstanding orders, one larger than MaxDatagramSize is sent in parts.
+const MaxPacketSize = 65536
+
+// Largest udp payload over ipv4
+const MaxDatagramSize = 65507
@@ -0,0 +1,63 @@
+package conn
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sync/atomic"
+)
+
+// Emulated packet loss for testing, equivalent to dropping a share of the
+// incoming udp packets with iptables. An isolated node neither sends nor
+// receives, as if its network cable was pulled. Only conns dialed after
+// EmulateLoss are wrapped, so a node not under test reads its socket
+// directly.
+
+var emulateLoss bool
+var lossRateBits uint64
+var isolated int32
+
+// EmulateLoss must be called before the conns are dialed
+func EmulateLoss() {
+	emulateLoss = true
+}
+
+func SetLossRate(p float64) {
+	atomic.StoreUint64(&lossRateBits, math.Float64bits(p))
+}
+
+func LossRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&lossRateBits))
+}
+
+func SetIsolated(on bool) {
+	if on {
+		atomic.StoreInt32(&isolated, 1)
+	} else {
+		atomic.StoreInt32(&isolated, 0)
+	}
+}
+
+func isIsolated() bool {
+	return atomic.LoadInt32(&isolated) == 1
+}
+
+type lossyPacketConn struct {
+	net.PacketConn
+}
+
+func (c lossyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || (rand.Float64() >= LossRate() && !isIsolated()) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if isIsolated() {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,55 @@
+package dissect
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Captures of the broadcast port, stored as one JSON object per line with the
+// raw packet, when it was received and where it came from
+
+type Record struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Data   []byte    `json:"data"`
+}
+
+type CaptureWriter struct {
+	mtx     sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{encoder: json.NewEncoder(w)}
+}
+
+func (c *CaptureWriter) Write(r Record) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.encoder.Encode(r)
+}
+
+func ReadCapture(r io.Reader) ([]Record, error) {
+	var records []Record
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var record Record
+		if err := decoder.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// DecodeRecord decodes a captured packet with the time and source of the capture
+func DecodeRecord(r Record) (Packet, error) {
+	p, err := Decode(r.Data)
+	p.Time = r.Time
+	p.Source = r.Source
+	return p, err
+}
@@ -0,0 +1,214 @@
+package dissect
+
+import (
+	"../../elevio"
+	"../../msgs"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Decodes packets seen on the common broadcast port. The port carries the raw
+// JSON heartbeats of peers, the type-tagged beacons, deltas, heartbeat parts,
+// acks and resync requests of peers and the type-tagged JSON messages of bcast, see
+// bcast.Transmitter.
+
+type Kind int
+
+const (
+	KIND_Heartbeat Kind = iota // peers heartbeat
+	KIND_Message               // bcast message
+	KIND_Beacon                // peers beacon, delta, heartbeat part, ack or resync request
+	KIND_Unknown
+)
+
+// Type names of the messages sent by the commhandler and raft, the tag is the
+// name of the Go type as formatted by reflect
+var messageTypes = []reflect.Type{
+	reflect.TypeOf(msgs.PlacedOrderMsg{}),
+	reflect.TypeOf(msgs.PlacedOrderAck{}),
+	reflect.TypeOf(msgs.TakeOrderMsg{}),
+	reflect.TypeOf(msgs.TakeOrderAck{}),
+	reflect.TypeOf(msgs.CompleteOrderMsg{}),
+	reflect.TypeOf(msgs.CompleteOrderAck{}),
+	reflect.TypeOf(msgs.RescueOrderMsg{}),
+	reflect.TypeOf(msgs.CabBackupMsg{}),
+	reflect.TypeOf(msgs.CabBackupAck{}),
+	reflect.TypeOf(msgs.CabRestoreRequest{}),
+	reflect.TypeOf(msgs.Beacon{}),
+	reflect.TypeOf(msgs.ResyncRequest{}),
+	reflect.TypeOf(msgs.HeartbeatDelta{}),
+	reflect.TypeOf(msgs.HeartbeatChunk{}),
+	reflect.TypeOf(msgs.VersionAck{}),
+	reflect.TypeOf(msgs.RaftVoteRequest{}),
+	reflect.TypeOf(msgs.RaftVoteReply{}),
+	reflect.TypeOf(msgs.RaftAppend{}),
+	reflect.TypeOf(msgs.RaftAppendReply{}),
+	reflect.TypeOf(msgs.RaftProposal{}),
+}
+
+var peersTypes = map[reflect.Type]bool{
+	reflect.TypeOf(msgs.Beacon{}):         true,
+	reflect.TypeOf(msgs.ResyncRequest{}):  true,
+	reflect.TypeOf(msgs.HeartbeatDelta{}): true,
+	reflect.TypeOf(msgs.HeartbeatChunk{}): true,
+	reflect.TypeOf(msgs.VersionAck{}):     true,
+}
+
+type Packet struct {
+	Time    time.Time
+	Source  string
+	Kind    Kind
+	Type    string      // bcast type tag, e.g. "msgs.TakeOrderMsg"
+	Message interface{} // msgs.Heartbeat for heartbeats, the tagged type for messages
+	Raw     []byte
+}
+
+// Decode parses one packet. Unknown packets are returned as KIND_Unknown
+// together with an error
+func Decode(data []byte) (Packet, error) {
+	p := Packet{Time: time.Now(), Kind: KIND_Unknown, Raw: append([]byte(nil), data...)}
+
+	if len(data) > 0 && data[0] == '{' {
+		var heartbeat msgs.Heartbeat
+		if err := json.Unmarshal(data, &heartbeat); err != nil {
+			return p, err
+		}
+		p.Kind = KIND_Heartbeat
+		p.Message = heartbeat
+		return p, nil
+	}
+
+	for _, T := range messageTypes {
+		typeName := T.String()
+		if !strings.HasPrefix(string(data), typeName+"{") {
+			continue
+		}
+		v := reflect.New(T)
+		if err := json.Unmarshal(data[len(typeName):], v.Interface()); err != nil {
+			return p, fmt.Errorf("%v: %v", typeName, err)
+		}
+		p.Kind = KIND_Message
+		if peersTypes[T] {
+			p.Kind = KIND_Beacon
+		}
+		p.Type = typeName
+		p.Message = v.Elem().Interface()
+		return p, nil
+	}
+	return p, fmt.Errorf("unknown packet of %v bytes", len(data))
+}
+
+// Order returns the order message carried by the packet, if any
+func (p Packet) Order() (msgs.OrderMsg, bool) {
+	switch m := p.Message.(type) {
+	case msgs.PlacedOrderMsg:
+		return msgs.OrderMsg(m), true
+	case msgs.PlacedOrderAck:
+		return msgs.OrderMsg(m), true
+	case msgs.TakeOrderMsg:
+		return msgs.OrderMsg(m), true
+	case msgs.TakeOrderAck:
+		return msgs.OrderMsg(m), true
+	case msgs.CompleteOrderMsg:
+		return msgs.OrderMsg(m), true
+	case msgs.CompleteOrderAck:
+		return msgs.OrderMsg(m), true
+	case msgs.RescueOrderMsg:
+		return msgs.OrderMsg(m), true
+	}
+	return msgs.OrderMsg{}, false
+}
+
+func ButtonName(button elevio.ButtonType) string {
+	switch button {
+	case elevio.BT_HallUp:
+		return "hall-up"
+	case elevio.BT_HallDown:
+		return "hall-down"
+	case elevio.BT_Cab:
+		return "cab"
+	default:
+		return "somebutton"
+	}
+}
+
+// Summary describes the packet on one line
+func (p Packet) Summary() string {
+	switch p.Kind {
+	case KIND_Heartbeat:
+		heartbeat := p.Message.(msgs.Heartbeat)
+		return fmt.Sprintf("heartbeat from %v version %v: floor %v dir %v state %v, %v accepted, %v taken",
+			heartbeat.SenderID, heartbeat.Version, heartbeat.Status.Floor, heartbeat.Status.Dir, heartbeat.Status.State,
+			len(heartbeat.AcceptedOrders), len(heartbeat.TakenOrders))
+	case KIND_Beacon:
+		switch m := p.Message.(type) {
+		case msgs.Beacon:
+			return fmt.Sprintf("beacon from %v version %v", m.SenderID, m.Version)
+		case msgs.ResyncRequest:
+			return fmt.Sprintf("resync request for %v", m.TargetID)
+		case msgs.HeartbeatDelta:
+			return fmt.Sprintf("delta from %v version %v -> %v: %v accepted, %v taken changed",
+				m.SenderID, m.Base, m.Version, len(m.AcceptedOrders), len(m.TakenOrders))
+		case msgs.HeartbeatChunk:
+			return fmt.Sprintf("heartbeat part %v/%v from %v version %v: %v bytes",
+				m.Index+1, m.Count, m.SenderID, m.Version, len(m.Data))
+		case msgs.VersionAck:
+			return fmt.Sprintf("version ack %v -> %v: version %v", m.SenderID, m.TargetID, m.Version)
+		}
+	case KIND_Message:
+		if orderMsg, isOrder := p.Order(); isOrder {
+			order := orderMsg.Order
+			receiver := orderMsg.ReceiverID
+			if receiver == "" {
+				receiver = "all"
+			}
+			summary := fmt.Sprintf("%v %v -> %v: order %v %v floor %v",
+				strings.TrimPrefix(p.Type, "msgs."), orderMsg.SenderID, receiver,
+				order.ID, ButtonName(order.Type), order.Floor)
+			if order.MasterID != "" {
+				summary += fmt.Sprintf(" (master %v)", order.MasterID)
+			}
+			if orderMsg.Seq != 0 {
+				summary += fmt.Sprintf(" seq %v", orderMsg.Seq)
+			}
+			if orderMsg.AckSeq != 0 {
+				summary += fmt.Sprintf(" acks %v", orderMsg.AckSeq)
+			}
+			if orderMsg.Clock != 0 {
+				summary += fmt.Sprintf(" clock %v", orderMsg.Clock)
+			}
+			return summary
+		}
+		switch m := p.Message.(type) {
+		case msgs.CabBackupMsg:
+			receiver := m.TargetID
+			if receiver == "" {
+				receiver = "all"
+			}
+			return fmt.Sprintf("CabBackupMsg %v -> %v: cab orders %v of %v seq %v clock %v",
+				m.SenderID, receiver, m.CabOrders, m.OwnerID, m.Seq, m.Clock)
+		case msgs.CabBackupAck:
+			return fmt.Sprintf("CabBackupAck %v -> %v: acks %v clock %v", m.SenderID, m.ReceiverID, m.AckSeq, m.Clock)
+		case msgs.CabRestoreRequest:
+			return fmt.Sprintf("CabRestoreRequest from %v clock %v", m.SenderID, m.Clock)
+		case msgs.RaftVoteRequest:
+			return fmt.Sprintf("RaftVoteRequest from %v term %v, last entry %v of term %v",
+				m.CandidateID, m.Term, m.LastLogIndex, m.LastLogTerm)
+		case msgs.RaftVoteReply:
+			return fmt.Sprintf("RaftVoteReply %v -> %v term %v: granted %v", m.SenderID, m.TargetID, m.Term, m.Granted)
+		case msgs.RaftAppend:
+			return fmt.Sprintf("RaftAppend %v -> %v term %v: %v entries after %v, commit %v",
+				m.LeaderID, m.TargetID, m.Term, len(m.Entries), m.PrevLogIndex, m.LeaderCommit)
+		case msgs.RaftAppendReply:
+			return fmt.Sprintf("RaftAppendReply %v -> %v term %v: success %v, match %v",
+				m.SenderID, m.TargetID, m.Term, m.Success, m.MatchIndex)
+		case msgs.RaftProposal:
+			return fmt.Sprintf("RaftProposal %v -> %v: %v order %v %v floor %v", m.SenderID, m.TargetID,
+				m.Entry.Event, m.Entry.Order.ID, ButtonName(m.Entry.Order.Type), m.Entry.Order.Floor)
+		}
+	}
+	return fmt.Sprintf("unknown packet of %v bytes", len(p.Raw))
+}
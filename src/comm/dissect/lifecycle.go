@@ -0,0 +1,193 @@
+package dissect
+
+import (
+	"../../msgs"
+	"fmt"
+	"time"
+)
+
+// Reconstruction of each order's lifecycle from the order messages of all
+// nodes: place -> ack -> take -> take-ack -> complete -> complete-ack. A place
+// after a complete starts a new lifecycle, in case an ID is placed again. An
+// order that is escalated is also rescued, which is not acknowledged.
+
+type Step int
+
+const (
+	STEP_Place Step = iota
+	STEP_PlaceAck
+	STEP_Take
+	STEP_TakeAck
+	STEP_Complete
+	STEP_CompleteAck
+	STEP_Rescue
+)
+
+func (s Step) String() string {
+	switch s {
+	case STEP_Place:
+		return "place"
+	case STEP_PlaceAck:
+		return "place-ack"
+	case STEP_Take:
+		return "take"
+	case STEP_TakeAck:
+		return "take-ack"
+	case STEP_Complete:
+		return "complete"
+	case STEP_CompleteAck:
+		return "complete-ack"
+	case STEP_Rescue:
+		return "rescue"
+	default:
+		return "somestep"
+	}
+}
+
+func (s Step) isAck() bool {
+	return s == STEP_PlaceAck || s == STEP_TakeAck || s == STEP_CompleteAck
+}
+
+// One message between two nodes, copies of it are counted
+type Transmission struct {
+	Step       Step
+	SenderID   string
+	ReceiverID string
+	Times      []time.Time // every copy seen
+}
+
+type Lifecycle struct {
+	Order         msgs.Order
+	Start         time.Time
+	Transmissions []*Transmission // in order of the first copy
+	Problems      []string
+}
+
+func (lc *Lifecycle) has(step Step) bool {
+	for _, t := range lc.Transmissions {
+		if t.Step == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Completed lifecycles have been completed and acknowledged
+func (lc *Lifecycle) Completed() bool {
+	return lc.has(STEP_Complete) && lc.has(STEP_CompleteAck)
+}
+
+func stepOf(p Packet) (Step, bool) {
+	switch p.Message.(type) {
+	case msgs.PlacedOrderMsg:
+		return STEP_Place, true
+	case msgs.PlacedOrderAck:
+		return STEP_PlaceAck, true
+	case msgs.TakeOrderMsg:
+		return STEP_Take, true
+	case msgs.TakeOrderAck:
+		return STEP_TakeAck, true
+	case msgs.CompleteOrderMsg:
+		return STEP_Complete, true
+	case msgs.CompleteOrderAck:
+		return STEP_CompleteAck, true
+	case msgs.RescueOrderMsg:
+		return STEP_Rescue, true
+	}
+	return STEP_Place, false
+}
+
+// Analyze groups the order messages of packets (sorted by time) in lifecycles
+// and checks them for missing acks and duplicates
+func Analyze(packets []Packet) []*Lifecycle {
+	var lifecycles []*Lifecycle
+	open := make(map[string]*Lifecycle)
+
+	for _, p := range packets {
+		step, isOrder := stepOf(p)
+		if !isOrder {
+			continue
+		}
+		orderMsg, _ := p.Order()
+		lc, exists := open[orderMsg.Order.ID]
+		if !exists || (step == STEP_Place && lc.has(STEP_Complete)) {
+			lc = &Lifecycle{Order: orderMsg.Order, Start: p.Time}
+			open[orderMsg.Order.ID] = lc
+			lifecycles = append(lifecycles, lc)
+		}
+		if lc.Order.MasterID == "" {
+			lc.Order.MasterID = orderMsg.Order.MasterID
+		}
+
+		// places and completes are for all nodes, retransmissions may carry a receiver
+		if step == STEP_Place || step == STEP_Complete || step == STEP_Rescue {
+			orderMsg.ReceiverID = ""
+		}
+		var transmission *Transmission
+		for _, t := range lc.Transmissions {
+			if t.Step == step && t.SenderID == orderMsg.SenderID && t.ReceiverID == orderMsg.ReceiverID {
+				transmission = t
+			}
+		}
+		if transmission == nil {
+			transmission = &Transmission{Step: step, SenderID: orderMsg.SenderID, ReceiverID: orderMsg.ReceiverID}
+			lc.Transmissions = append(lc.Transmissions, transmission)
+		}
+		transmission.Times = append(transmission.Times, p.Time)
+	}
+
+	for _, lc := range lifecycles {
+		lc.check()
+	}
+	return lifecycles
+}
+
+// the ack of a message from sender, nil if it was never acknowledged
+func (lc *Lifecycle) ackOf(t *Transmission) *Transmission {
+	for _, ack := range lc.Transmissions {
+		if ack.Step != t.Step+1 || ack.ReceiverID != t.SenderID {
+			continue
+		}
+		// a take is acknowledged by the elevator it was sent to
+		if t.Step == STEP_Take && ack.SenderID != t.ReceiverID {
+			continue
+		}
+		return ack
+	}
+	return nil
+}
+
+func (lc *Lifecycle) check() {
+	for _, t := range lc.Transmissions {
+		if t.Step.isAck() {
+			if len(t.Times) > 1 {
+				lc.Problems = append(lc.Problems, fmt.Sprintf("duplicate %v from %v to %v, seen %v times",
+					t.Step, t.SenderID, t.ReceiverID, len(t.Times)))
+			}
+			continue
+		}
+		if t.Step == STEP_Rescue {
+			continue
+		}
+
+		ack := lc.ackOf(t)
+		if ack == nil {
+			lc.Problems = append(lc.Problems, fmt.Sprintf("missing ack for %v from %v", t.Step, t.SenderID))
+			continue
+		}
+		// copies sent before the ack arrived are retransmissions
+		afterAck := 0
+		for _, sent := range t.Times {
+			if sent.After(ack.Times[0]) {
+				afterAck++
+			}
+		}
+		if afterAck > 0 {
+			lc.Problems = append(lc.Problems, fmt.Sprintf("duplicate %v from %v, %v copies after it was acknowledged",
+				t.Step, t.SenderID, afterAck))
+		}
+	}
+	if lc.has(STEP_Complete) && !lc.has(STEP_Take) && !lc.has(STEP_Rescue) && lc.has(STEP_Place) {
+		lc.Problems = append(lc.Problems, "completed without being taken")
+	}
+}
@@ -0,0 +1,155 @@
+package peers
+
+import (
+	"../../msgs"
+	"reflect"
+)
+
+// A change to the heartbeat is sent as a msgs.HeartbeatDelta from the last
+// version every alive peer has acknowledged with a msgs.VersionAck, so its
+// size follows what changed rather than the number of floors and orders. A
+// receiver applies it only if it holds exactly the base version, otherwise it
+// asks for the full heartbeat with a msgs.ResyncRequest. Full heartbeats are
+// still sent on resync requests, when a peer has not acknowledged any version
+// yet, and every antiEntropyInterval until all peers have acknowledged the
+// current version. Peers that do not know this node yet see its beacons.
+
+const deltaHistoryLength = 32 // sent versions kept as delta bases
+
+func diffOrders(base, current map[string]msgs.Order) map[string]*msgs.Order {
+	var changes map[string]*msgs.Order
+	set := func(id string, order *msgs.Order) {
+		if changes == nil {
+			changes = make(map[string]*msgs.Order)
+		}
+		changes[id] = order
+	}
+	for id, order := range current {
+		if baseOrder, exists := base[id]; !exists || baseOrder != order {
+			order := order
+			set(id, &order)
+		}
+	}
+	for id := range base {
+		if _, exists := current[id]; !exists {
+			set(id, nil)
+		}
+	}
+	return changes
+}
+
+func applyOrders(base map[string]msgs.Order, changes map[string]*msgs.Order) map[string]msgs.Order {
+	if base == nil && changes == nil {
+		return nil
+	}
+	result := make(map[string]msgs.Order)
+	for id, order := range base {
+		result[id] = order
+	}
+	for id, order := range changes {
+		if order == nil {
+			delete(result, id)
+		} else {
+			result[id] = *order
+		}
+	}
+	return result
+}
+
+func diff(base, current msgs.Heartbeat) msgs.HeartbeatDelta {
+	delta := msgs.HeartbeatDelta{SenderID: current.SenderID, Boot: current.Boot,
+		Base: base.Version, Version: current.Version, Clock: current.Clock}
+
+	status := current.Status
+	if status.Floor != base.Status.Floor {
+		delta.Floor = &status.Floor
+	}
+	if status.Dir != base.Status.Dir {
+		delta.Dir = &status.Dir
+	}
+	if status.Orders != base.Status.Orders {
+		delta.Orders = &status.Orders
+	}
+	if status.CompletedOrders != base.Status.CompletedOrders {
+		delta.CompletedOrders = &status.CompletedOrders
+	}
+	if status.Lights != base.Status.Lights {
+		delta.Lights = &status.Lights
+	}
+	if status.State != base.Status.State {
+		delta.State = &status.State
+	}
+
+	delta.AcceptedOrders = diffOrders(base.AcceptedOrders, current.AcceptedOrders)
+	delta.TakenOrders = diffOrders(base.TakenOrders, current.TakenOrders)
+	for orderID, elevatorID := range current.ChosenElevatorForOrder {
+		if baseID, exists := base.ChosenElevatorForOrder[orderID]; !exists || baseID != elevatorID {
+			if delta.ChosenElevatorForOrder == nil {
+				delta.ChosenElevatorForOrder = make(map[string]*string)
+			}
+			elevatorID := elevatorID
+			delta.ChosenElevatorForOrder[orderID] = &elevatorID
+		}
+	}
+	for orderID := range base.ChosenElevatorForOrder {
+		if _, exists := current.ChosenElevatorForOrder[orderID]; !exists {
+			if delta.ChosenElevatorForOrder == nil {
+				delta.ChosenElevatorForOrder = make(map[string]*string)
+			}
+			delta.ChosenElevatorForOrder[orderID] = nil
+		}
+	}
+
+	if !reflect.DeepEqual(base.HallCalls, current.HallCalls) {
+		delta.HallCalls = current.HallCalls
+	}
+	return delta
+}
+
+// ApplyDelta returns a new heartbeat, base is not modified. The caller checks
+// that base has the version the delta is based on.
+func ApplyDelta(base msgs.Heartbeat, delta msgs.HeartbeatDelta) msgs.Heartbeat {
+	heartbeat := base
+	heartbeat.Version = delta.Version
+	heartbeat.Clock = delta.Clock
+
+	if delta.Floor != nil {
+		heartbeat.Status.Floor = *delta.Floor
+	}
+	if delta.Dir != nil {
+		heartbeat.Status.Dir = *delta.Dir
+	}
+	if delta.Orders != nil {
+		heartbeat.Status.Orders = *delta.Orders
+	}
+	if delta.CompletedOrders != nil {
+		heartbeat.Status.CompletedOrders = *delta.CompletedOrders
+	}
+	if delta.Lights != nil {
+		heartbeat.Status.Lights = *delta.Lights
+	}
+	if delta.State != nil {
+		heartbeat.Status.State = *delta.State
+	}
+
+	heartbeat.AcceptedOrders = applyOrders(base.AcceptedOrders, delta.AcceptedOrders)
+	heartbeat.TakenOrders = applyOrders(base.TakenOrders, delta.TakenOrders)
+	if base.ChosenElevatorForOrder != nil || delta.ChosenElevatorForOrder != nil {
+		heartbeat.ChosenElevatorForOrder = make(map[string]string)
+		for orderID, elevatorID := range base.ChosenElevatorForOrder {
+			heartbeat.ChosenElevatorForOrder[orderID] = elevatorID
+		}
+		for orderID, elevatorID := range delta.ChosenElevatorForOrder {
+			if elevatorID == nil {
+				delete(heartbeat.ChosenElevatorForOrder, orderID)
+			} else {
+				heartbeat.ChosenElevatorForOrder[orderID] = *elevatorID
+			}
+		}
+	}
+
+	if delta.HallCalls != nil {
+		heartbeat.HallCalls = delta.HallCalls
+	}
+	return heartbeat
+}
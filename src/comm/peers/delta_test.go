@@ -0,0 +1,112 @@
+package peers
+
+import (
+	"../../elevio"
+	"../../fsm"
+	"../../msgs"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testOrder(id string, floor int, button elevio.ButtonType) msgs.Order {
+	return msgs.Order{ID: id, MasterID: "A", Floor: floor, Type: button}
+}
+
+func testHeartbeats() []msgs.Heartbeat {
+	idle := msgs.Heartbeat{SenderID: "A", Boot: 7, Version: 1, Clock: 3}
+
+	moving := idle
+	moving.Version, moving.Clock = 2, 5
+	moving.Status.Floor = 2
+	moving.Status.Dir = elevio.MD_Up
+	moving.Status.Orders[3][elevio.BT_Cab] = true
+	moving.Status.Lights[3][elevio.BT_Cab] = true
+	moving.Status.State = fsm.State(1)
+
+	accepting := moving
+	accepting.Version, accepting.Clock = 3, 9
+	accepting.AcceptedOrders = map[string]msgs.Order{
+		"A-1": testOrder("A-1", 1, elevio.BT_HallUp),
+		"A-2": testOrder("A-2", 3, elevio.BT_HallDown)}
+	accepting.ChosenElevatorForOrder = map[string]string{"A-1": "A", "A-2": "B"}
+	accepting.TakenOrders = map[string]msgs.Order{"A-1": testOrder("A-1", 1, elevio.BT_HallUp)}
+
+	moved := accepting
+	moved.Version, moved.Clock = 4, 12
+	moved.Status.Floor = 3
+	moved.Status.CompletedOrders[1][elevio.BT_HallUp] = true
+	moved.AcceptedOrders = map[string]msgs.Order{
+		"A-2": testOrder("A-2", 3, elevio.BT_HallDown),
+		"A-3": testOrder("A-3", 0, elevio.BT_HallUp)}
+	moved.ChosenElevatorForOrder = map[string]string{"A-2": "A", "A-3": "C"}
+	moved.TakenOrders = map[string]msgs.Order{"A-2": testOrder("A-2", 3, elevio.BT_HallDown)}
+
+	crdt := moved
+	crdt.Version, crdt.Clock = 5, 13
+	crdt.HallCalls = &msgs.HallCalls{}
+	crdt.HallCalls[1][elevio.BT_HallUp] = msgs.HallCall{Counter: 3, SeenBy: []string{"A", "B"}}
+
+	emptied := crdt
+	emptied.Version, emptied.Clock = 6, 20
+	emptied.AcceptedOrders = map[string]msgs.Order{}
+	emptied.ChosenElevatorForOrder = map[string]string{}
+	emptied.TakenOrders = map[string]msgs.Order{}
+	emptied.HallCalls = &msgs.HallCalls{}
+
+	return []msgs.Heartbeat{idle, moving, accepting, moved, crdt, emptied}
+}
+
+// normalized has empty maps where there are none, a delta does not tell
+// them apart
+func normalized(heartbeat msgs.Heartbeat) msgs.Heartbeat {
+	if heartbeat.AcceptedOrders == nil {
+		heartbeat.AcceptedOrders = map[string]msgs.Order{}
+	}
+	if heartbeat.ChosenElevatorForOrder == nil {
+		heartbeat.ChosenElevatorForOrder = map[string]string{}
+	}
+	if heartbeat.TakenOrders == nil {
+		heartbeat.TakenOrders = map[string]msgs.Order{}
+	}
+	return heartbeat
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	heartbeats := testHeartbeats()
+	for i, base := range heartbeats {
+		for j, target := range heartbeats {
+			if target.HallCalls == nil && base.HallCalls != nil {
+				continue // hall calls are never removed from a heartbeat
+			}
+			name := fmt.Sprintf("version %v to %v", base.Version, target.Version)
+
+			// deltas are sent as JSON
+			serialized, err := json.Marshal(diff(base, target))
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			var delta msgs.HeartbeatDelta
+			if err := json.Unmarshal(serialized, &delta); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			if delta.Base != base.Version || delta.Version != target.Version {
+				t.Errorf("%v: delta from %v to %v", name, delta.Base, delta.Version)
+			}
+
+			baseCopy := normalized(heartbeats[i])
+			got := ApplyDelta(base, delta)
+			if !reflect.DeepEqual(normalized(got), normalized(target)) {
+				t.Errorf("%v: got\n%+v\nwant\n%+v", name, got, target)
+			}
+			if !reflect.DeepEqual(normalized(base), baseCopy) {
+				t.Errorf("%v: base modified", name)
+			}
+			if i == j && len(serialized) > len(fmt.Sprintf(`{"sender_id":"A","boot":7,"base":%v,"version":%v,"clock":%v}`,
+				base.Version, target.Version, target.Clock)) {
+				t.Errorf("%v: delta to the same heartbeat is not empty: %s", name, serialized)
+			}
+		}
+	}
+}
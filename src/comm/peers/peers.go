@@ -1,20 +1,45 @@
 package peers
 
 import (
+	"../../logging"
+	"../../metrics"
 	"../../msgs"
 	"../conn"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"reflect"
+	"sort"
 	"time"
 )
 
+var Log = logging.New("peers")
+
+var peersNew = metrics.NewCounter("elevator_peers_new_total", "Peers that have appeared")
+var peersLost = metrics.NewCounter("elevator_peers_lost_total", "Peers that have been lost")
+var peersSuspected = metrics.NewCounter("elevator_peers_suspected_total", "Peers that have been suspected, see phi.go")
+var heartbeatsSent = metrics.NewCounter("elevator_heartbeats_sent_total",
+	"Heartbeats sent, by reason (change, anti_entropy or resync) and encoding (full or delta)", "reason", "encoding")
+var heartbeatBytes = metrics.NewCounter("elevator_heartbeat_bytes_total",
+	"Bytes of heartbeats sent, by encoding (full or delta)", "encoding")
+var resyncRequests = metrics.NewCounter("elevator_resync_requests_total",
+	"Full heartbeats requested because a beacon or delta showed a missed version")
+
 type PeerUpdate struct {
-	Peers []msgs.Heartbeat
-	New   string
-	Lost  []msgs.Heartbeat
+	Peers     []msgs.Heartbeat
+	New       string
+	Lost      []msgs.Heartbeat
+	Suspected []string // alive, but silent for longer than usual
+	LastSeen  map[string]time.Time
+	Phi       map[string]float64
+}
+
+// Sent by the Receiver to the Transmitter of the same node
+type Sync struct {
+	Resync bool   // a peer asked for the full heartbeat
+	Boot   int64  // of the acknowledged heartbeat
+	Base   uint64 // version all peers have acknowledged, 0 if there is none
 }
 
 type observation struct {
@@ -22,10 +47,92 @@ type observation struct {
 	Heartbeat msgs.Heartbeat
 }
 
+// Every interval a small msgs.Beacon is sent, which is what the failure
+// detector measures. The heartbeat is only sent when it changes, every
+// antiEntropyInterval while a peer has not acknowledged it, and when a peer
+// asks for it with a msgs.ResyncRequest because a beacon carried a version it
+// has not seen. Changes are sent as deltas when possible, see delta.go.
+// Beacons, deltas, acks and resync requests are type-tagged like bcast
+// messages, full heartbeats are plain JSON. A full heartbeat larger than a
+// datagram is sent in type-tagged parts of heartbeatChunkSize bytes, which
+// the receiver joins, and a delta that large is sent as a full heartbeat.
+
 const interval = 100 * time.Millisecond
-const timeout = 2000 * time.Millisecond
+const antiEntropyInterval = 1000 * time.Millisecond
+const lastSeenUpdatePeriod = 1000 * time.Millisecond // updates are sent at least this often
+const maxHeartbeatSize = conn.MaxDatagramSize        // larger full heartbeats are sent in parts
+const heartbeatChunkSize = maxHeartbeatSize / 2      // the base64 encoding of a part grows it by a third
+
+var beaconTag = reflect.TypeOf(msgs.Beacon{}).String()
+var resyncRequestTag = reflect.TypeOf(msgs.ResyncRequest{}).String()
+var deltaTag = reflect.TypeOf(msgs.HeartbeatDelta{}).String()
+var versionAckTag = reflect.TypeOf(msgs.VersionAck{}).String()
+var chunkTag = reflect.TypeOf(msgs.HeartbeatChunk{}).String()
+
+func tagged(tag string, v interface{}) []byte {
+	serialized, _ := json.Marshal(v)
+	return append([]byte(tag), serialized...)
+}
+
+// isNewer compares the version of heartbeats from the same sender. A restarted
+// sender has a later boot time and starts over from version 1.
+func isNewer(boot int64, version uint64, than msgs.Heartbeat) bool {
+	return boot > than.Boot || (boot == than.Boot && version > than.Version)
+}
+
+// remember keeps the heartbeat as a delta base, and forgets the one
+// deltaHistoryLength versions older
+func remember(history map[uint64]msgs.Heartbeat, heartbeat msgs.Heartbeat) {
+	history[heartbeat.Version] = heartbeat
+	if heartbeat.Version > deltaHistoryLength {
+		delete(history, heartbeat.Version-deltaHistoryLength)
+	}
+}
+
+// split cuts the serialized heartbeat into parts of heartbeatChunkSize bytes
+func split(heartbeat msgs.Heartbeat, serialized []byte) []msgs.HeartbeatChunk {
+	count := (len(serialized) + heartbeatChunkSize - 1) / heartbeatChunkSize
+	chunks := make([]msgs.HeartbeatChunk, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * heartbeatChunkSize
+		if end > len(serialized) {
+			end = len(serialized)
+		}
+		chunks = append(chunks, msgs.HeartbeatChunk{SenderID: heartbeat.SenderID,
+			Boot: heartbeat.Boot, Version: heartbeat.Version,
+			Index: i, Count: count, Data: serialized[i*heartbeatChunkSize : end]})
+	}
+	return chunks
+}
+
+// join gathers the part in chunks, and returns the serialized heartbeat once
+// all its parts have arrived. A part of another version than the ones
+// gathered for the sender drops them.
+func join(chunks map[string][]msgs.HeartbeatChunk, chunk msgs.HeartbeatChunk) []byte {
+	parts := chunks[chunk.SenderID]
+	if len(parts) != chunk.Count || parts[0].Boot != chunk.Boot || parts[0].Version != chunk.Version {
+		parts = make([]msgs.HeartbeatChunk, chunk.Count)
+		for i := range parts {
+			parts[i].Boot, parts[i].Version, parts[i].Index = chunk.Boot, chunk.Version, -1
+		}
+		chunks[chunk.SenderID] = parts
+	}
+	parts[chunk.Index] = chunk
+
+	var joined []byte
+	for _, part := range parts {
+		if part.Index < 0 {
+			return nil
+		}
+		joined = append(joined, part.Data...)
+	}
+	delete(chunks, chunk.SenderID)
+	return joined
+}
 
-func Transmitter(port int, transmitEnable <-chan bool, statusCh <-chan msgs.Heartbeat) {
+// syncCh has the resync requests and acknowledgements of this node received
+// by the Receiver
+func Transmitter(port int, transmitEnable <-chan bool, statusCh <-chan msgs.Heartbeat, syncCh <-chan Sync) {
 
 	conn := conn.DialBroadcastUDP(port)
 	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", port))
@@ -33,80 +140,306 @@ func Transmitter(port int, transmitEnable <-chan bool, statusCh <-chan msgs.Hear
 	enable := true
 	statusRecieved := false
 	var recievedStatus msgs.Heartbeat
+	boot := time.Now().UnixNano()
+	history := make(map[uint64]msgs.Heartbeat) // sent versions that may become delta bases
+	var base uint64
+	beaconTicker := time.NewTicker(interval)
+	antiEntropyTicker := time.NewTicker(antiEntropyInterval)
+
+	send := func(data []byte) {
+		if _, err := conn.WriteTo(data, addr); err != nil {
+			Log.Warnf("%v\n", err)
+		}
+	}
+	sendHeartbeat := func(reason string) {
+		if !enable || !statusRecieved {
+			return
+		}
+		serialized, err := json.Marshal(recievedStatus)
+		if err != nil {
+			Log.Warnf("%v\n", err)
+			return
+		}
+		heartbeatsSent.Inc(reason, "full")
+		heartbeatBytes.Add(float64(len(serialized)), "full")
+		if len(serialized) <= maxHeartbeatSize {
+			send(serialized)
+			return
+		}
+		chunks := split(recievedStatus, serialized)
+		Log.Debugf("heartbeat of %v bytes sent in %v parts\n", len(serialized), len(chunks))
+		for _, chunk := range chunks {
+			send(tagged(chunkTag, chunk))
+		}
+	}
+	sendChange := func() {
+		baseHeartbeat, exists := history[base]
+		if !enable || base == 0 || !exists {
+			sendHeartbeat("change")
+			return
+		}
+		serialized := tagged(deltaTag, diff(baseHeartbeat, recievedStatus))
+		if len(serialized) > maxHeartbeatSize {
+			sendHeartbeat("change")
+			return
+		}
+		heartbeatsSent.Inc("change", "delta")
+		heartbeatBytes.Add(float64(len(serialized)), "delta")
+		send(serialized)
+	}
+
 	for {
 		select {
 		case enable = <-transmitEnable:
-		case recievedStatus = <-statusCh:
+		case status := <-statusCh:
+			status.Boot, status.Version = recievedStatus.Boot, recievedStatus.Version
+			if statusRecieved && reflect.DeepEqual(status, recievedStatus) {
+				break
+			}
+			status.Boot, status.Version = boot, recievedStatus.Version+1
+			recievedStatus = status
 			statusRecieved = true
-		case <-time.After(interval):
-		}
-		if enable && statusRecieved {
-			serialized, err := json.Marshal(recievedStatus)
-			if err != nil {
-				log.Println("[peer]", err)
-				continue
+			remember(history, status)
+			sendChange()
+		case sync := <-syncCh:
+			if sync.Resync {
+				sendHeartbeat("resync")
+			} else if sync.Boot == boot {
+				base = sync.Base
+			}
+		case <-antiEntropyTicker.C:
+			if base != recievedStatus.Version {
+				sendHeartbeat("anti_entropy")
 			}
-			_, err = conn.WriteTo(serialized, addr)
-			if err != nil {
-				log.Println("[peer]", err)
-				continue
+		case <-beaconTicker.C:
+			if enable && statusRecieved {
+				send(tagged(beaconTag, msgs.Beacon{SenderID: recievedStatus.SenderID,
+					Boot: recievedStatus.Boot, Version: recievedStatus.Version}))
 			}
+		}
+	}
+}
 
+// ackedBase is the newest version of this node's heartbeat that all other
+// alive peers have acknowledged
+func ackedBase(thisID string, lastSeen map[string]observation, acked map[string]msgs.VersionAck) (int64, uint64) {
+	own, exists := lastSeen[thisID]
+	if !exists || len(lastSeen) < 2 {
+		return 0, 0
+	}
+	base := own.Heartbeat.Version
+	for id := range lastSeen {
+		if id == thisID {
+			continue
+		}
+		ack, exists := acked[id]
+		if !exists || ack.Boot != own.Heartbeat.Boot {
+			return 0, 0
+		}
+		if ack.Version < base {
+			base = ack.Version
 		}
 	}
+	return own.Heartbeat.Boot, base
 }
 
-func Receiver(port int, peerUpdateCh chan<- PeerUpdate) {
+// Peers are lost when their phi reaches phiThreshold, see phi.go. Resync
+// requests and acknowledgements for this node are passed on to the
+// Transmitter on syncCh.
+func Receiver(port int, thisID string, phiThreshold float64, peerUpdateCh chan<- PeerUpdate, syncCh chan<- Sync) {
 
-	var buf [1024]byte
+	var buf [conn.MaxPacketSize]byte
 	var p PeerUpdate
 	lastSeen := make(map[string]observation)
+	arrivals := make(map[string]*arrivalWindow)
+	suspected := make(map[string]bool)
+	lastResyncRequest := make(map[string]time.Time)
+	acked := make(map[string]msgs.VersionAck)        // acknowledgements of the heartbeat of this node
+	chunks := make(map[string][]msgs.HeartbeatChunk) // parts of the last heartbeat of each peer sent in parts
+	var lastSync Sync
+	lastUpdate := time.Now()
 
 	conn := conn.DialBroadcastUDP(port)
+	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", port))
+
+	send := func(data []byte) {
+		if _, err := conn.WriteTo(data, addr); err != nil {
+			Log.Warnf("%v\n", err)
+		}
+	}
+	// at most one request per peer and beacon interval, the heartbeat may be underway
+	requestResync := func(id string) {
+		if time.Since(lastResyncRequest[id]) < interval {
+			return
+		}
+		lastResyncRequest[id] = time.Now()
+		resyncRequests.Inc()
+		send(tagged(resyncRequestTag, msgs.ResyncRequest{TargetID: id}))
+	}
+	acknowledge := func(heartbeat msgs.Heartbeat) {
+		if heartbeat.SenderID != thisID {
+			send(tagged(versionAckTag, msgs.VersionAck{SenderID: thisID, TargetID: heartbeat.SenderID,
+				Boot: heartbeat.Boot, Version: heartbeat.Version}))
+		}
+	}
+	observe := func(heartbeat msgs.Heartbeat) {
+		id := heartbeat.SenderID
+		_, known := lastSeen[id]
+		lastSeen[id] = observation{Time: time.Now(), Heartbeat: heartbeat}
+		acknowledge(heartbeat)
+
+		// Adding new connection
+		if !known {
+			p.New = id
+			peersNew.Inc()
+			arrivals[id] = newArrivalWindow(time.Now())
+		}
+	}
+
+	// returns whether the heartbeat was new
+	receiveHeartbeat := func(data []byte) bool {
+		var heartbeat msgs.Heartbeat
+		if err := json.Unmarshal(data, &heartbeat); err != nil || heartbeat.SenderID == "" {
+			return false
+		}
+		observed, known := lastSeen[heartbeat.SenderID]
+		if !known || isNewer(heartbeat.Boot, heartbeat.Version, observed.Heartbeat) {
+			observe(heartbeat)
+			return true
+		} else if heartbeat.Version == observed.Heartbeat.Version {
+			acknowledge(heartbeat) // the first acknowledgement may have been lost
+		}
+		return false
+	}
 
 	for {
 		updated := false
+		p.New = ""
 
 		conn.SetReadDeadline(time.Now().Add(interval))
 		n, _, _ := conn.ReadFrom(buf[0:])
 		data := buf[:n]
-		var heartbeat msgs.Heartbeat
-		json.Unmarshal(data, &heartbeat)
 
-		id := heartbeat.SenderID
+		switch {
+		case bytes.HasPrefix(data, []byte(beaconTag+"{")):
+			var beacon msgs.Beacon
+			if err := json.Unmarshal(data[len(beaconTag):], &beacon); err != nil || beacon.SenderID == "" {
+				break
+			}
+			id := beacon.SenderID
 
-		// Adding new connection
-		p.New = ""
-		if id != "" {
-			if _, idExists := lastSeen[id]; !idExists {
-				p.New = id
-				updated = true
-			} else if !reflect.DeepEqual(heartbeat, lastSeen[id].Heartbeat) {
+			// peers are added when their full heartbeat arrives
+			observed, known := lastSeen[id]
+			if !known || isNewer(beacon.Boot, beacon.Version, observed.Heartbeat) {
+				Log.Debugf("beacon from %v has version %v, requesting its heartbeat\n", id, beacon.Version)
+				requestResync(id)
+			}
+			if known {
+				arrivals[id].heartbeat(time.Now())
+				lastSeen[id] = observation{Time: time.Now(), Heartbeat: observed.Heartbeat}
+			}
+
+		case bytes.HasPrefix(data, []byte(resyncRequestTag+"{")):
+			var request msgs.ResyncRequest
+			if err := json.Unmarshal(data[len(resyncRequestTag):], &request); err != nil {
+				break
+			}
+			if request.TargetID == thisID {
+				syncCh <- Sync{Resync: true}
+			}
+
+		case bytes.HasPrefix(data, []byte(versionAckTag+"{")):
+			var ack msgs.VersionAck
+			if err := json.Unmarshal(data[len(versionAckTag):], &ack); err != nil {
+				break
+			}
+			if ack.TargetID == thisID {
+				acked[ack.SenderID] = ack
+			}
+
+		case bytes.HasPrefix(data, []byte(deltaTag+"{")):
+			var delta msgs.HeartbeatDelta
+			if err := json.Unmarshal(data[len(deltaTag):], &delta); err != nil || delta.SenderID == "" {
+				break
+			}
+			observed, known := lastSeen[delta.SenderID]
+			switch {
+			case known && observed.Heartbeat.Boot == delta.Boot && observed.Heartbeat.Version == delta.Base:
+				observe(ApplyDelta(observed.Heartbeat, delta))
 				updated = true
+			case known && !isNewer(delta.Boot, delta.Version, observed.Heartbeat):
+				// a repetition, or reordered behind a newer one
+			default:
+				Log.Debugf("delta from %v is based on version %v, requesting its heartbeat\n",
+					delta.SenderID, delta.Base)
+				requestResync(delta.SenderID)
+			}
+
+		case bytes.HasPrefix(data, []byte(chunkTag+"{")):
+			var chunk msgs.HeartbeatChunk
+			if err := json.Unmarshal(data[len(chunkTag):], &chunk); err != nil || chunk.SenderID == "" ||
+				chunk.Count < 1 || chunk.Index < 0 || chunk.Index >= chunk.Count {
+				break
+			}
+			if joined := join(chunks, chunk); joined != nil {
+				updated = receiveHeartbeat(joined)
 			}
 
-			lastSeen[id] = observation{Time: time.Now(), Heartbeat: heartbeat}
+		case len(data) > 0 && data[0] == '{':
+			updated = receiveHeartbeat(data)
 		}
 
-		// Removing dead connection
+		// Removing dead connection, suspecting silent ones
 		p.Lost = make(msgs.HeartbeatSlice, 0)
+		phi := make(map[string]float64)
 		for k, v := range lastSeen {
-			if time.Now().Sub(v.Time) > timeout {
+			phi[k] = arrivals[k].phi(time.Now())
+			switch {
+			case phi[k] >= phiThreshold:
 				updated = true
+				peersLost.Inc()
 				p.Lost = append(p.Lost, v.Heartbeat)
 				delete(lastSeen, k)
+				delete(arrivals, k)
+				delete(suspected, k)
+				delete(acked, k)
+				delete(chunks, k)
+				delete(phi, k)
+			case phi[k] >= phiThreshold/2 && !suspected[k]:
+				updated = true
+				peersSuspected.Inc()
+				suspected[k] = true
+				Log.Printf("suspecting %v, phi %.1f\n", k, phi[k])
+			case phi[k] < phiThreshold/2 && suspected[k]:
+				updated = true
+				delete(suspected, k)
+				Log.Printf("%v no longer suspected\n", k)
 			}
 		}
 
+		// Moving the delta base of the Transmitter
+		if boot, base := ackedBase(thisID, lastSeen, acked); boot != lastSync.Boot || base != lastSync.Base {
+			lastSync = Sync{Boot: boot, Base: base}
+			syncCh <- lastSync
+		}
 		// Sending update
-		if updated {
+		if updated || time.Since(lastUpdate) > lastSeenUpdatePeriod {
 			p.Peers = make([]msgs.Heartbeat, 0, len(lastSeen))
+			p.LastSeen = make(map[string]time.Time)
+			p.Suspected = make([]string, 0, len(suspected))
+			p.Phi = phi
 
-			for _, v := range lastSeen {
+			for k, v := range lastSeen {
 				p.Peers = append(p.Peers, v.Heartbeat)
+				p.LastSeen[k] = v.Time
+			}
+			for k := range suspected {
+				p.Suspected = append(p.Suspected, k)
 			}
+			sort.Strings(p.Suspected)
 
 			peerUpdateCh <- p
+			lastUpdate = time.Now()
 		}
 	}
 }
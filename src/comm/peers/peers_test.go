@@ -0,0 +1,69 @@
+package peers
+
+import (
+	"../../elevio"
+	"../../msgs"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestRemember(t *testing.T) {
+	wrapped := uint64(1<<64 - deltaHistoryLength + 1) // what forgetting before version 1 would wrap to
+	history := map[uint64]msgs.Heartbeat{wrapped: {}}
+	for version := uint64(1); version <= 2*deltaHistoryLength; version++ {
+		remember(history, msgs.Heartbeat{Version: version})
+	}
+	if _, exists := history[wrapped]; !exists {
+		t.Errorf("version %v forgotten", wrapped)
+	}
+	for version := uint64(1); version <= 2*deltaHistoryLength; version++ {
+		_, exists := history[version]
+		if want := version > deltaHistoryLength; exists != want {
+			t.Errorf("version %v kept %v, want %v", version, exists, want)
+		}
+	}
+}
+
+func TestSplitJoin(t *testing.T) {
+	heartbeat := msgs.Heartbeat{SenderID: "A", Boot: 7, Version: 4, AcceptedOrders: make(map[string]msgs.Order)}
+	for i := 0; i < 3000; i++ {
+		id := fmt.Sprintf("A-%v", i)
+		heartbeat.AcceptedOrders[id] = msgs.Order{ID: id, MasterID: "A", Floor: i % 4, Type: elevio.BT_HallUp}
+	}
+	serialized, _ := json.Marshal(heartbeat)
+	if len(serialized) <= maxHeartbeatSize {
+		t.Fatalf("heartbeat of %v bytes fits in a datagram", len(serialized))
+	}
+
+	chunks := split(heartbeat, serialized)
+	if len(chunks) < 2 {
+		t.Fatalf("%v parts", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if size := len(tagged(chunkTag, chunk)); size > maxHeartbeatSize {
+			t.Errorf("part %v is %v bytes", chunk.Index, size)
+		}
+	}
+
+	// parts arrive in any order, a part of an older version is dropped
+	gathered := make(map[string][]msgs.HeartbeatChunk)
+	old := chunks[0]
+	old.Version = 3
+	if joined := join(gathered, old); joined != nil {
+		t.Fatalf("joined one part of %v", old.Count)
+	}
+	for i := len(chunks) - 1; i > 0; i-- {
+		if joined := join(gathered, chunks[i]); joined != nil {
+			t.Fatalf("joined before all parts arrived")
+		}
+	}
+	joined := join(gathered, chunks[0])
+	if !bytes.Equal(joined, serialized) {
+		t.Errorf("joined %v bytes, want the %v bytes sent", len(joined), len(serialized))
+	}
+	if _, exists := gathered["A"]; exists {
+		t.Errorf("parts kept after joining")
+	}
+}
@@ -0,0 +1,70 @@
+package peers
+
+import (
+	"math"
+	"time"
+)
+
+// Phi accrual failure detector (Hayashibara et al.), as in Akka and Cassandra.
+// The intervals between heartbeats of a peer are assumed normally distributed
+// with the mean and deviation of the last arrivalWindowSize intervals. Phi is
+// -log10 of the probability that the next heartbeat arrives later than now,
+// so phi 1 means a 10% chance of being wrong when declaring the peer dead,
+// phi 8 a chance of 10^-8. A peer is suspected at half the lost threshold.
+
+const arrivalWindowSize = 200
+const minStdDeviation = 100 * time.Millisecond
+const acceptableHeartbeatPause = 200 * time.Millisecond // added to the mean, covers a few lost heartbeats
+
+type arrivalWindow struct {
+	intervals   []float64 // milliseconds, ring buffer
+	next        int
+	sum         float64
+	squaredSum  float64
+	lastArrival time.Time
+}
+
+// the first heartbeat is taken to arrive at the nominal interval
+func newArrivalWindow(now time.Time) *arrivalWindow {
+	w := &arrivalWindow{lastArrival: now}
+	nominal := float64(interval / time.Millisecond)
+	w.add(nominal - nominal/4)
+	w.add(nominal + nominal/4)
+	return w
+}
+
+func (w *arrivalWindow) add(interval float64) {
+	if len(w.intervals) < arrivalWindowSize {
+		w.intervals = append(w.intervals, interval)
+	} else {
+		old := w.intervals[w.next]
+		w.sum -= old
+		w.squaredSum -= old * old
+		w.intervals[w.next] = interval
+		w.next = (w.next + 1) % arrivalWindowSize
+	}
+	w.sum += interval
+	w.squaredSum += interval * interval
+}
+
+func (w *arrivalWindow) heartbeat(now time.Time) {
+	w.add(float64(now.Sub(w.lastArrival)) / float64(time.Millisecond))
+	w.lastArrival = now
+}
+
+func (w *arrivalWindow) phi(now time.Time) float64 {
+	n := float64(len(w.intervals))
+	mean := w.sum / n
+	variance := w.squaredSum/n - mean*mean
+	stdDeviation := math.Max(math.Sqrt(math.Max(variance, 0)), float64(minStdDeviation/time.Millisecond))
+	mean += float64(acceptableHeartbeatPause / time.Millisecond)
+
+	// logistic approximation of the normal cumulative distribution
+	elapsed := float64(now.Sub(w.lastArrival)) / float64(time.Millisecond)
+	y := (elapsed - mean) / stdDeviation
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
@@ -0,0 +1,121 @@
+package peers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// exactPhi uses the normal distribution instead of the logistic
+// approximation in phi
+func exactPhi(elapsed, mean, stdDeviation float64) float64 {
+	return -math.Log10(0.5 * math.Erfc((elapsed-mean)/(stdDeviation*math.Sqrt2)))
+}
+
+func windowOf(start time.Time, intervals ...float64) *arrivalWindow {
+	w := &arrivalWindow{lastArrival: start}
+	for _, interval := range intervals {
+		w.add(interval)
+	}
+	return w
+}
+
+func TestPhi(t *testing.T) {
+	start := time.Unix(1000, 0)
+	pause := float64(acceptableHeartbeatPause / time.Millisecond)
+	floor := float64(minStdDeviation / time.Millisecond)
+
+	tests := []struct {
+		name         string
+		intervals    []float64 // milliseconds
+		mean         float64   // of the intervals
+		stdDeviation float64   // of the intervals, at least minStdDeviation
+	}{
+		{"steady, deviation at the floor", []float64{100, 100, 100, 100}, 100, floor},
+		{"small jitter, deviation at the floor", []float64{90, 110, 90, 110}, 100, floor},
+		{"large jitter", []float64{100, 500, 100, 500}, 300, 200},
+		{"slow peer", []float64{1000, 1000, 1400, 600}, 1000, 2 * floor * math.Sqrt2},
+	}
+	for _, test := range tests {
+		w := windowOf(start, test.intervals...)
+		mean := test.mean + pause
+
+		// at the expected arrival it is a coin toss
+		if phi := w.phi(start.Add(time.Duration(mean) * time.Millisecond)); math.Abs(phi-math.Log10(2)) > 1e-9 {
+			t.Errorf("%v: phi %v at the mean, want %v", test.name, phi, math.Log10(2))
+		}
+
+		last := 0.0
+		for y := -2.0; y <= 3; y += 0.5 {
+			elapsed := mean + y*test.stdDeviation
+			phi := w.phi(start.Add(time.Duration(elapsed * float64(time.Millisecond))))
+			if want := exactPhi(elapsed, mean, test.stdDeviation); math.Abs(phi-want) > 0.05 {
+				t.Errorf("%v: phi %v after %vms, want %v", test.name, phi, elapsed, want)
+			}
+			if phi <= last {
+				t.Errorf("%v: phi %v after %vms, not above %v", test.name, phi, elapsed, last)
+			}
+			last = phi
+		}
+	}
+}
+
+func TestArrivalWindowRing(t *testing.T) {
+	start := time.Unix(1000, 0)
+	w := newArrivalWindow(start)
+	now := start
+	for i := 0; i < 3*arrivalWindowSize; i++ {
+		now = now.Add(time.Duration(100+i%3*10) * time.Millisecond)
+		w.heartbeat(now)
+	}
+	if len(w.intervals) != arrivalWindowSize {
+		t.Errorf("%v intervals kept, want %v", len(w.intervals), arrivalWindowSize)
+	}
+	sum, squaredSum := 0.0, 0.0
+	for _, interval := range w.intervals {
+		sum += interval
+		squaredSum += interval * interval
+	}
+	if math.Abs(sum-w.sum) > 1e-6 || math.Abs(squaredSum-w.squaredSum) > 1e-3 {
+		t.Errorf("sums %v and %v, want %v and %v", w.sum, w.squaredSum, sum, squaredSum)
+	}
+}
+
+// with heartbeats every interval a peer is neither suspected nor lost after
+// one missed heartbeat, is suspected at half the threshold and lost after
+func TestPhiSuspicion(t *testing.T) {
+	const threshold = 8.0
+	start := time.Unix(1000, 0)
+	w := newArrivalWindow(start)
+	now := start
+	for i := 0; i < 50; i++ {
+		now = now.Add(interval)
+		w.heartbeat(now)
+	}
+
+	var suspectedAfter, lostAfter time.Duration
+	for elapsed := time.Duration(0); elapsed < 5*time.Second && lostAfter == 0; elapsed += 10 * time.Millisecond {
+		phi := w.phi(now.Add(elapsed))
+		if suspectedAfter == 0 && phi >= threshold/2 {
+			suspectedAfter = elapsed
+		}
+		if phi >= threshold {
+			lostAfter = elapsed
+		}
+	}
+	if suspectedAfter <= 2*interval+acceptableHeartbeatPause {
+		t.Errorf("suspected after %v, a missed heartbeat is not suspicious", suspectedAfter)
+	}
+	if lostAfter <= suspectedAfter {
+		t.Errorf("lost after %v, before it was suspected after %v", lostAfter, suspectedAfter)
+	}
+	if lostAfter == 0 || lostAfter > 2*time.Second {
+		t.Errorf("lost after %v", lostAfter)
+	}
+
+	// a heartbeat clears the suspicion
+	w.heartbeat(now.Add(suspectedAfter))
+	if phi := w.phi(now.Add(suspectedAfter)); phi >= threshold/2 {
+		t.Errorf("phi %v right after a heartbeat", phi)
+	}
+}
@@ -0,0 +1,110 @@
+package commhandler
+
+import (
+	"../fsm"
+	"../metrics"
+	"../msgs"
+	"time"
+)
+
+var cabRestores = metrics.NewCounter("elevator_cab_restores_total",
+	"Cab orders asked for from the peers on start, by result (restored, empty or unanswered)", "result")
+
+// Cab orders are served by the elevator they were placed in, but backed up by
+// its peers so they survive a restart. The fsm sends its cab orders whenever
+// they change, and they are broadcast as a numbered msgs.CabBackupMsg that is
+// retransmitted like a placed order until a peer acknowledges it. The fsm
+// turns the lights of the acknowledged cab orders on (spec 1.8), an order
+// nobody acknowledges is served unlit and backed up again when a peer
+// appears. Every peer keeps the backup with the highest number, numbering
+// starts at the boot time so a restarted owner is always newer.
+//
+// On start a node asks for its cab orders with a msgs.CabRestoreRequest,
+// repeated every restoreRetryPeriod until a peer answers or restoreTimeout.
+// Every peer answers with the backup it keeps, empty if it has none, and the
+// newest answer received within restoreWindow of the first is restored. Its
+// own backups are held back until then, so they do not replace the orders
+// being restored. A node that was cut off by a partition never asks, its
+// orders are newer than the backups.
+
+const restoreRetryPeriod = 500 * time.Millisecond
+const restoreWindow = 300 * time.Millisecond
+const restoreTimeout = 3 * time.Second
+
+type CabBackup struct {
+	Seq           uint64             `json:"seq"`
+	CabOrders     [fsm.N_FLOORS]bool `json:"cab_orders"`
+	TimeStamp     time.Time          `json:"time_stamp"` // changed, or received from its owner
+	TransmitCount int                `json:"transmit_count,omitempty"`
+	AckedBy       string             `json:"acked_by,omitempty"` // the first peer that acknowledged it
+}
+
+type cabRestore struct {
+	started     time.Time
+	lastRequest time.Time
+	firstAnswer time.Time
+	newest      msgs.CabBackupMsg
+	done        bool
+}
+
+// checkAndRetransmitCab sends this elevator's backup when it is due, once the
+// restore is done
+func checkAndRetransmitCab(backup *CabBackup, restore *cabRestore, thisID string, c *clock,
+	cabBackupSend_bcastCh chan<- msgs.CabBackupMsg) {
+	if backup == nil || backup.AckedBy != "" || !restore.done {
+		return
+	}
+	timeoutTime := backup.TimeStamp.Add(time.Duration(backup.TransmitCount) * ackwaitTimeout)
+	if time.Now().Before(timeoutTime) || backup.TransmitCount > retransmitCountMax+1 {
+		return
+	}
+	if backup.TransmitCount == retransmitCountMax+1 {
+		Log.Warnf("cab orders %v not backed up, served without light\n", backup.CabOrders)
+		giveups.Inc("CAB_BACKUP")
+	} else {
+		if backup.TransmitCount > 0 {
+			Log.Debugf("retransmitting cab backup %v for time %v\n", backup.Seq, backup.TransmitCount)
+			retransmissions.Inc("CAB_BACKUP")
+		}
+		cabBackupSend_bcastCh <- msgs.CabBackupMsg{SenderID: thisID, OwnerID: thisID, Seq: backup.Seq,
+			Clock: c.tick(), CabOrders: backup.CabOrders}
+	}
+	backup.TransmitCount += 1
+}
+
+// checkRestore asks again or finishes the restore when it is due. It returns
+// the cab orders to restore, if any
+func checkRestore(restore *cabRestore, thisID string, c *clock,
+	cabRestoreSend_bcastCh chan<- msgs.CabRestoreRequest) ([fsm.N_FLOORS]bool, bool) {
+	var none [fsm.N_FLOORS]bool
+	now := time.Now()
+	switch {
+	case restore.done:
+		return none, false
+
+	case !restore.firstAnswer.IsZero():
+		if now.Sub(restore.firstAnswer) < restoreWindow {
+			return none, false
+		}
+		restore.done = true
+		if restore.newest.CabOrders == none {
+			Log.Printf("no cab orders to restore\n")
+			cabRestores.Inc("empty")
+			return none, false
+		}
+		Log.Printf("my cab orders were %v, backed up by %v\n", restore.newest.CabOrders, restore.newest.SenderID)
+		cabRestores.Inc("restored")
+		return restore.newest.CabOrders, true
+
+	case now.Sub(restore.started) >= restoreTimeout:
+		Log.Printf("no peer answered for my cab orders\n")
+		cabRestores.Inc("unanswered")
+		restore.done = true
+		return none, false
+
+	case now.Sub(restore.lastRequest) >= restoreRetryPeriod:
+		cabRestoreSend_bcastCh <- msgs.CabRestoreRequest{SenderID: thisID, Clock: c.tick()}
+		restore.lastRequest = now
+	}
+	return none, false
+}
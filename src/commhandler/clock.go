@@ -0,0 +1,131 @@
+package commhandler
+
+import (
+	"time"
+)
+
+// Hybrid logical clock stamped on every order message and heartbeat. Sending
+// ticks it to the larger of the next value and the wall clock in
+// microseconds, receiving moves it up to the stamp seen, so a message is
+// always stamped later than everything its sender had seen (Lamport). The
+// wall clock part keeps a restarted node from stamping behind the others.
+//
+// Stamps ordered by clock and then node ID are a total order all nodes agree
+// on. It resolves conflicting messages for the same order: the newest take
+// wins, a take stamped before the completion of the order is stale, and the
+// first completion is the one recorded in the timeline.
+//
+// An elevator that loses an order to a newer take keeps serving it until the
+// new receiver has acknowledged the take (handoff), so an order is never
+// dropped by both.
+
+const decisionsLength = 256 // orders whose take and completion are remembered
+
+type clock uint64
+
+func (c *clock) tick() uint64 {
+	*c += 1
+	if wall := clock(time.Now().UnixNano() / int64(time.Microsecond)); wall > *c {
+		*c = wall
+	}
+	return uint64(*c)
+}
+
+// not incremented, heartbeats would otherwise move each other's clocks forever
+func (c *clock) observe(remote uint64) {
+	if clock(remote) > *c {
+		*c = clock(remote)
+	}
+}
+
+func (c *clock) now() uint64 {
+	return uint64(*c)
+}
+
+type Stamp struct {
+	Clock  uint64 `json:"clock"`
+	NodeID string `json:"node_id"`
+}
+
+func (s Stamp) IsZero() bool {
+	return s.Clock == 0
+}
+
+func (s Stamp) Before(other Stamp) bool {
+	return s.Clock < other.Clock || (s.Clock == other.Clock && s.NodeID < other.NodeID)
+}
+
+// The take and completion that won for an order
+type decision struct {
+	Take          Stamp
+	ReceiverID    string
+	ReceiverAcked bool // the receiver of the newest take has acknowledged it
+	Rescued       bool // this elevator serves it after a rescue, see orderhandler/escalation.go
+	Completed     Stamp
+	CompletedBy   string
+}
+
+type decisions struct {
+	byOrder  map[string]*decision
+	orderIDs []string // oldest first
+}
+
+func newDecisions() *decisions {
+	return &decisions{byOrder: make(map[string]*decision)}
+}
+
+func (d *decisions) get(orderID string) *decision {
+	if decision, exists := d.byOrder[orderID]; exists {
+		return decision
+	}
+	d.byOrder[orderID] = &decision{}
+	d.orderIDs = append(d.orderIDs, orderID)
+	if len(d.orderIDs) > decisionsLength {
+		delete(d.byOrder, d.orderIDs[0])
+		d.orderIDs = d.orderIDs[1:]
+	}
+	return d.byOrder[orderID]
+}
+
+// isCompleted does not remember the order
+func (d *decisions) isCompleted(orderID string) bool {
+	decision, exists := d.byOrder[orderID]
+	return exists && !decision.Completed.IsZero()
+}
+
+// take reports if the take is the newest for the order and was not sent
+// before its completion
+func (d *decisions) take(orderID string, stamp Stamp, receiverID string) bool {
+	decision := d.get(orderID)
+	if !decision.Completed.IsZero() && stamp.Before(decision.Completed) {
+		return false
+	}
+	if !decision.Take.IsZero() && stamp.Before(decision.Take) {
+		return false
+	}
+	decision.Take = stamp
+	decision.ReceiverID = receiverID
+	decision.ReceiverAcked = false
+	return true
+}
+
+// handedOver reports the first ack of the newest take by its receiver
+func (d *decisions) handedOver(orderID string, senderID string) bool {
+	decision, exists := d.byOrder[orderID]
+	if !exists || decision.ReceiverID != senderID || decision.ReceiverAcked {
+		return false
+	}
+	decision.ReceiverAcked = true
+	return true
+}
+
+// complete reports if the completion is the first of the order
+func (d *decisions) complete(orderID string, stamp Stamp, elevatorID string) bool {
+	decision := d.get(orderID)
+	if !decision.Completed.IsZero() && !stamp.Before(decision.Completed) {
+		return false
+	}
+	decision.Completed = stamp
+	decision.CompletedBy = elevatorID
+	return true
+}
@@ -0,0 +1,181 @@
+package commhandler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClockTick(t *testing.T) {
+	var c clock
+	before := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	last := c.tick()
+	if last < before {
+		t.Errorf("tick %v behind the wall clock %v", last, before)
+	}
+	for i := 0; i < 1000; i++ {
+		next := c.tick()
+		if next <= last {
+			t.Fatalf("tick %v after %v", next, last)
+		}
+		if c.now() != next {
+			t.Fatalf("now %v after tick %v", c.now(), next)
+		}
+		last = next
+	}
+}
+
+func TestClockObserve(t *testing.T) {
+	var c clock
+	start := c.tick()
+
+	// a stamp from the future moves the clock to it, without ticking
+	ahead := start + uint64(time.Hour/time.Microsecond)
+	c.observe(ahead)
+	if c.now() != ahead {
+		t.Errorf("now %v after observing %v", c.now(), ahead)
+	}
+	if tick := c.tick(); tick != ahead+1 {
+		t.Errorf("tick %v after observing %v", tick, ahead)
+	}
+
+	// an older stamp does not move it back
+	c.observe(start)
+	if c.now() != ahead+1 {
+		t.Errorf("now %v after observing the older %v", c.now(), start)
+	}
+	c.observe(ahead + 1)
+	if c.now() != ahead+1 {
+		t.Errorf("now %v after observing the same stamp", c.now())
+	}
+}
+
+func TestStampBefore(t *testing.T) {
+	tests := []struct {
+		a, b   Stamp
+		before bool
+	}{
+		{Stamp{1, "A"}, Stamp{2, "A"}, true},
+		{Stamp{2, "A"}, Stamp{1, "B"}, false},
+		{Stamp{1, "A"}, Stamp{1, "B"}, true},
+		{Stamp{1, "B"}, Stamp{1, "A"}, false},
+		{Stamp{1, "A"}, Stamp{1, "A"}, false},
+	}
+	for _, test := range tests {
+		if before := test.a.Before(test.b); before != test.before {
+			t.Errorf("%+v before %+v: %v, want %v", test.a, test.b, before, test.before)
+		}
+	}
+}
+
+func TestDecisionsTake(t *testing.T) {
+	tests := []struct {
+		name      string
+		takes     []Stamp // the last one is checked
+		completed Stamp   // if not zero, completed before the last take
+		newest    bool
+	}{
+		{"first take", []Stamp{{10, "A"}}, Stamp{}, true},
+		{"newer take", []Stamp{{10, "A"}, {11, "A"}}, Stamp{}, true},
+		{"older take", []Stamp{{10, "A"}, {9, "B"}}, Stamp{}, false},
+		{"same take again", []Stamp{{10, "A"}, {10, "A"}}, Stamp{}, true},
+		{"same clock, higher node", []Stamp{{10, "A"}, {10, "B"}}, Stamp{}, true},
+		{"same clock, lower node", []Stamp{{10, "B"}, {10, "A"}}, Stamp{}, false},
+		{"take after the completion", []Stamp{{12, "A"}}, Stamp{11, "B"}, true},
+		{"take before the completion", []Stamp{{10, "A"}}, Stamp{11, "B"}, false},
+		{"take with the clock of the completion, lower node", []Stamp{{11, "A"}}, Stamp{11, "B"}, false},
+		{"take with the clock of the completion, higher node", []Stamp{{11, "C"}}, Stamp{11, "B"}, true},
+	}
+	for _, test := range tests {
+		d := newDecisions()
+		last := len(test.takes) - 1
+		for _, stamp := range test.takes[:last] {
+			d.take("A-1", stamp, "R"+stamp.NodeID)
+		}
+		if !test.completed.IsZero() {
+			d.complete("A-1", test.completed, test.completed.NodeID)
+		}
+		stamp := test.takes[last]
+		if newest := d.take("A-1", stamp, "R"+stamp.NodeID); newest != test.newest {
+			t.Errorf("%v: newest %v, want %v", test.name, newest, test.newest)
+		}
+		if decision := d.get("A-1"); test.newest && decision.Take != stamp {
+			t.Errorf("%v: take %+v recorded, want %+v", test.name, decision.Take, stamp)
+		}
+	}
+}
+
+func TestDecisionsHandedOver(t *testing.T) {
+	d := newDecisions()
+	d.take("A-1", Stamp{10, "A"}, "B")
+	if d.handedOver("A-1", "C") {
+		t.Errorf("handed over by an ack from another elevator")
+	}
+	if !d.handedOver("A-1", "B") {
+		t.Errorf("not handed over by the first ack of the receiver")
+	}
+	if d.handedOver("A-1", "B") {
+		t.Errorf("handed over again by a repeated ack")
+	}
+	d.take("A-1", Stamp{11, "A"}, "C")
+	if !d.handedOver("A-1", "C") {
+		t.Errorf("not handed over by the ack of the newer take")
+	}
+	if d.handedOver("A-2", "B") {
+		t.Errorf("unknown order handed over")
+	}
+}
+
+func TestDecisionsComplete(t *testing.T) {
+	d := newDecisions()
+	if d.isCompleted("A-1") {
+		t.Errorf("completed before any completion")
+	}
+	if !d.complete("A-1", Stamp{10, "B"}, "B") {
+		t.Errorf("first completion not recorded")
+	}
+	if d.complete("A-1", Stamp{10, "B"}, "B") {
+		t.Errorf("repeated completion with the same stamp recorded")
+	}
+	if d.complete("A-1", Stamp{12, "C"}, "C") {
+		t.Errorf("later completion recorded")
+	}
+	if !d.complete("A-1", Stamp{10, "A"}, "A") {
+		t.Errorf("completion with the same clock and a lower node not recorded")
+	}
+	if decision := d.get("A-1"); decision.CompletedBy != "A" || decision.Completed != (Stamp{10, "A"}) {
+		t.Errorf("completion %+v by %v recorded, want the first one", decision.Completed, decision.CompletedBy)
+	}
+	if !d.isCompleted("A-1") {
+		t.Errorf("not completed")
+	}
+}
+
+func TestDecisionsEviction(t *testing.T) {
+	d := newDecisions()
+	d.complete("first", Stamp{1, "A"}, "A")
+	for i := 0; i < decisionsLength-1; i++ {
+		d.get(fmt.Sprintf("A-%v", i))
+	}
+	if !d.isCompleted("first") {
+		t.Fatalf("forgotten with %v orders remembered", decisionsLength)
+	}
+
+	d.get("one more")
+	if d.isCompleted("first") {
+		t.Errorf("oldest order remembered past %v orders", decisionsLength)
+	}
+	if len(d.byOrder) != decisionsLength || len(d.orderIDs) != decisionsLength {
+		t.Errorf("%v orders remembered (%v ids), want %v", len(d.byOrder), len(d.orderIDs), decisionsLength)
+	}
+	// isCompleted does not remember, so it does not evict
+	for i := 0; i < decisionsLength; i++ {
+		d.isCompleted(fmt.Sprintf("B-%v", i))
+	}
+	if len(d.byOrder) != decisionsLength {
+		t.Errorf("isCompleted remembered orders")
+	}
+	if _, exists := d.byOrder["A-0"]; !exists {
+		t.Errorf("isCompleted evicted orders")
+	}
+}
@@ -3,15 +3,34 @@ package commhandler
 import (
 	"../comm/bcast"
 	"../comm/peers"
+	"../elevio"
+	"../fsm"
 	"../go-nonblockingchan"
+	"../logging"
+	"../metrics"
 	"../msgs"
-	"log"
-	"os"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
 
-var Info *log.Logger
+var Log = logging.New("commhandler")
+
+var retransmissions = metrics.NewCounter("elevator_retransmissions_total",
+	"Retransmitted messages by order state", "state")
+var duplicates = metrics.NewCounter("elevator_duplicates_total",
+	"Received order messages that were duplicates, by message type", "type")
+var giveups = metrics.NewCounter("elevator_giveups_total",
+	"Orders given up waiting for acknowledgement or completion, by order state", "state")
+var partitionsStarted = metrics.NewCounter("elevator_partitions_total",
+	"Groups of peers lost together, see partition.go")
+var partitionDuration = metrics.NewHistogram("elevator_partition_seconds",
+	"Time from a group of peers was lost until all of them were seen again",
+	[]float64{1, 5, 10, 30, 60, 300, 900})
+var staleMessages = metrics.NewCounter("elevator_stale_messages_total",
+	"Order messages ignored because a later take or completion of the order is known, by message type", "type")
 
 type OrderState int
 
@@ -45,17 +64,61 @@ type StampedOrder struct {
 	TransmitCount int
 	PlacedCount   int
 	OrderState    OrderState
+	PlacedClock   uint64   // logical time the order was placed, or first heard of here
+	PlacedSeqs    []uint64 // every number the placement was sent with, an ack of any counts
 
 	OrderMsg msgs.OrderMsg
 }
 
 type StampedLastHeartbeat struct {
 	TimeStamp     time.Time
-	Alive         bool
-	TransmitCount int
 	LastHeartbeat msgs.Heartbeat
 }
 
+type PeerStatus struct {
+	ID        string    `json:"id"`
+	LastSeen  time.Time `json:"last_seen"`
+	Alive     bool      `json:"alive"`
+	Phi       float64   `json:"phi"`
+	Suspected bool      `json:"suspected"`
+}
+
+// Assignment or completion of an order seen by this node
+type TimelineEntry struct {
+	Time       time.Time  `json:"time"`
+	Clock      uint64     `json:"clock"` // of the take or complete message
+	Event      string     `json:"event"` // assigned, rescued or completed
+	Order      msgs.Order `json:"order"`
+	MasterID   string     `json:"master_id"`
+	ElevatorID string     `json:"elevator_id"`
+}
+
+// Snapshot of the commhandler state for the status api
+type Snapshot struct {
+	AllOrders      map[string]StampedOrder         `json:"all_orders"`
+	LastHeartbeats map[string]StampedLastHeartbeat `json:"last_heartbeats"`
+	Peers          []PeerStatus                    `json:"peers"`
+	Timeline       []TimelineEntry                 `json:"timeline"`
+	Partitions     []Partition                     `json:"partitions"`
+	Clock          uint64                          `json:"clock"`
+	CabBackup      *CabBackup                      `json:"cab_backup"`  // of this elevator
+	CabBackups     map[string]CabBackup            `json:"cab_backups"` // kept for the other elevators
+}
+
+func (s OrderState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *OrderState) UnmarshalText(text []byte) error {
+	for state := ACKWAIT_PLACED; state <= ACKWAIT_COMPLETE; state++ {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown order state %q", text)
+}
+
 func createStampedOrder(order msgs.Order, os OrderState) *StampedOrder {
 	return &StampedOrder{TimeStamp: time.Now(),
 		TransmitCount: 1,
@@ -64,27 +127,75 @@ func createStampedOrder(order msgs.Order, os OrderState) *StampedOrder {
 		OrderMsg:      msgs.OrderMsg{Order: order}}
 }
 
-func createStampedLastHearbeat(heartbeat msgs.Heartbeat, alive bool) *StampedLastHeartbeat {
+// setStampedOrder replaces the entry of the order, keeping when it was placed
+func setStampedOrder(allOrders map[string]*StampedOrder, order msgs.Order, os OrderState, placedClock uint64) *StampedOrder {
+	stampedOrder := createStampedOrder(order, os)
+	stampedOrder.PlacedClock = placedClock
+	if old, exists := allOrders[order.ID]; exists && old.PlacedClock != 0 {
+		stampedOrder.PlacedClock = old.PlacedClock
+	}
+	allOrders[order.ID] = stampedOrder
+	return stampedOrder
+}
+
+func containsSeq(seqs []uint64, seq uint64) bool {
+	for _, s := range seqs {
+		if s == seq {
+			return true
+		}
+	}
+	return false
+}
+
+func createStampedLastHearbeat(heartbeat msgs.Heartbeat) *StampedLastHeartbeat {
 	return &StampedLastHeartbeat{TimeStamp: time.Now(),
-		TransmitCount: 1,
-		Alive:         alive,
 		LastHeartbeat: heartbeat}
 }
 
 const ackwaitTimeout = 100 * time.Millisecond
 const placeAgainTimeIncrement = 10 * time.Second
-const giveupOtherElevTimeout = 40 * time.Second
 const timeoutCheckMaxPeriod = 100 * time.Millisecond
 const retransmitCountMax = 5       // number of times to retransmit if no ack is recieved
-const placedGiveupAndTakeTries = 3 // if no acks are recieved and user tries this many times, take order
+const placedGiveupAndTakeTries = 3 // if no acks are recieved and user tries this many times, take order (unless -redundancy=strict)
+const timelineLength = 100         // number of assignments and completions kept for the status api
+
+// retransmissions are not added again
+func addToTimeline(timeline []TimelineEntry, event string, clock uint64, order msgs.Order, masterID string, elevatorID string) []TimelineEntry {
+	for i := len(timeline) - 1; i >= 0; i-- {
+		if timeline[i].Order.ID == order.ID {
+			if timeline[i].Event == event && timeline[i].ElevatorID == elevatorID {
+				return timeline
+			}
+			break
+		}
+	}
+	timeline = append(timeline, TimelineEntry{Time: time.Now(), Clock: clock, Event: event,
+		Order: order, MasterID: masterID, ElevatorID: elevatorID})
+	if len(timeline) > timelineLength {
+		timeline = timeline[len(timeline)-timelineLength:]
+	}
+	return timeline
+}
 
+// only the first completion of an order is shown, it may arrive after a later one
+func completeInTimeline(timeline []TimelineEntry, clock uint64, order msgs.Order, elevatorID string) []TimelineEntry {
+	for i := len(timeline) - 1; i >= 0; i-- {
+		if timeline[i].Order.ID == order.ID && timeline[i].Event == "completed" {
+			timeline[i].Clock = clock
+			timeline[i].ElevatorID = elevatorID
+			return timeline
+		}
+	}
+	return addToTimeline(timeline, "completed", clock, order, order.MasterID, elevatorID)
+}
 
-func checkAndRetransmit(allOrders map[int]*StampedOrder, orderID int, thisID string,
+func checkAndRetransmit(allOrders map[string]*StampedOrder, orderID string, thisID string, redundancy msgs.Redundancy,
 	placedOrderSend_bcastCh chan<- msgs.PlacedOrderMsg, takeOrderSend_bcastCh chan<- msgs.TakeOrderMsg, completeOrderSend_bcastCh chan<- msgs.CompleteOrderMsg,
-	takeOrder_orderhandlerCh *nbc.NonBlockingChan, redundantOrder_orderhandlerCh *nbc.NonBlockingChan) {
+	takeOrder_orderhandlerCh *nbc.NonBlockingChan, redundantOrder_orderhandlerCh *nbc.NonBlockingChan,
+	ignoredOrder_orderhandlerCh *nbc.NonBlockingChan) {
 
 	if stampedOrder, exists := allOrders[orderID]; !exists {
-		Info.Printf("check and retransmit for non-existent order\n")
+		Log.Warnf("check and retransmit for non-existent order\n")
 	} else {
 		retransmitDuration := time.Duration(stampedOrder.TransmitCount) * ackwaitTimeout
 		timeoutTime := stampedOrder.TimeStamp.Add(retransmitDuration)
@@ -93,48 +204,65 @@ func checkAndRetransmit(allOrders map[int]*StampedOrder, orderID int, thisID str
 			if stampedOrder.TransmitCount <= retransmitCountMax {
 				stampedOrder.TransmitCount += 1
 				switch stampedOrder.OrderState {
+				case ACKWAIT_PLACED, ACKWAIT_TAKE, ACKWAIT_COMPLETE:
+					retransmissions.Inc(stampedOrder.OrderState.String())
+				}
+				switch stampedOrder.OrderState {
 				case ACKWAIT_PLACED:
-					Info.Printf("retransmitting place for %v for time %v\n", stampedOrder.OrderMsg.Order.ID, stampedOrder.TransmitCount)
+					Log.Debugf("retransmitting place for %v for time %v\n", stampedOrder.OrderMsg.Order.ID, stampedOrder.TransmitCount)
 					placedOrderSend_bcastCh <- msgs.PlacedOrderMsg{SenderID: thisID,
+						Seq:   stampedOrder.OrderMsg.Seq,
+						Clock: stampedOrder.OrderMsg.Clock,
 						Order: stampedOrder.OrderMsg.Order}
 				case ACKWAIT_TAKE:
-					Info.Printf("retransmitting take for %v time %v\n", stampedOrder.OrderMsg.Order.ID, stampedOrder.TransmitCount)
+					Log.Debugf("retransmitting take for %v time %v\n", stampedOrder.OrderMsg.Order.ID, stampedOrder.TransmitCount)
 					takeOrderSend_bcastCh <- msgs.TakeOrderMsg{SenderID: thisID,
 						ReceiverID: stampedOrder.OrderMsg.ReceiverID,
+						Seq:        stampedOrder.OrderMsg.Seq,
+						Clock:      stampedOrder.OrderMsg.Clock,
 						Order:      stampedOrder.OrderMsg.Order}
 				case ACKWAIT_COMPLETE:
-					Info.Printf("retransmitting complete for order %+v time %v\n", stampedOrder.OrderMsg.Order.ID, stampedOrder.TransmitCount)
+					Log.Debugf("retransmitting complete for order %+v time %v\n", stampedOrder.OrderMsg.Order.ID, stampedOrder.TransmitCount)
 					orderMasterID := stampedOrder.OrderMsg.SenderID
 					completeOrderSend_bcastCh <- msgs.CompleteOrderMsg{SenderID: thisID, ReceiverID: orderMasterID,
-						Order: stampedOrder.OrderMsg.Order}
+						Seq: stampedOrder.OrderMsg.Seq, Clock: stampedOrder.OrderMsg.Clock, Order: stampedOrder.OrderMsg.Order}
 				case SERVING:
 				case SAFE:
 				default:
-					Info.Printf("no retransmission set up for this order state: %v\n", stampedOrder.OrderState)
+					Log.Warnf("no retransmission set up for this order state: %v\n", stampedOrder.OrderState)
 				}
 			} else {
 				// "Give-up actions"
 				switch stampedOrder.OrderState {
 				case ACKWAIT_PLACED:
-					if stampedOrder.PlacedCount >= placedGiveupAndTakeTries {
-						Info.Printf("%v retransmit (ackplaced) failed %v times\n", orderID, stampedOrder.PlacedCount)
+					if redundancy == msgs.RED_Strict {
+						// specification 2.8, the order is placed again on the next press
+						giveups.Inc(stampedOrder.OrderState.String())
+						Log.Warnf("%v not acknowledged by any elevator, ignored\n", orderID)
+						ignoredOrder_orderhandlerCh.Send <- stampedOrder.OrderMsg.Order
+						delete(allOrders, orderID)
+					} else if stampedOrder.PlacedCount >= placedGiveupAndTakeTries {
+						giveups.Inc(stampedOrder.OrderState.String())
+						Log.Warnf("%v retransmit (ackplaced) failed %v times\n", orderID, stampedOrder.PlacedCount)
 
 						redundantOrder_orderhandlerCh.Send <- msgs.RedundantOrderMsg{SenderID: thisID,
 							ReceiverID: thisID,
 							Order:      stampedOrder.OrderMsg.Order}
 
-						allOrders[orderID] = createStampedOrder(stampedOrder.OrderMsg.Order, SERVING)
+						setStampedOrder(allOrders, stampedOrder.OrderMsg.Order, SERVING, stampedOrder.OrderMsg.Clock)
 					}
 
 				case ACKWAIT_TAKE:
-					Info.Printf("%v retransmit (acktake) failed. Take it\n", orderID)
+					giveups.Inc(stampedOrder.OrderState.String())
+					Log.Warnf("%v retransmit (acktake) failed. Take it\n", orderID)
 					takeOrder_orderhandlerCh.Send <- msgs.TakeOrderMsg{SenderID: thisID,
 						ReceiverID: thisID,
 						Order:      stampedOrder.OrderMsg.Order}
 
-					allOrders[orderID] = createStampedOrder(stampedOrder.OrderMsg.Order, SERVING)
+					setStampedOrder(allOrders, stampedOrder.OrderMsg.Order, SERVING, stampedOrder.OrderMsg.Clock)
 				case ACKWAIT_COMPLETE:
-					Info.Printf("%v retransmit (ackcomplete) failed. Order deleted.\n", orderID)
+					giveups.Inc(stampedOrder.OrderState.String())
+					Log.Warnf("%v retransmit (ackcomplete) failed. Order deleted.\n", orderID)
 					delete(allOrders, stampedOrder.OrderMsg.Order.ID)
 
 				}
@@ -143,37 +271,45 @@ func checkAndRetransmit(allOrders map[int]*StampedOrder, orderID int, thisID str
 	}
 }
 
-func CommHandler(thisID string, commonPort int,
+func CommHandler(thisID string, commonPort int, redundancy msgs.Redundancy, phiThreshold float64,
 	/* read */
 	thisElevatorHeartbeat_orderhandlerCh *nbc.NonBlockingChan,
 	downedElevators_orderhandlerCh *nbc.NonBlockingChan,
 	placedOrder_orderhandlerCh *nbc.NonBlockingChan,
 	assignOrder_orderhandlerCh *nbc.NonBlockingChan,
 	completedOrder_orderhandlerCh *nbc.NonBlockingChan,
+	rescueOrder_orderhandlerCh *nbc.NonBlockingChan,
+	cabOrders_fsmCh *nbc.NonBlockingChan,
+	statusRequest_apiCh *nbc.NonBlockingChan,
 	/* write */
 	allElevatorsHeartbeat_orderhandlerCh *nbc.NonBlockingChan,
 	takeOrder_orderhandlerCh *nbc.NonBlockingChan,
 	redundantOrder_orderhandlerCh *nbc.NonBlockingChan,
+	ignoredOrder_orderhandlerCh *nbc.NonBlockingChan,
 	completedHallOrderOtherElev_orderhandlerCh *nbc.NonBlockingChan,
 	lastKnownOrders_orderhandlerCh *nbc.NonBlockingChan,
+	rejoinedElevator_orderhandlerCh *nbc.NonBlockingChan,
+	suspectedElevators_orderhandlerCh *nbc.NonBlockingChan,
+	backedUpCabOrders_fsmCh *nbc.NonBlockingChan,
 	/* sync */
 	wg *sync.WaitGroup) {
 
-	Info = log.New(os.Stdout, "[network]: ", 0)
-
 	placedOrderSend_bcastCh := make(chan msgs.PlacedOrderMsg)
 	placedOrderAckSend_bcastCh := make(chan msgs.PlacedOrderAck)
 	takeOrderSend_bcastCh := make(chan msgs.TakeOrderMsg)
 	takeOrderAckSend_bcastCh := make(chan msgs.TakeOrderAck)
 	completeOrderSend_bcastCh := make(chan msgs.CompleteOrderMsg)
 	completeOrderAckSend_bcastCh := make(chan msgs.CompleteOrderAck)
-	lastKnowHeartbeatSend_bcastCh := make(chan msgs.Heartbeat)
-	lastKnowHeartbeatAckSend_bcastCh := make(chan msgs.HeartbeatAck)
+	rescueOrderSend_bcastCh := make(chan msgs.RescueOrderMsg)
+	cabBackupSend_bcastCh := make(chan msgs.CabBackupMsg)
+	cabBackupAckSend_bcastCh := make(chan msgs.CabBackupAck)
+	cabRestoreSend_bcastCh := make(chan msgs.CabRestoreRequest)
 	go bcast.Transmitter(commonPort,
 		placedOrderSend_bcastCh, placedOrderAckSend_bcastCh,
 		takeOrderAckSend_bcastCh, takeOrderSend_bcastCh,
 		completeOrderSend_bcastCh, completeOrderAckSend_bcastCh,
-		lastKnowHeartbeatSend_bcastCh, lastKnowHeartbeatAckSend_bcastCh)
+		rescueOrderSend_bcastCh,
+		cabBackupSend_bcastCh, cabBackupAckSend_bcastCh, cabRestoreSend_bcastCh)
 
 	placedOrderRecv_bcastCh := make(chan msgs.PlacedOrderMsg)
 	placedOrderAckRecv_bcastCh := make(chan msgs.PlacedOrderAck)
@@ -181,50 +317,83 @@ func CommHandler(thisID string, commonPort int,
 	takeOrderAckRecv_bcastCh := make(chan msgs.TakeOrderAck)
 	completeOrderRecv_bcastCh := make(chan msgs.CompleteOrderMsg)
 	completeOrderAckRecv_bcastCh := make(chan msgs.CompleteOrderAck)
-	lastKnowHeartbeatRecv_bcastCh := make(chan msgs.Heartbeat)
-	lastKnowHeartbeatAckRecv_bcastCh := make(chan msgs.HeartbeatAck)
+	rescueOrderRecv_bcastCh := make(chan msgs.RescueOrderMsg)
+	cabBackupRecv_bcastCh := make(chan msgs.CabBackupMsg)
+	cabBackupAckRecv_bcastCh := make(chan msgs.CabBackupAck)
+	cabRestoreRecv_bcastCh := make(chan msgs.CabRestoreRequest)
 	go bcast.Receiver(commonPort,
 		placedOrderRecv_bcastCh, placedOrderAckRecv_bcastCh,
 		takeOrderAckRecv_bcastCh, takeOrderRecv_bcastCh,
 		completeOrderRecv_bcastCh, completeOrderAckRecv_bcastCh,
-		lastKnowHeartbeatRecv_bcastCh, lastKnowHeartbeatAckRecv_bcastCh)
+		rescueOrderRecv_bcastCh,
+		cabBackupRecv_bcastCh, cabBackupAckRecv_bcastCh, cabRestoreRecv_bcastCh)
 
 	txEnable_peerCh := make(chan bool)
 	updateHeartbeat_peerCh := make(chan msgs.Heartbeat)
-	go peers.Transmitter(commonPort, txEnable_peerCh, updateHeartbeat_peerCh)
+	sync_peerCh := make(chan peers.Sync, 1)
+	go peers.Transmitter(commonPort, txEnable_peerCh, updateHeartbeat_peerCh, sync_peerCh)
 
 	updates_peerCh := make(chan peers.PeerUpdate, 1)
-	go peers.Receiver(commonPort, updates_peerCh)
+	go peers.Receiver(commonPort, thisID, phiThreshold, updates_peerCh, sync_peerCh)
 
-	allOrders := make(map[int]*StampedOrder)
+	allOrders := make(map[string]*StampedOrder)
 	lastHeartbeats := make(map[string]*StampedLastHeartbeat)
+	peerLastSeen := make(map[string]time.Time)
+	alivePeers := make(map[string]bool)
+	peerPhi := make(map[string]float64)
+	suspectedPeers := []string{}
+	lostPeers := make(map[string]bool)
+	var timeline []TimelineEntry
+	var partitions partitionTracker
+	seq := newSequence()
+	var clock clock
+	orderDecisions := newDecisions()
+	dedup := make(dedupFilter)
+	var cabBackup *CabBackup // of this elevator
+	cabBackups := make(map[string]*CabBackup)
 
 	// Wait until all modules are initialized
 	wg.Done()
-	Info.Println("initialized")
+	Log.Println("initialized")
 	wg.Wait()
-	Info.Println("starting")
+	Log.Println("starting")
+	restore := cabRestore{started: time.Now()}
 
 	for {
 		select {
 		case msg := <-placedOrderRecv_bcastCh:
+			clock.observe(msg.Clock)
 			if msg.SenderID != thisID { // Order transmitted from other node
-				allOrders[msg.Order.ID] = createStampedOrder(msg.Order, SAFE)
-				allOrders[msg.Order.ID].OrderMsg.SenderID = msg.SenderID
-
-				// acknowledge order
 				ack := msgs.PlacedOrderAck{SenderID: thisID,
 					ReceiverID: msg.SenderID,
+					AckSeq:     msg.Seq,
+					Clock:      clock.tick(),
 					Order:      msg.Order}
+				if dedup.isDuplicate(msg.SenderID, msg.Seq) {
+					// the ack may have been lost
+					duplicates.Inc("PlacedOrderMsg")
+					placedOrderAckSend_bcastCh <- ack
+					break
+				}
+				if orderDecisions.isCompleted(msg.Order.ID) {
+					Log.Debugf("placement of completed order %v ignored\n", msg.Order.ID)
+					staleMessages.Inc("PlacedOrderMsg")
+					placedOrderAckSend_bcastCh <- ack
+					break
+				}
+				setStampedOrder(allOrders, msg.Order, SAFE, msg.Clock)
+				allOrders[msg.Order.ID].OrderMsg.SenderID = msg.SenderID
+
+				// acknowledge order
 				placedOrderAckSend_bcastCh <- ack
-				Info.Printf("sent ack to %v for order %v\n", ack.ReceiverID, ack.Order.ID)
+				Log.Debugf("sent ack to %v for order %v\n", ack.ReceiverID, ack.Order.ID)
 			}
 
 		case msg, _ := <-placedOrder_orderhandlerCh.Recv:
 			order := msg.(msgs.Order)
 
 			if orderStamped, exists := allOrders[order.ID]; exists && orderStamped.OrderState == ACKWAIT_PLACED {
-				Info.Printf("unacked order %v placed again %v\n", orderStamped.OrderMsg.Order.ID, orderStamped.PlacedCount)
+				Log.Printf("unacked order %v placed again %v\n", orderStamped.OrderMsg.Order.ID, orderStamped.PlacedCount)
 				orderStamped.TimeStamp = time.Now()
 				orderStamped.TransmitCount = 1
 				orderStamped.PlacedCount += 1
@@ -232,25 +401,37 @@ func CommHandler(thisID string, commonPort int,
 				allOrders[order.ID] = createStampedOrder(order, ACKWAIT_PLACED)
 				allOrders[order.ID].OrderMsg.SenderID = thisID
 			}
-			placedOrderSend_bcastCh <- msgs.PlacedOrderMsg{SenderID: thisID, Order: order}
+			allOrders[order.ID].OrderMsg.Seq = seq.next()
+			allOrders[order.ID].OrderMsg.Clock = clock.tick()
+			allOrders[order.ID].PlacedSeqs = append(allOrders[order.ID].PlacedSeqs, allOrders[order.ID].OrderMsg.Seq)
+			if allOrders[order.ID].PlacedClock == 0 {
+				allOrders[order.ID].PlacedClock = allOrders[order.ID].OrderMsg.Clock
+			}
+			placedOrderSend_bcastCh <- msgs.PlacedOrderMsg{SenderID: thisID, Seq: allOrders[order.ID].OrderMsg.Seq,
+				Clock: allOrders[order.ID].OrderMsg.Clock, Order: order}
 
 		case msg := <-placedOrderAckRecv_bcastCh:
+			clock.observe(msg.Clock)
 			if msg.ReceiverID == thisID {
 				// acknowledgement recieved from other node
 				if _, exists := allOrders[msg.Order.ID]; !exists {
-					Info.Printf("order %v not found\n", msg.Order.ID)
+					Log.Warnf("order %v not found\n", msg.Order.ID)
 					break
 				}
 				if orderStamped, _ := allOrders[msg.Order.ID]; orderStamped.OrderState != ACKWAIT_PLACED {
-					Info.Printf("not awaiting place ack for order %v\n", msg.Order.ID)
+					Log.Debugf("not awaiting place ack for order %v\n", msg.Order.ID)
+					break
+				}
+				if orderStamped, _ := allOrders[msg.Order.ID]; !containsSeq(orderStamped.PlacedSeqs, msg.AckSeq) {
+					Log.Debugf("stale place ack %v for order %v\n", msg.AckSeq, msg.Order.ID)
 					break
 				}
 
-				Info.Printf("order %v acknowledged\n", msg.Order.ID)
+				Log.Printf("order %v acknowledged\n", msg.Order.ID)
 				allOrders[msg.Order.ID].OrderState = SAFE
 
 				// order is redundant since multiple elevators know about it, notify orderHandler
-				redundantMsg := msgs.RedundantOrderMsg{SenderID: thisID, ReceiverID: thisID, Order: msg.Order}
+				redundantMsg := msgs.RedundantOrderMsg{SenderID: msg.SenderID, ReceiverID: thisID, Order: msg.Order}
 				redundantOrder_orderhandlerCh.Send <- redundantMsg
 			}
 
@@ -258,89 +439,245 @@ func CommHandler(thisID string, commonPort int,
 			orderMsg := msg.(msgs.TakeOrderMsg)
 
 			orderMsg.SenderID = thisID
+			orderMsg.Seq = seq.next()
+			orderMsg.Clock = clock.tick()
+			orderDecisions.take(orderMsg.Order.ID, Stamp{Clock: orderMsg.Clock, NodeID: thisID}, orderMsg.ReceiverID)
 			takeOrderSend_bcastCh <- orderMsg
 
-			Info.Printf("elevator %v should take %v\n", orderMsg.ReceiverID, orderMsg.Order.ID)
+			Log.Printf("elevator %v should take %v\n", orderMsg.ReceiverID, orderMsg.Order.ID)
 
-			allOrders[orderMsg.Order.ID] = createStampedOrder(orderMsg.Order, ACKWAIT_TAKE)
+			setStampedOrder(allOrders, orderMsg.Order, ACKWAIT_TAKE, orderMsg.Clock)
 			allOrders[orderMsg.Order.ID].OrderMsg.ReceiverID = orderMsg.ReceiverID
+			allOrders[orderMsg.Order.ID].OrderMsg.Seq = orderMsg.Seq
+			allOrders[orderMsg.Order.ID].OrderMsg.Clock = orderMsg.Clock
 
 		case msg := <-takeOrderRecv_bcastCh:
+			clock.observe(msg.Clock)
+			ack := msgs.TakeOrderAck{SenderID: thisID, ReceiverID: msg.SenderID, AckSeq: msg.Seq,
+				Clock: clock.tick(), Order: msg.Order}
+			if dedup.isDuplicate(msg.SenderID, msg.Seq) {
+				duplicates.Inc("TakeOrderMsg")
+				if msg.ReceiverID == thisID {
+					takeOrderAckSend_bcastCh <- ack
+				}
+				break
+			}
+			if msg.SenderID != thisID && !orderDecisions.take(msg.Order.ID, Stamp{Clock: msg.Clock, NodeID: msg.SenderID}, msg.ReceiverID) {
+				// acknowledged all the same, so the sender stops retransmitting
+				Log.Printf("take of %v from %v is older than its last take or completion, ignored\n", msg.Order.ID, msg.SenderID)
+				staleMessages.Inc("TakeOrderMsg")
+				if msg.ReceiverID == thisID {
+					takeOrderAckSend_bcastCh <- ack
+				}
+				break
+			}
+			timeline = addToTimeline(timeline, "assigned", msg.Clock, msg.Order, msg.SenderID, msg.ReceiverID)
 
 			if msg.ReceiverID == thisID {
-				allOrders[msg.Order.ID] = createStampedOrder(msg.Order, SERVING)
+				setStampedOrder(allOrders, msg.Order, SERVING, msg.Clock)
 				allOrders[msg.Order.ID].OrderMsg.SenderID = msg.SenderID
 
-				Info.Printf("this elevator takes order %v\n", msg.Order.ID)
+				Log.Printf("this elevator takes order %v\n", msg.Order.ID)
 				takeOrder_orderhandlerCh.Send <- msg
-
-				ack := msgs.TakeOrderAck{SenderID: thisID, ReceiverID: msg.SenderID, Order: msg.Order}
-
 				takeOrderAckSend_bcastCh <- ack
+			} else if msg.Order.MasterID == thisID && msg.SenderID != thisID {
+				// assigned by the leader, the orderhandler records the choice
+				takeOrder_orderhandlerCh.Send <- msg
 			}
 
 		case msg := <-takeOrderAckRecv_bcastCh:
-			if msg.ReceiverID == thisID {
-				Info.Printf("recieved take ack for order %+v from %v\n", msg.Order, msg.SenderID)
+			clock.observe(msg.Clock)
+			if orderDecisions.isCompleted(msg.Order.ID) {
+				staleMessages.Inc("TakeOrderAck")
+				break
+			}
+			if msg.SenderID != thisID && orderDecisions.handedOver(msg.Order.ID, msg.SenderID) {
+				// an elevator that had the order drops it, see clock.go
+				Log.Debugf("order %v handed over to %v\n", msg.Order.ID, msg.SenderID)
+				takeOrder_orderhandlerCh.Send <- msgs.TakeOrderMsg{SenderID: msg.ReceiverID,
+					ReceiverID: msg.SenderID, Clock: msg.Clock, Order: msg.Order}
+			}
+			if msg.ReceiverID != thisID {
+				break
 			}
+			// only the take waiting for this ack is served, a late ack must not
+			// undo a later state such as ACKWAIT_COMPLETE
+			if stampedOrder, exists := allOrders[msg.Order.ID]; !exists || stampedOrder.OrderState != ACKWAIT_TAKE ||
+				stampedOrder.OrderMsg.Seq != msg.AckSeq {
+				Log.Debugf("stale take ack %v for order %v\n", msg.AckSeq, msg.Order.ID)
+				staleMessages.Inc("TakeOrderAck")
+				break
+			}
+			Log.Debugf("recieved take ack for order %+v from %v\n", msg.Order, msg.SenderID)
+			setStampedOrder(allOrders, msg.Order, SERVING, msg.Clock)
+
+		case msg, _ := <-rescueOrder_orderhandlerCh.Recv:
+			order := msg.(msgs.Order)
+
+			// repeated by the orderhandler until the order is completed
+			Log.Debugf("rescue of %v sent\n", order.ID)
+			rescueOrderSend_bcastCh <- msgs.RescueOrderMsg{SenderID: thisID, Clock: clock.tick(), Order: order}
 
-			allOrders[msg.Order.ID] = createStampedOrder(msg.Order, SERVING)
+		case msg := <-rescueOrderRecv_bcastCh:
+			clock.observe(msg.Clock)
+			if msg.SenderID == thisID {
+				break
+			}
+			if orderDecisions.isCompleted(msg.Order.ID) {
+				staleMessages.Inc("RescueOrderMsg")
+				break
+			}
+			if decision := orderDecisions.get(msg.Order.ID); !decision.Rescued {
+				decision.Rescued = true
+				Log.Printf("rescuing order %v for %v\n", msg.Order.ID, msg.SenderID)
+				timeline = addToTimeline(timeline, "rescued", msg.Clock, msg.Order, msg.SenderID, thisID)
+				// served as a take, its completion is broadcast as usual
+				if stampedOrder, exists := allOrders[msg.Order.ID]; !exists || stampedOrder.OrderState != ACKWAIT_COMPLETE {
+					setStampedOrder(allOrders, msg.Order, SERVING, msg.Clock).OrderMsg.SenderID = msg.SenderID
+				}
+				takeOrder_orderhandlerCh.Send <- msgs.TakeOrderMsg{SenderID: msg.SenderID, ReceiverID: thisID,
+					Clock: msg.Clock, Order: msg.Order}
+			}
 
 		case peerUpdate := <-updates_peerCh:
+			alivePeers = make(map[string]bool)
+			for id, lastSeen := range peerUpdate.LastSeen {
+				peerLastSeen[id] = lastSeen
+				alivePeers[id] = true
+			}
+			peerPhi = peerUpdate.Phi
+			for _, heartbeat := range peerUpdate.Peers {
+				clock.observe(heartbeat.Clock)
+			}
 
 			if len(peerUpdate.Lost) > 0 {
 				var downedElevators []msgs.Heartbeat
 				for _, lastHeartbeat := range peerUpdate.Lost {
-					Info.Printf("lost %v\n", lastHeartbeat.SenderID)
+					Log.Printf("lost %v\n", lastHeartbeat.SenderID)
 					downedElevators = append(downedElevators, lastHeartbeat)
-					lastHeartbeats[lastHeartbeat.SenderID] = createStampedLastHearbeat(lastHeartbeat, false)
-					Info.Printf("it last heartbeat was %v\n", lastHeartbeats[lastHeartbeat.SenderID])
+					lastHeartbeats[lastHeartbeat.SenderID] = createStampedLastHearbeat(lastHeartbeat)
+					Log.Debugf("it last heartbeat was %v\n", lastHeartbeats[lastHeartbeat.SenderID])
+					if lastHeartbeat.SenderID != thisID && partitions.lost(lastHeartbeat.SenderID, time.Now()) {
+						partitionsStarted.Inc()
+					}
+				}
+				if latest := partitions.latest(); latest != nil && len(latest.Lost) > 1 {
+					Log.Warnf("partition: %v lost together\n", latest.Lost)
 				}
 				downedElevators_orderhandlerCh.Send <- downedElevators
 			}
 
 			if peerUpdate.New != "" {
+				if peerUpdate.New != thisID && cabBackup != nil && cabBackup.AckedBy == "" {
+					// back up again what nobody has acknowledged
+					cabBackup.TimeStamp = time.Now()
+					cabBackup.TransmitCount = 0
+				}
 				if _, exists := lastHeartbeats[peerUpdate.New]; exists {
-					Info.Printf("new peer: %v\n", peerUpdate.New)
-					lastHeartbeat := lastHeartbeats[peerUpdate.New].LastHeartbeat
-					lastHeartbeats[peerUpdate.New] = createStampedLastHearbeat(lastHeartbeat, true)
-					lastKnownHeartbeat := lastHeartbeats[peerUpdate.New]
-					Info.Printf("its last heartbeat is sent: %v\n", lastKnownHeartbeat)
-					lastKnowHeartbeatSend_bcastCh <- lastKnownHeartbeat.LastHeartbeat
+					Log.Printf("new peer: %v\n", peerUpdate.New)
+					delete(lastHeartbeats, peerUpdate.New)
+
+					if peerUpdate.New != thisID {
+						if partition, exists := partitions.rejoined(peerUpdate.New, time.Now()); exists && partition.Healed {
+							Log.Printf("partition healed: %v back after %.1fs\n", partition.Lost, partition.Duration)
+							partitionDuration.Observe(partition.Duration)
+						}
+						// the orderhandler took over its orders when it was lost
+						for _, heartbeat := range peerUpdate.Peers {
+							if heartbeat.SenderID == peerUpdate.New {
+								rejoinedElevator_orderhandlerCh.Send <- heartbeat
+							}
+						}
+					}
 				}
 			}
 
+			// the orderhandler stops assigning new orders to suspected elevators.
+			// Lost peers stay suspected until they are back, the orderhandler may
+			// handle this before it handles their loss.
+			for _, lastHeartbeat := range peerUpdate.Lost {
+				lostPeers[lastHeartbeat.SenderID] = true
+			}
+			delete(lostPeers, peerUpdate.New)
+			suspected := append([]string{}, peerUpdate.Suspected...)
+			for id := range lostPeers {
+				if !contains(suspected, id) {
+					suspected = append(suspected, id)
+				}
+			}
+			sort.Strings(suspected)
+			if !reflect.DeepEqual(suspected, suspectedPeers) {
+				Log.Printf("suspected: %v\n", suspected)
+				suspectedPeers = suspected
+				suspectedElevators_orderhandlerCh.Send <- suspectedPeers
+			}
+
 			allElevatorsHeartbeat_orderhandlerCh.Send <- peerUpdate.Peers
 
 		case msg, _ := <-completedOrder_orderhandlerCh.Recv:
 			order := msg.(msgs.Order)
 
 			if _, exists := allOrders[order.ID]; exists {
-				Info.Printf("order %v completed by this elevator\n", order)
-				completeOrderSend_bcastCh <- msgs.CompleteOrderMsg{SenderID: thisID,
-					Order: order}
-				allOrders[order.ID] = createStampedOrder(order, ACKWAIT_COMPLETE)
+				Log.Printf("order %v completed by this elevator\n", order)
+				completeMsg := msgs.CompleteOrderMsg{SenderID: thisID, Seq: seq.next(), Clock: clock.tick(), Order: order}
+				if orderDecisions.complete(order.ID, Stamp{Clock: completeMsg.Clock, NodeID: thisID}, thisID) {
+					timeline = addToTimeline(timeline, "completed", completeMsg.Clock, order, allOrders[order.ID].OrderMsg.Order.MasterID, thisID)
+				}
+				completeOrderSend_bcastCh <- completeMsg
+				setStampedOrder(allOrders, order, ACKWAIT_COMPLETE, completeMsg.Clock)
 				allOrders[order.ID].OrderMsg.SenderID = thisID
+				allOrders[order.ID].OrderMsg.Seq = completeMsg.Seq
+				allOrders[order.ID].OrderMsg.Clock = completeMsg.Clock
 			}
 
 		case msg := <-completeOrderRecv_bcastCh:
+			clock.observe(msg.Clock)
 
 			if msg.SenderID != thisID {
-					completeOrderAckSend_bcastCh <- msgs.CompleteOrderAck{SenderID: thisID,
-						ReceiverID: msg.SenderID,
-						Order:      msg.Order}
+				completeOrderAckSend_bcastCh <- msgs.CompleteOrderAck{SenderID: thisID,
+					ReceiverID: msg.SenderID,
+					AckSeq:     msg.Seq,
+					Clock:      clock.tick(),
+					Order:      msg.Order}
+				if dedup.isDuplicate(msg.SenderID, msg.Seq) {
+					duplicates.Inc("CompleteOrderMsg")
+					break
+				}
 
-				Info.Printf("order %v completed by %v\n", msg.Order, msg.SenderID)
+				Log.Printf("order %v completed by %v\n", msg.Order, msg.SenderID)
+				stamp := Stamp{Clock: msg.Clock, NodeID: msg.SenderID}
+				if orderDecisions.complete(msg.Order.ID, stamp, msg.SenderID) {
+					timeline = completeInTimeline(timeline, msg.Clock, msg.Order, msg.SenderID)
+				} else {
+					Log.Printf("order %v was completed before by %v\n", msg.Order.ID, orderDecisions.get(msg.Order.ID).CompletedBy)
+				}
 				completedHallOrderOtherElev_orderhandlerCh.Send <- msg.Order
+				// equivalent orders placed on other elevators are completed as well,
+				// but not those placed after the completion, they are new calls
+				for orderID, stampedOrder := range allOrders {
+					if stampedOrder.OrderMsg.Order.Floor == msg.Order.Floor && stampedOrder.OrderMsg.Order.Type == msg.Order.Type &&
+						stampedOrder.OrderState != ACKWAIT_COMPLETE && stampedOrder.PlacedClock <= msg.Clock {
+						orderDecisions.complete(orderID, stamp, msg.SenderID)
+						if orderID != msg.Order.ID {
+							completedHallOrderOtherElev_orderhandlerCh.Send <- stampedOrder.OrderMsg.Order
+						}
+						delete(allOrders, orderID)
+					}
+				}
 				delete(allOrders, msg.Order.ID)
 			}
 
 		case msg := <-completeOrderAckRecv_bcastCh:
+			clock.observe(msg.Clock)
 
 			if msg.SenderID != thisID {
 				if stampedOrder, exists := allOrders[msg.Order.ID]; exists {
-					if stampedOrder.OrderState == ACKWAIT_COMPLETE {
-						Info.Printf("complete order ack for %v from %v\n", msg.Order, msg.SenderID)
+					// the master keeps the order accepted, and its light on, until it
+					// knows of the completion, so only its ack counts while it is alive
+					masterID := msg.Order.MasterID
+					if stampedOrder.OrderState == ACKWAIT_COMPLETE && stampedOrder.OrderMsg.Seq == msg.AckSeq &&
+						(msg.SenderID == masterID || masterID == thisID || !alivePeers[masterID]) {
+						Log.Debugf("complete order ack for %v from %v\n", msg.Order, msg.SenderID)
 						delete(allOrders, msg.Order.ID)
 					}
 				}
@@ -350,66 +687,120 @@ func CommHandler(thisID string, commonPort int,
 			heartbeat := msg.(msgs.Heartbeat)
 
 			heartbeat.SenderID = thisID
+			heartbeat.Clock = clock.now()
 			updateHeartbeat_peerCh <- heartbeat
 
-		case msg := <-lastKnowHeartbeatRecv_bcastCh:
+		case msg, _ := <-cabOrders_fsmCh.Recv:
+			cabOrders := msg.([fsm.N_FLOORS]bool)
+
+			Log.Debugf("cab orders now %v\n", cabOrders)
+			cabBackup = &CabBackup{Seq: seq.next(), CabOrders: cabOrders, TimeStamp: time.Now()}
+
+		case msg := <-cabBackupRecv_bcastCh:
+			clock.observe(msg.Clock)
 			if msg.SenderID == thisID {
-				// this elevator just woke up
-				Info.Printf("my last orders were: %v\n", msg.Status.Orders)
-				lastKnownOrders_orderhandlerCh.Send <- msg.Status.Orders
-				// acknowledge
-				lastKnowHeartbeatAckSend_bcastCh <- msgs.HeartbeatAck(msg)
+				break
+			}
+			if msg.OwnerID == thisID && msg.TargetID == thisID && !restore.done {
+				// answer to this elevator's restore request
+				if restore.firstAnswer.IsZero() {
+					restore.firstAnswer = time.Now()
+				}
+				if msg.Seq >= restore.newest.Seq {
+					restore.newest = msg
+				}
+				break
+			}
+			if msg.OwnerID == thisID {
+				break
+			}
+			if msg.SenderID == msg.OwnerID {
+				cabBackupAckSend_bcastCh <- msgs.CabBackupAck{SenderID: thisID, ReceiverID: msg.SenderID,
+					AckSeq: msg.Seq, Clock: clock.tick()}
+			}
+			// answers to others keep this node's backup up to date as well
+			if kept, exists := cabBackups[msg.OwnerID]; !exists || msg.Seq > kept.Seq {
+				Log.Debugf("backing up cab orders %v of %v\n", msg.CabOrders, msg.OwnerID)
+				cabBackups[msg.OwnerID] = &CabBackup{Seq: msg.Seq, CabOrders: msg.CabOrders, TimeStamp: time.Now()}
+			}
 
+		case msg := <-cabBackupAckRecv_bcastCh:
+			clock.observe(msg.Clock)
+			if msg.ReceiverID == thisID && cabBackup != nil && cabBackup.Seq == msg.AckSeq && cabBackup.AckedBy == "" {
+				Log.Printf("cab orders %v backed up by %v\n", cabBackup.CabOrders, msg.SenderID)
+				cabBackup.AckedBy = msg.SenderID
+				backedUpCabOrders_fsmCh.Send <- cabBackup.CabOrders
 			}
 
-		case msg := <-lastKnowHeartbeatAckRecv_bcastCh:
-			Info.Printf("%v acks its last heartbeat\n", msg.SenderID)
-			delete(lastHeartbeats, msg.SenderID)
+		case msg := <-cabRestoreRecv_bcastCh:
+			clock.observe(msg.Clock)
+			if msg.SenderID != thisID {
+				answer := msgs.CabBackupMsg{SenderID: thisID, OwnerID: msg.SenderID, TargetID: msg.SenderID,
+					Clock: clock.tick()}
+				if kept, exists := cabBackups[msg.SenderID]; exists {
+					answer.Seq = kept.Seq
+					answer.CabOrders = kept.CabOrders
+				}
+				Log.Printf("%v asks for its cab orders: %v\n", msg.SenderID, answer.CabOrders)
+				cabBackupSend_bcastCh <- answer
+			}
+
+		case msg, _ := <-statusRequest_apiCh.Recv:
+			replyCh := msg.(chan Snapshot)
+
+			snapshot := Snapshot{AllOrders: make(map[string]StampedOrder),
+				LastHeartbeats: make(map[string]StampedLastHeartbeat)}
+			for orderID, stampedOrder := range allOrders {
+				snapshot.AllOrders[orderID] = *stampedOrder
+			}
+			for id, heartbeatStamped := range lastHeartbeats {
+				snapshot.LastHeartbeats[id] = *heartbeatStamped
+			}
+			if cabBackup != nil {
+				backup := *cabBackup
+				snapshot.CabBackup = &backup
+			}
+			snapshot.CabBackups = make(map[string]CabBackup)
+			for id, backup := range cabBackups {
+				snapshot.CabBackups[id] = *backup
+			}
+			for id, lastSeen := range peerLastSeen {
+				snapshot.Peers = append(snapshot.Peers, PeerStatus{ID: id, LastSeen: lastSeen, Alive: alivePeers[id],
+					Phi: peerPhi[id], Suspected: contains(suspectedPeers, id)})
+			}
+			sort.Slice(snapshot.Peers, func(i, j int) bool { return snapshot.Peers[i].ID < snapshot.Peers[j].ID })
+			snapshot.Timeline = append([]TimelineEntry(nil), timeline...)
+			snapshot.Partitions = partitions.snapshot()
+			snapshot.Clock = clock.now()
+			replyCh <- snapshot
 
-		case <- time.After(timeoutCheckMaxPeriod):
+		case <-time.After(timeoutCheckMaxPeriod):
 			// guarantees that the statements below are run sufficiently often.
 		}
 
 		// actions that happen on every update
 		for orderID, stampedOrder := range allOrders {
 			// retransmission if necessary
-			checkAndRetransmit(allOrders, orderID, thisID,
+			checkAndRetransmit(allOrders, orderID, thisID, redundancy,
 				placedOrderSend_bcastCh, takeOrderSend_bcastCh, completeOrderSend_bcastCh,
-				takeOrder_orderhandlerCh, redundantOrder_orderhandlerCh)
+				takeOrder_orderhandlerCh, redundantOrder_orderhandlerCh, ignoredOrder_orderhandlerCh)
 			placeAgainDuration := time.Duration(stampedOrder.PlacedCount) * placeAgainTimeIncrement
 			deleteTime := stampedOrder.TimeStamp.Add(placeAgainDuration)
 
 			if stampedOrder.OrderState == ACKWAIT_PLACED && time.Now().After(deleteTime) {
-				Info.Printf("delete old order: %v\n", orderID)
+				Log.Printf("delete old order: %v\n", orderID)
+				ignoredOrder_orderhandlerCh.Send <- stampedOrder.OrderMsg.Order
 				delete(allOrders, orderID)
 			}
 		}
 
-		for orderID, stampedOrder := range allOrders {
-			if time.Since(stampedOrder.TimeStamp) > giveupOtherElevTimeout {
-				Info.Printf("complete not recieved for %v\n", orderID)
-
-				msg := msgs.TakeOrderMsg{SenderID: thisID,
-					ReceiverID: thisID,
-					Order:      allOrders[orderID].OrderMsg.Order}
-
-				takeOrder_orderhandlerCh.Send <- msg
-				allOrders[orderID] = createStampedOrder(stampedOrder.OrderMsg.Order, SERVING)
-			}
-		}
-
-		for _, heartbeatStamped := range lastHeartbeats {
-			if heartbeatStamped.Alive {
-				retransmitDuration := time.Duration(heartbeatStamped.TransmitCount) * ackwaitTimeout
-				timeoutTime := heartbeatStamped.TimeStamp.Add(retransmitDuration)
-				if heartbeatStamped.TransmitCount <= retransmitCountMax {
-					if time.Now().After(timeoutTime) {
-						Info.Printf("retransmitting last heartbeat for %v for time %v\n", heartbeatStamped.LastHeartbeat.SenderID, heartbeatStamped.TransmitCount)
-						heartbeatStamped.TransmitCount += 1
-						lastKnowHeartbeatSend_bcastCh <- heartbeatStamped.LastHeartbeat
-					}
-				}
+		if cabOrders, restored := checkRestore(&restore, thisID, &clock, cabRestoreSend_bcastCh); restored {
+			var lastOrders [fsm.N_FLOORS][fsm.N_BUTTONS]bool
+			for floor := 0; floor < fsm.N_FLOORS; floor++ {
+				lastOrders[floor][elevio.BT_Cab] = cabOrders[floor]
 			}
+			lastKnownOrders_orderhandlerCh.Send <- lastOrders
 		}
+		checkAndRetransmitCab(cabBackup, &restore, thisID, &clock, cabBackupSend_bcastCh)
 	}
 }
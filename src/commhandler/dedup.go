@@ -0,0 +1,56 @@
+package commhandler
+
+import (
+	"time"
+)
+
+// Receiver side duplicate suppression. Every node numbers the order messages
+// it sends, and retransmissions keep the number of the original. A message is
+// a duplicate when its number has been seen before, or when it is too old to
+// be remembered. Numbering starts at the boot time, so a restarted node is
+// not mistaken for sending old messages.
+
+const dedupWindowSize = 256 // numbers remembered per sender
+
+type sequence uint64
+
+func newSequence() *sequence {
+	s := sequence(time.Now().UnixNano())
+	return &s
+}
+
+func (s *sequence) next() uint64 {
+	*s += 1
+	return uint64(*s)
+}
+
+type dedupWindow struct {
+	highest uint64
+	seen    map[uint64]bool // numbers within the window
+}
+
+type dedupFilter map[string]*dedupWindow
+
+func (f dedupFilter) isDuplicate(senderID string, seq uint64) bool {
+	if seq == 0 {
+		return false // not numbered
+	}
+	window, exists := f[senderID]
+	if !exists {
+		window = &dedupWindow{seen: make(map[uint64]bool)}
+		f[senderID] = window
+	}
+	if seq+dedupWindowSize <= window.highest || window.seen[seq] {
+		return true
+	}
+	window.seen[seq] = true
+	if seq > window.highest {
+		window.highest = seq
+		for old := range window.seen {
+			if old+dedupWindowSize <= window.highest {
+				delete(window.seen, old)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package commhandler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupFilter(t *testing.T) {
+	type received struct {
+		senderID  string
+		seq       uint64
+		duplicate bool
+	}
+	tests := []struct {
+		name     string
+		received []received
+	}{
+		{"unnumbered is never a duplicate", []received{
+			{"A", 0, false}, {"A", 0, false},
+		}},
+		{"repeated", []received{
+			{"A", 10, false}, {"A", 10, true}, {"A", 11, false}, {"A", 10, true}, {"A", 11, true},
+		}},
+		{"reordered", []received{
+			{"A", 10, false}, {"A", 13, false}, {"A", 11, false}, {"A", 12, false},
+			{"A", 11, true}, {"A", 13, true},
+		}},
+		{"senders are apart", []received{
+			{"A", 10, false}, {"B", 10, false}, {"B", 10, true}, {"A", 10, true},
+		}},
+		{"window edge", []received{
+			{"A", 100, false}, {"A", 100 + dedupWindowSize - 1, false},
+			{"A", 101, false}, // within the window, never seen
+			{"A", 100, true},  // remembered
+			{"A", 99, true},   // too old
+			{"A", 100 + dedupWindowSize, false},
+			{"A", 100, true},  // too old now
+			{"A", 101, true},  // remembered
+			{"A", 102, false}, // within the window, never seen
+		}},
+		{"jump past the window", []received{
+			{"A", 10, false}, {"A", 10 + 10*dedupWindowSize, false}, {"A", 11, true},
+			{"A", 10 + 10*dedupWindowSize, true},
+		}},
+	}
+
+	for _, test := range tests {
+		filter := make(dedupFilter)
+		for i, r := range test.received {
+			if duplicate := filter.isDuplicate(r.senderID, r.seq); duplicate != r.duplicate {
+				t.Errorf("%v: message %v (%v %v): duplicate %v, want %v", test.name, i, r.senderID, r.seq, duplicate, r.duplicate)
+			}
+		}
+	}
+}
+
+func TestDedupFilterForgets(t *testing.T) {
+	filter := make(dedupFilter)
+	for seq := uint64(1); seq <= 10*dedupWindowSize; seq++ {
+		filter.isDuplicate("A", seq)
+	}
+	if seen := len(filter["A"].seen); seen > dedupWindowSize {
+		t.Errorf("remembers %v numbers, want at most %v", seen, dedupWindowSize)
+	}
+}
+
+func TestDedupFilterReboot(t *testing.T) {
+	boot := time.Now()
+	before := sequence(boot.UnixNano())
+	filter := make(dedupFilter)
+	for i := 0; i < 3*dedupWindowSize; i++ {
+		if filter.isDuplicate("A", before.next()) {
+			t.Fatalf("message %v before the reboot is a duplicate", i)
+		}
+	}
+
+	// a restarted node numbers from its new boot time, past the old numbers
+	after := sequence(boot.Add(time.Second).UnixNano())
+	for i := 0; i < 3; i++ {
+		if filter.isDuplicate("A", after.next()) {
+			t.Errorf("message %v after the reboot is a duplicate", i)
+		}
+	}
+	if !filter.isDuplicate("A", uint64(before)) {
+		t.Errorf("last message before the reboot is not a duplicate")
+	}
+}
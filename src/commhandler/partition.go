@@ -0,0 +1,85 @@
+package commhandler
+
+import (
+	"time"
+)
+
+// Peers lost within partitionWindow of each other are taken to be cut off by
+// the same network split. A group is healed when all its peers are seen again.
+// A single lost peer is a group of its own, as a crash and a split of two
+// nodes look the same. The orderhandler reconciles its orders with every
+// peer that rejoins.
+
+const partitionWindow = 1 * time.Second
+const partitionHistoryLength = 20 // partitions kept for the status api
+
+type Partition struct {
+	Start    time.Time `json:"start"`
+	Lost     []string  `json:"lost"`
+	Rejoined []string  `json:"rejoined"`
+	Healed   bool      `json:"healed"`
+	Duration float64   `json:"duration_seconds"` // set when healed
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+type partitionTracker struct {
+	partitions []*Partition // oldest first
+}
+
+// lost reports if the peer started a new partition
+func (t *partitionTracker) lost(id string, now time.Time) bool {
+	if last := t.latest(); last != nil {
+		if !last.Healed && now.Sub(last.Start) < partitionWindow && len(last.Rejoined) == 0 {
+			last.Lost = append(last.Lost, id)
+			return false
+		}
+	}
+	t.partitions = append(t.partitions, &Partition{Start: now, Lost: []string{id}})
+	if len(t.partitions) > partitionHistoryLength {
+		t.partitions = t.partitions[len(t.partitions)-partitionHistoryLength:]
+	}
+	return true
+}
+
+// latest is nil if no peer has been lost
+func (t *partitionTracker) latest() *Partition {
+	if len(t.partitions) == 0 {
+		return nil
+	}
+	return t.partitions[len(t.partitions)-1]
+}
+
+// rejoined returns the partition the peer was lost in, if it is remembered
+func (t *partitionTracker) rejoined(id string, now time.Time) (*Partition, bool) {
+	for i := len(t.partitions) - 1; i >= 0; i-- {
+		p := t.partitions[i]
+		if p.Healed || !contains(p.Lost, id) || contains(p.Rejoined, id) {
+			continue
+		}
+		p.Rejoined = append(p.Rejoined, id)
+		if len(p.Rejoined) == len(p.Lost) {
+			p.Healed = true
+			p.Duration = now.Sub(p.Start).Seconds()
+		}
+		return p, true
+	}
+	return nil, false
+}
+
+func (t *partitionTracker) snapshot() []Partition {
+	partitions := make([]Partition, len(t.partitions))
+	for i, p := range t.partitions {
+		partitions[i] = *p
+		partitions[i].Lost = append([]string(nil), p.Lost...)
+		partitions[i].Rejoined = append([]string(nil), p.Rejoined...)
+	}
+	return partitions
+}
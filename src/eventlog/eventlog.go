@@ -0,0 +1,93 @@
+package eventlog
+
+import (
+	"../go-nonblockingchan"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Structured log of every message crossing a module boundary, written as one
+// JSON encoded Entry per line
+
+type Entry struct {
+	Time    time.Time       `json:"time"`
+	NodeID  string          `json:"node_id"`
+	Channel string          `json:"channel"`
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type Logger struct {
+	nodeID  string
+	mtx     sync.Mutex
+	encoder *json.Encoder
+}
+
+// Channel is a module boundary. The writing module sends on In and the reading
+// module receives on Out. Without logging In and Out are the same channel.
+type Channel struct {
+	In  *nbc.NonBlockingChan
+	Out *nbc.NonBlockingChan
+}
+
+func New(w io.Writer, nodeID string) *Logger {
+	return &Logger{nodeID: nodeID, encoder: json.NewEncoder(w)}
+}
+
+// NewChannel creates a channel from module `from` to module `to`. Every
+// message is logged before it is forwarded, unless l is nil.
+func (l *Logger) NewChannel(name string, from string, to string) Channel {
+	in := nbc.New()
+	if l == nil {
+		return Channel{In: in, Out: in}
+	}
+	out := nbc.New()
+	go func() {
+		for msg := range in.Recv {
+			l.Log(name, from, to, msg)
+			out.Send <- msg
+		}
+	}()
+	return Channel{In: in, Out: out}
+}
+
+func (l *Logger) Log(channel string, from string, to string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	entry := Entry{Time: time.Now(),
+		NodeID:  l.nodeID,
+		Channel: channel,
+		From:    from,
+		To:      to,
+		Type:    fmt.Sprintf("%T", msg),
+		Payload: payload}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.encoder.Encode(entry)
+}
+
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -3,13 +3,26 @@ package fsm
 import (
 	"../elevio"
 	"../go-nonblockingchan"
-	"log"
-	"os"
+	"../logging"
+	"../metrics"
 	"sync"
 	"time"
 )
 
-var Info *log.Logger
+var Log = logging.New("fsm")
+
+var doorOpenTime = metrics.NewHistogram("elevator_door_open_seconds",
+	"Time the door stays open", []float64{1, 2, 3, 4, 5, 7.5, 10, 20})
+var motorRunTime = metrics.NewCounter("elevator_motor_run_seconds_total",
+	"Time the motor has been running")
+var cabOrderBackupTime = metrics.NewHistogram("elevator_cab_order_backup_seconds",
+	"Time from a cab order is placed until it is backed up by a peer (light on)", []float64{0.1, 0.5, 1, 2, 5, 10})
+var cabOrderServiceTime = metrics.NewHistogram("elevator_cab_order_service_seconds",
+	"Time from a cab order is placed until the door opens at its floor", []float64{1, 2, 5, 10, 20, 30, 60, 120})
+
+var doorOpenedAt time.Time
+var motorStartedAt time.Time // zero when the motor is stopped
+var cabOrderPlacedAt [N_FLOORS]time.Time
 
 const N_FLOORS = 4
 const N_BUTTONS = 3
@@ -35,7 +48,15 @@ type Elevator struct {
 type OrderEvent struct {
 	Floor       int
 	Button      elevio.ButtonType
-	TurnLightOn bool
+	TurnLightOn bool // cab orders only, hall lights are set by updateLights
+}
+
+// Order removed through the status api. A completed order is reported as if
+// this elevator had served it, a cancelled order is only dropped here
+type OrderCommand struct {
+	Floor    int
+	Button   elevio.ButtonType
+	Complete bool
 }
 
 func FSM(elevServerAddr string,
@@ -43,16 +64,20 @@ func FSM(elevServerAddr string,
 	addOrder_orderhandlerCh *nbc.NonBlockingChan,
 	deleteHallOrder_orderhandlerCh *nbc.NonBlockingChan,
 	updateLights_orderhandlerCh *nbc.NonBlockingChan,
+	injectButton_apiCh *nbc.NonBlockingChan,
+	statusRequest_apiCh *nbc.NonBlockingChan,
+	orderCommand_apiCh *nbc.NonBlockingChan,
+	backedUpCabOrders_commhandlerCh *nbc.NonBlockingChan,
 	/* Write channels */
 	placedOrder_orderhandlerCh *nbc.NonBlockingChan,
 	completedHallOrders_orderhandlerCh *nbc.NonBlockingChan,
 	elevatorStatus_orderhandlerCh *nbc.NonBlockingChan,
+	cabOrders_commhandlerCh *nbc.NonBlockingChan,
 	/* Sync */
 	wg_ptr *sync.WaitGroup) {
 
-	Info = log.New(os.Stdout, "[fsm]: ", 0)
-
 	var elevator Elevator
+	var sentCabOrders [N_FLOORS]bool // last sent to the commhandler
 	var doorTimer = time.NewTimer(DOOR_OPEN_TIME * time.Second)
 	doorTimer.Stop()
 	buttonCh := make(chan elevio.ButtonEvent)
@@ -65,20 +90,41 @@ func FSM(elevServerAddr string,
 
 	// Wait until all modules are initialized
 	wg_ptr.Done()
-	Info.Println("initialized")
+	Log.Println("initialized")
 	wg_ptr.Wait()
-	Info.Println("starting")
+	Log.Println("starting")
 
 	for {
-		elevatorStatus_orderhandlerCh.Send <-elevator
+		elevatorStatus_orderhandlerCh.Send <- elevator
 		select {
 		case buttonEvent := <-buttonCh:
-			orderEvent := OrderEvent{Floor: buttonEvent.Floor, Button: buttonEvent.Button}
-			if buttonEvent.Button == elevio.BT_Cab {
-				orderEvent.TurnLightOn = true
-				fsmOnAddedOrder(&elevator, doorTimer, orderEvent)
-			} else {
-				placedOrder_orderhandlerCh.Send <-orderEvent
+			fsmOnButtonPress(&elevator, doorTimer, buttonEvent, placedOrder_orderhandlerCh)
+
+		case msg, _ := <-injectButton_apiCh.Recv:
+			// button pressed remotely, handled like a press on the panel
+			buttonEvent := msg.(elevio.ButtonEvent)
+			fsmOnButtonPress(&elevator, doorTimer, buttonEvent, placedOrder_orderhandlerCh)
+
+		case msg, _ := <-statusRequest_apiCh.Recv:
+			replyCh := msg.(chan Elevator)
+			replyCh <- elevator
+
+		case msg, _ := <-orderCommand_apiCh.Recv:
+			command := msg.(OrderCommand)
+			if !elevator.Orders[command.Floor][command.Button] {
+				Log.Warnf("no order %+v to remove\n", command)
+				break
+			}
+			if !command.Complete && command.Button == elevio.BT_Cab {
+				cabOrderPlacedAt[command.Floor] = time.Time{}
+			}
+			clearOrder(&elevator, command.Floor, command.Button, true)
+			if !command.Complete {
+				elevator.CompletedOrders[command.Floor][command.Button] = false
+			}
+			Log.Printf("order removed remotely %+v\n", command)
+			if elevator.State == ST_DoorOpen {
+				updateElevatorDirection(&elevator)
 			}
 
 		case msg, _ := <-addOrder_orderhandlerCh.Recv:
@@ -90,8 +136,8 @@ func FSM(elevServerAddr string,
 			clearOrder(&elevator, hallOrder.Floor, hallOrder.Button, true)
 			// hallOrder was not completed by this elevator. Hence,
 			elevator.CompletedOrders[hallOrder.Floor][hallOrder.Button] = false
-			Info.Printf("deleteHallOrder %+v\n", hallOrder)
-			Info.Printf("orders now %+v\n", elevator.Orders)
+			Log.Printf("deleteHallOrder %+v\n", hallOrder)
+			Log.Debugf("orders now %+v\n", elevator.Orders)
 			if elevator.State == ST_DoorOpen {
 				updateElevatorDirection(&elevator)
 				clearOrdersAtFloor(&elevator, true)
@@ -114,6 +160,7 @@ func FSM(elevServerAddr string,
 
 		case <-doorTimer.C:
 			elevio.SetDoorOpenLamp(false)
+			doorOpenTime.Observe(time.Since(doorOpenedAt).Seconds())
 			updateElevatorDirection(&elevator)
 			if elevator.Dir == elevio.MD_Stop {
 				setStateToIdle(&elevator)
@@ -121,13 +168,27 @@ func FSM(elevServerAddr string,
 				setStateToDrive(&elevator)
 			}
 
+		case msg, _ := <-backedUpCabOrders_commhandlerCh.Recv:
+			// spec 1.8: a cab order is accepted once a peer has backed it up
+			backedUp := msg.([N_FLOORS]bool)
+			for floor := 0; floor < N_FLOORS; floor++ {
+				if backedUp[floor] && elevator.Orders[floor][elevio.BT_Cab] && !elevator.Lights[floor][elevio.BT_Cab] {
+					elevator.Lights[floor][elevio.BT_Cab] = true
+					elevio.SetButtonLamp(elevio.BT_Cab, floor, true)
+					if !cabOrderPlacedAt[floor].IsZero() {
+						cabOrderBackupTime.Observe(time.Since(cabOrderPlacedAt[floor]).Seconds())
+					}
+				}
+			}
+
 		case msg, _ := <-updateLights_orderhandlerCh.Recv:
 			updateLights := msg.([N_FLOORS][N_BUTTONS]bool)
 			for floor := 0; floor < N_FLOORS; floor++ {
 				for button := 0; button < N_BUTTONS; button++ {
 					if elevio.ButtonType(button) != elevio.BT_Cab &&
 						!(floor == N_FLOORS-1 && elevio.ButtonType(button) == elevio.BT_HallUp) &&
-						!(floor == 0 && elevio.ButtonType(button) == elevio.BT_HallDown) {
+						!(floor == 0 && elevio.ButtonType(button) == elevio.BT_HallDown) &&
+						elevator.Lights[floor][button] != updateLights[floor][button] {
 						elevator.Lights[floor][button] = updateLights[floor][button]
 						elevio.SetButtonLamp(elevio.ButtonType(button), floor, elevator.Lights[floor][button])
 					}
@@ -147,8 +208,18 @@ func FSM(elevServerAddr string,
 			}
 		}
 		if len(completedHallOrders) > 0 {
-			completedHallOrders_orderhandlerCh.Send <-completedHallOrders
-			Info.Printf("completedHallOrders: %v", completedHallOrders)
+			completedHallOrders_orderhandlerCh.Send <- completedHallOrders
+			Log.Printf("completedHallOrders: %v", completedHallOrders)
+		}
+
+		// placed, restored, completed and removed cab orders are backed up
+		var cabOrders [N_FLOORS]bool
+		for floor := 0; floor < N_FLOORS; floor++ {
+			cabOrders[floor] = elevator.Orders[floor][elevio.BT_Cab]
+		}
+		if cabOrders != sentCabOrders {
+			cabOrders_commhandlerCh.Send <- cabOrders
+			sentCabOrders = cabOrders
 		}
 	}
 }
@@ -161,19 +232,33 @@ func initializeState(elev *Elevator, floorSensorCh <-chan int) {
 			elevio.SetButtonLamp(elevio.ButtonType(button), floor, false)
 		}
 	}
-	elevio.SetMotorDirection(elevio.MD_Down)
+	setMotorDirection(elevio.MD_Down)
 	elev.Floor = <-floorSensorCh
 	elev.Dir = elevio.MD_Stop
 	setStateToIdle(elev)
 	elevio.SetFloorIndicator(elev.Floor)
 }
 
+func fsmOnButtonPress(elev *Elevator, doorTimer *time.Timer, buttonEvent elevio.ButtonEvent,
+	placedOrder_orderhandlerCh *nbc.NonBlockingChan) {
+	orderEvent := OrderEvent{Floor: buttonEvent.Floor, Button: buttonEvent.Button}
+	if buttonEvent.Button == elevio.BT_Cab {
+		// served at once, the light is turned on when it is backed up
+		if cabOrderPlacedAt[buttonEvent.Floor].IsZero() {
+			cabOrderPlacedAt[buttonEvent.Floor] = time.Now()
+		}
+		fsmOnAddedOrder(elev, doorTimer, orderEvent)
+	} else {
+		placedOrder_orderhandlerCh.Send <- orderEvent
+	}
+}
+
 func fsmOnAddedOrder(elev *Elevator, doorTimer *time.Timer, order OrderEvent) {
 	elev.Orders[order.Floor][order.Button] = true
-	orderLightStatus := elev.Lights[order.Floor][order.Button]
-	orderLightStatus = orderLightStatus || order.TurnLightOn
-	elev.Lights[order.Floor][order.Button] = orderLightStatus
-	elevio.SetButtonLamp(order.Button, order.Floor, orderLightStatus)
+	if order.Button == elevio.BT_Cab && order.TurnLightOn {
+		elev.Lights[order.Floor][order.Button] = true
+		elevio.SetButtonLamp(order.Button, order.Floor, true)
+	}
 	switch elev.State {
 	case ST_Idle:
 		if shouldOpenDoor(*elev) {
@@ -194,20 +279,34 @@ func fsmOnAddedOrder(elev *Elevator, doorTimer *time.Timer, order OrderEvent) {
 }
 
 func setStateToDoorOpen(elev *Elevator, doorTimer *time.Timer) {
+	if elev.State != ST_DoorOpen {
+		doorOpenedAt = time.Now()
+	}
 	elev.State = ST_DoorOpen
-	elevio.SetMotorDirection(elevio.MD_Stop)
+	setMotorDirection(elevio.MD_Stop)
 	elevio.SetDoorOpenLamp(true)
 	doorTimer.Reset(DOOR_OPEN_TIME * time.Second)
 }
 
 func setStateToDrive(elev *Elevator) {
 	elev.State = ST_Moving
-	elevio.SetMotorDirection(elev.Dir)
+	setMotorDirection(elev.Dir)
 }
 
 func setStateToIdle(elev *Elevator) {
 	elev.State = ST_Idle
-	elevio.SetMotorDirection(elev.Dir)
+	setMotorDirection(elev.Dir)
+}
+
+// keeps track of the motor run time
+func setMotorDirection(dir elevio.MotorDirection) {
+	if dir == elevio.MD_Stop && !motorStartedAt.IsZero() {
+		motorRunTime.Add(time.Since(motorStartedAt).Seconds())
+		motorStartedAt = time.Time{}
+	} else if dir != elevio.MD_Stop && motorStartedAt.IsZero() {
+		motorStartedAt = time.Now()
+	}
+	elevio.SetMotorDirection(dir)
 }
 
 func isOrderAbove(elev Elevator) bool {
@@ -286,7 +385,11 @@ func clearOrder(elev *Elevator, floor int, buttonType elevio.ButtonType, hasHard
 		elev.CompletedOrders[floor][buttonType] = true
 		elev.Lights[floor][buttonType] = false
 		if hasHardwareAccess {
-			elevio.SetButtonLamp(buttonType, elev.Floor, false)
+			elevio.SetButtonLamp(buttonType, floor, false)
+			if buttonType == elevio.BT_Cab && !cabOrderPlacedAt[floor].IsZero() {
+				cabOrderServiceTime.Observe(time.Since(cabOrderPlacedAt[floor]).Seconds())
+				cabOrderPlacedAt[floor] = time.Time{}
+			}
 		}
 	}
 }
@@ -340,6 +443,9 @@ func EstimatedCompletionTime(elev Elevator, orderEvent OrderEvent) float64 {
 			if elev.Dir == elevio.MD_Stop {
 				return duration
 			}
+		} else {
+			// turn when passing the last order, as on arrival at a floor
+			updateElevatorDirection(&elev)
 		}
 		elev.Floor += int(elev.Dir)
 		duration += TRAVEL_TIME
@@ -0,0 +1,181 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Leveled loggers, one per module. Levels can be set per module at startup
+// (-loglevel) and changed at runtime. All modules share the same output and
+// node id prefix.
+
+type Level int32
+
+const (
+	LV_Debug Level = iota
+	LV_Info
+	LV_Warn
+	LV_Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case LV_Debug:
+		return "DEBUG"
+	case LV_Info:
+		return "INFO"
+	case LV_Warn:
+		return "WARN"
+	case LV_Error:
+		return "ERROR"
+	default:
+		return "somelevel"
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LV_Debug, nil
+	case "info":
+		return LV_Info, nil
+	case "warn", "warning":
+		return LV_Warn, nil
+	case "error":
+		return LV_Error, nil
+	}
+	return LV_Info, fmt.Errorf("unknown log level %q", s)
+}
+
+type Logger struct {
+	module string
+	level  int32
+}
+
+var mtx sync.Mutex
+var output io.Writer = os.Stdout
+var nodeID = "-"
+var defaultLevel = LV_Info
+var loggers = make(map[string]*Logger)
+
+// New returns the logger for module, creating it if necessary
+func New(module string) *Logger {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if l, exists := loggers[module]; exists {
+		return l
+	}
+	l := &Logger{module: module, level: int32(defaultLevel)}
+	loggers[module] = l
+	return l
+}
+
+func SetOutput(w io.Writer) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	output = w
+}
+
+func SetNodeID(id string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	nodeID = id
+}
+
+// SetLevel sets the level of module, or of all modules if module is "all"
+func SetLevel(module string, level Level) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if module == "all" {
+		defaultLevel = level
+		for _, l := range loggers {
+			atomic.StoreInt32(&l.level, int32(level))
+		}
+		return
+	}
+	l, exists := loggers[module]
+	if !exists {
+		l = &Logger{module: module}
+		loggers[module] = l
+	}
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// ParseLevels sets levels from a comma separated list of level or
+// module=level, e.g. "warn,commhandler=debug"
+func ParseLevels(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		module, levelName := "all", item
+		if i := strings.Index(item, "="); i >= 0 {
+			module, levelName = item[:i], item[i+1:]
+		}
+		level, err := ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+		SetLevel(module, level)
+	}
+	return nil
+}
+
+// Levels returns the current level of every module
+func Levels() map[string]string {
+	mtx.Lock()
+	defer mtx.Unlock()
+	levels := make(map[string]string)
+	for module, l := range loggers {
+		levels[module] = Level(atomic.LoadInt32(&l.level)).String()
+	}
+	return levels
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) output(level Level, msg string) {
+	if !l.Enabled(level) {
+		return
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	fmt.Fprintf(output, "%v [%v] %-5v [%v]: %v",
+		time.Now().Format("15:04:05.000"), nodeID, level, l.module, msg)
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(LV_Debug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(LV_Info, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(LV_Warn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(LV_Error, fmt.Sprintf(format, v...))
+}
+
+// Printf and Println log at info level
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(LV_Info, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.output(LV_Info, fmt.Sprintln(v...))
+}
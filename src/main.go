@@ -1,19 +1,45 @@
 package main
 
 import (
+	"./comm/conn"
 	"./commhandler"
+	"./eventlog"
 	"./fsm"
 	"./go-nonblockingchan"
+	"./logging"
+	"./msgs"
 	"./orderhandler"
+	"./raft"
+	"./statusapi"
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var id_ptr = flag.String("id", "noid", "ID for node")
 var elevServerAddr_ptr = flag.String("addr", "localhost:15657", "Port for node")
 var commonPort_ptr = flag.Int("bport", 20010, "Port for all broadcasts")
+var eventLogFile_ptr = flag.String("eventlog", "", "File to log all messages between modules to (JSON lines)")
+var logLevels_ptr = flag.String("loglevel", "info", "Log levels, e.g. \"warn,commhandler=debug\" (debug, info, warn, error)")
+var logFile_ptr = flag.String("logfile", "", "Log to this file instead of stdout")
+var logFileSize_ptr = flag.Int64("logsize", 10, "Size in MB at which the log file is rotated")
+var logFileBackups_ptr = flag.Int("logbackups", 3, "Number of rotated log files to keep")
+var httpPort_ptr = flag.Int("http", 0, "Port for the status and control api (disabled if 0)")
+var httpHost_ptr = flag.String("httphost", "localhost", "Address the status and control api is bound to")
+var replication_ptr = flag.String("replication", "master", "Hall order replication: master (acknowledged messages), crdt (merged heartbeat state) or raft (replicated log)")
+var cluster_ptr = flag.String("cluster", "", "IDs of all nodes with -replication=raft, e.g. \"1,2,3\", orders are committed by a majority of them")
+var assign_ptr = flag.String("assign", "master", "Who assigns hall orders with -replication=master: master (the elevator the order was placed at) or leader (the alive elevator with the lowest ID)")
+var redundancy_ptr = flag.String("redundancy", "lenient", "Hall orders no other elevator acknowledges: strict (ignored), lenient (served without light) or persisted (written to -statedir, served with light)")
+var stateDir_ptr = flag.String("statedir", "state", "Directory for orders persisted with -redundancy=persisted, and the raft log")
+var serviceDeadline_ptr = flag.Duration("deadline", 20*time.Second, "Time an accepted hall order may go unserved before its master reassigns it, then rescues it with all elevators and then raises an alarm (-replication=master)")
+var phiThreshold_ptr = flag.Float64("phi", 8, "Suspicion level at which a silent peer is lost, it is suspected at half of it")
+var testControl_ptr = flag.Bool("testctl", false, "Read control commands (e.g. \"loss 0.25\" or \"loglevel debug\") from stdin")
 
 var wg sync.WaitGroup
 
@@ -27,60 +53,218 @@ func main() {
 		fmt.Println("Specify id")
 		os.Exit(1)
 	}
+	if *replication_ptr != "master" && *replication_ptr != "crdt" && *replication_ptr != "raft" {
+		fmt.Println("Replication must be master, crdt or raft")
+		os.Exit(1)
+	}
+	var cluster []string
+	if *replication_ptr == "raft" {
+		for _, id := range strings.Split(*cluster_ptr, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				cluster = append(cluster, id)
+			}
+		}
+		inCluster := false
+		for _, id := range cluster {
+			inCluster = inCluster || id == *id_ptr
+		}
+		if !inCluster {
+			fmt.Println("Raft replication needs -cluster with the IDs of all nodes, this one included")
+			os.Exit(1)
+		}
+	}
+	if *assign_ptr != "master" && *assign_ptr != "leader" {
+		fmt.Println("Assign must be master or leader")
+		os.Exit(1)
+	}
+	if *assign_ptr == "leader" && *replication_ptr != "master" {
+		fmt.Println("Assign by leader needs -replication=master")
+		os.Exit(1)
+	}
+	if *serviceDeadline_ptr <= 0 {
+		fmt.Println("Service deadline must be positive")
+		os.Exit(1)
+	}
+	if *phiThreshold_ptr <= 0 {
+		fmt.Println("Phi threshold must be positive")
+		os.Exit(1)
+	}
+	if *testControl_ptr {
+		conn.EmulateLoss()
+	}
+	redundancy, err := msgs.ParseRedundancy(*redundancy_ptr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	// Three modules in wait group
+	logging.SetNodeID(*id_ptr)
+	if err := logging.ParseLevels(*logLevels_ptr); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *logFile_ptr != "" {
+		logFile, err := logging.OpenRotatingFile(*logFile_ptr, *logFileSize_ptr*1024*1024, *logFileBackups_ptr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		logging.SetOutput(logFile)
+	}
+
+	var eventLog *eventlog.Logger
+	if *eventLogFile_ptr != "" {
+		f, err := os.Create(*eventLogFile_ptr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		eventLog = eventlog.New(f, *id_ptr)
+	}
+
+	// Three modules in wait group, four with raft
 	wg.Add(3)
+	if *replication_ptr == "raft" {
+		wg.Add(1)
+	}
 
 	// Channels: FSM -> OrderHandler
-	elevatorStatusCh := nbc.New()              //make(chan fsm.Elevator)
-	placedHallOrderCh := nbc.New()             //make(chan fsm.OrderEvent)
-	completedHallOrdersThisElevCh := nbc.New() //make(chan []fsm.OrderEvent)
+	elevatorStatusCh := eventLog.NewChannel("elevatorStatus", "fsm", "orderhandler")                           //make(chan fsm.Elevator)
+	placedHallOrderCh := eventLog.NewChannel("placedHallOrder", "fsm", "orderhandler")                         //make(chan fsm.OrderEvent)
+	completedHallOrdersThisElevCh := eventLog.NewChannel("completedHallOrdersThisElev", "fsm", "orderhandler") //make(chan []fsm.OrderEvent)
 
 	// Channels: OrderHandler -> FSM
-	addHallOrderCh := nbc.New()    //make(chan fsm.OrderEvent)
-	deleteHallOrderCh := nbc.New() //make(chan fsm.OrderEvent)
-	updateLightsCh := nbc.New()    //make(chan [N_FLOORS][N_BUTTONS]bool)
+	addHallOrderCh := eventLog.NewChannel("addHallOrder", "orderhandler", "fsm")       //make(chan fsm.OrderEvent)
+	deleteHallOrderCh := eventLog.NewChannel("deleteHallOrder", "orderhandler", "fsm") //make(chan fsm.OrderEvent)
+	updateLightsCh := eventLog.NewChannel("updateLights", "orderhandler", "fsm")       //make(chan [N_FLOORS][N_BUTTONS]bool)
 
 	// Channels: OrderHandler -> Network
-	assignOrderCh := nbc.New()    //make(chan msgs.TakeOrderMsg)
-	placedOrderCh := nbc.New()           //make(chan msgs.Order)
-	completedOrderCh := nbc.New()        //make(chan msgs.Order)
-	thisElevatorHeartbeatCh := nbc.New() //make(chan msgs.Heartbeat)
+	assignOrderCh := eventLog.NewChannel("assignOrder", "orderhandler", "network")                     //make(chan msgs.TakeOrderMsg)
+	placedOrderCh := eventLog.NewChannel("placedOrder", "orderhandler", "network")                     //make(chan msgs.Order)
+	completedOrderCh := eventLog.NewChannel("completedOrder", "orderhandler", "network")               //make(chan msgs.Order)
+	rescueOrderCh := eventLog.NewChannel("rescueOrder", "orderhandler", "network")                     //make(chan msgs.Order)
+	thisElevatorHeartbeatCh := eventLog.NewChannel("thisElevatorHeartbeat", "orderhandler", "network") //make(chan msgs.Heartbeat)
 
 	// Channels: Network -> OrderHandler
-	allElevatorsHeartbeatCh := nbc.New()   //make(chan []msgs.Heartbeat)
-	redundantOrderCh := nbc.New()               //make(chan msgs.RedundantOrderMsg)
-	takeOrderCh := nbc.New()           //make(chan msgs.TakeOrderMsg)
-	downedElevatorsCh := nbc.New()         //make(chan []msgs.Heartbeat)
-	completedHallOrderOtherElevCh := nbc.New() //make(chan msgs.Order)
-	lastKnownOrdersCh := nbc.New() //make(chan msgs.Heartbeat)
+	allElevatorsHeartbeatCh := eventLog.NewChannel("allElevatorsHeartbeat", "network", "orderhandler")             //make(chan []msgs.Heartbeat)
+	redundantOrderCh := eventLog.NewChannel("redundantOrder", "network", "orderhandler")                           //make(chan msgs.RedundantOrderMsg)
+	ignoredOrderCh := eventLog.NewChannel("ignoredOrder", "network", "orderhandler")                               //make(chan msgs.Order)
+	takeOrderCh := eventLog.NewChannel("takeOrder", "network", "orderhandler")                                     //make(chan msgs.TakeOrderMsg)
+	downedElevatorsCh := eventLog.NewChannel("downedElevators", "network", "orderhandler")                         //make(chan []msgs.Heartbeat)
+	completedHallOrderOtherElevCh := eventLog.NewChannel("completedHallOrderOtherElev", "network", "orderhandler") //make(chan msgs.Order)
+	lastKnownOrdersCh := eventLog.NewChannel("lastKnownOrders", "network", "orderhandler")                         //make(chan [N_FLOORS][N_BUTTONS]bool)
+	rejoinedElevatorCh := eventLog.NewChannel("rejoinedElevator", "network", "orderhandler")                       //make(chan msgs.Heartbeat)
+	suspectedElevatorsCh := eventLog.NewChannel("suspectedElevators", "network", "orderhandler")                   //make(chan []string)
+
+	// Channels: OrderHandler <-> Raft
+	proposeEntryCh := eventLog.NewChannel("proposeEntry", "orderhandler", "raft")     //make(chan msgs.RaftEntry)
+	committedEntryCh := eventLog.NewChannel("committedEntry", "raft", "orderhandler") //make(chan msgs.RaftEntry)
+	raftStatusCh := eventLog.NewChannel("raftStatus", "raft", "orderhandler")         //make(chan raft.Status)
 
 	// Channels: Network -> FSM
-	// (none)
+	backedUpCabOrdersCh := eventLog.NewChannel("backedUpCabOrders", "network", "fsm") //make(chan [N_FLOORS]bool)
 
 	// FSM -> Network
-	// (none)
-
-	go commhandler.CommHandler(*id_ptr, *commonPort_ptr,
-		thisElevatorHeartbeatCh, downedElevatorsCh, placedOrderCh,
-		assignOrderCh, completedOrderCh,
-		allElevatorsHeartbeatCh, takeOrderCh, redundantOrderCh,
-		completedHallOrderOtherElevCh, lastKnownOrdersCh, &wg)
-
-	go orderhandler.OrderHandler(*id_ptr,
-		placedHallOrderCh, redundantOrderCh, takeOrderCh,
-		completedHallOrdersThisElevCh, completedHallOrderOtherElevCh,
-		downedElevatorsCh, elevatorStatusCh, allElevatorsHeartbeatCh,
-		lastKnownOrdersCh,
-		placedOrderCh, assignOrderCh, addHallOrderCh, completedOrderCh,
-		deleteHallOrderCh, thisElevatorHeartbeatCh, updateLightsCh, &wg)
+	cabOrdersCh := eventLog.NewChannel("cabOrders", "fsm", "network") //make(chan [N_FLOORS]bool)
+
+	// Channels: Status API -> modules
+	injectButtonCh := eventLog.NewChannel("injectButton", "statusapi", "fsm") //make(chan elevio.ButtonEvent)
+	statusRequestFSMCh := nbc.New()                                           //make(chan chan fsm.Elevator)
+	statusRequestOrderHandlerCh := nbc.New()                                  //make(chan chan orderhandler.Snapshot)
+	statusRequestCommHandlerCh := nbc.New()                                   //make(chan chan commhandler.Snapshot)
+	orderCommandCh := eventLog.NewChannel("orderCommand", "statusapi", "fsm") //make(chan fsm.OrderCommand)
+
+	go commhandler.CommHandler(*id_ptr, *commonPort_ptr, redundancy, *phiThreshold_ptr,
+		thisElevatorHeartbeatCh.Out, downedElevatorsCh.In, placedOrderCh.Out,
+		assignOrderCh.Out, completedOrderCh.Out, rescueOrderCh.Out, cabOrdersCh.Out, statusRequestCommHandlerCh,
+		allElevatorsHeartbeatCh.In, takeOrderCh.In, redundantOrderCh.In, ignoredOrderCh.In,
+		completedHallOrderOtherElevCh.In, lastKnownOrdersCh.In, rejoinedElevatorCh.In,
+		suspectedElevatorsCh.In, backedUpCabOrdersCh.In, &wg)
+
+	switch *replication_ptr {
+	case "raft":
+		storage, err := raft.OpenStorage(*stateDir_ptr, *id_ptr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		go raft.Raft(*id_ptr, cluster, *commonPort_ptr, storage,
+			proposeEntryCh.Out,
+			committedEntryCh.In, raftStatusCh.In, &wg)
+		// order messages are not used, orders are committed through the raft log
+		go orderhandler.RaftOrderHandler(*id_ptr,
+			placedHallOrderCh.Out, completedHallOrdersThisElevCh.Out, downedElevatorsCh.Out,
+			elevatorStatusCh.Out, allElevatorsHeartbeatCh.Out, lastKnownOrdersCh.Out,
+			suspectedElevatorsCh.Out, committedEntryCh.Out, raftStatusCh.Out, statusRequestOrderHandlerCh,
+			addHallOrderCh.In, deleteHallOrderCh.In, proposeEntryCh.In, thisElevatorHeartbeatCh.In,
+			updateLightsCh.In, &wg)
+	case "crdt":
+		// no order messages are sent, so the commhandler has no orders for the orderhandler
+		go orderhandler.CRDTOrderHandler(*id_ptr, redundancy, *stateDir_ptr,
+			placedHallOrderCh.Out, completedHallOrdersThisElevCh.Out, downedElevatorsCh.Out,
+			elevatorStatusCh.Out, allElevatorsHeartbeatCh.Out, lastKnownOrdersCh.Out,
+			suspectedElevatorsCh.Out, statusRequestOrderHandlerCh,
+			addHallOrderCh.In, deleteHallOrderCh.In, thisElevatorHeartbeatCh.In, updateLightsCh.In, &wg)
+	default:
+		go orderhandler.OrderHandler(*id_ptr, redundancy, *assign_ptr == "leader", *stateDir_ptr, *serviceDeadline_ptr,
+			placedHallOrderCh.Out, redundantOrderCh.Out, ignoredOrderCh.Out, takeOrderCh.Out,
+			completedHallOrdersThisElevCh.Out, completedHallOrderOtherElevCh.Out,
+			downedElevatorsCh.Out, elevatorStatusCh.Out, allElevatorsHeartbeatCh.Out,
+			lastKnownOrdersCh.Out, rejoinedElevatorCh.Out, suspectedElevatorsCh.Out, statusRequestOrderHandlerCh,
+			placedOrderCh.In, assignOrderCh.In, addHallOrderCh.In, completedOrderCh.In,
+			rescueOrderCh.In, deleteHallOrderCh.In, thisElevatorHeartbeatCh.In, updateLightsCh.In, &wg)
+	}
 
 	go fsm.FSM(*elevServerAddr_ptr,
-		addHallOrderCh, deleteHallOrderCh, updateLightsCh,
-		placedHallOrderCh, completedHallOrdersThisElevCh, elevatorStatusCh,
+		addHallOrderCh.Out, deleteHallOrderCh.Out, updateLightsCh.Out,
+		injectButtonCh.Out, statusRequestFSMCh, orderCommandCh.Out, backedUpCabOrdersCh.Out,
+		placedHallOrderCh.In, completedHallOrdersThisElevCh.In, elevatorStatusCh.In, cabOrdersCh.In,
 		&wg)
 
+	if *httpPort_ptr != 0 {
+		go statusapi.Serve(fmt.Sprintf("%v:%d", *httpHost_ptr, *httpPort_ptr), *id_ptr,
+			statusRequestFSMCh, statusRequestOrderHandlerCh, statusRequestCommHandlerCh,
+			injectButtonCh.In, orderCommandCh.In)
+	}
+
+	if *testControl_ptr {
+		go testControl(os.Stdin)
+	}
+
 	for {
 		select {}
 	}
 }
+
+// Commands from the scenario runner for fault injection, and for changing log
+// levels at runtime
+//
+//	loss 0.25
+//	isolate on
+//	loglevel commhandler=debug,fsm=warn
+func testControl(r io.Reader) {
+	Log := logging.New("testctl")
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "loss" {
+			if p, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				conn.SetLossRate(p)
+				Log.Printf("packet loss %v\n", p)
+				continue
+			}
+		}
+		if len(fields) == 2 && fields[0] == "isolate" && (fields[1] == "on" || fields[1] == "off") {
+			conn.SetIsolated(fields[1] == "on")
+			Log.Printf("isolated %v\n", fields[1])
+			continue
+		}
+		if len(fields) == 2 && fields[0] == "loglevel" {
+			if err := logging.ParseLevels(fields[1]); err == nil {
+				Log.Printf("log levels %v\n", logging.Levels())
+				continue
+			}
+		}
+		Log.Warnf("unknown command %q\n", scanner.Text())
+	}
+}
@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counters and histograms exported in the Prometheus text format. Metrics are
+// declared as package variables in the module they belong to, and are
+// registered in a common registry served by Handler.
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var registryMtx sync.Mutex
+var registry = make(map[string]metric)
+
+func register(m metric) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, exists := registry[m.name()]; exists {
+		panic(fmt.Sprintf("metric %v registered twice", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// labelKey joins label values to a map key, values are checked against names
+func labelKey(names []string, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("expected %v label values, got %v", len(names), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%v=%q", names[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Counter struct {
+	metricName string
+	help       string
+	labelNames []string
+
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{metricName: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := labelKey(c.labelNames, labelValues)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.metricName, c.help, c.metricName)
+	keys := make(map[string]bool)
+	for key := range c.values {
+		keys[key] = true
+	}
+	if len(c.labelNames) == 0 {
+		keys[""] = true
+	}
+	for _, key := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%v%v %v\n", c.metricName, formatLabels(c.labelNames, key), c.values[key])
+	}
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+	labelNames []string
+
+	mtx    sync.Mutex
+	values map[string]*histogramValue
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{metricName: name, help: help, buckets: buckets, labelNames: labelNames,
+		values: make(map[string]*histogramValue)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.labelNames, labelValues)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	value, exists := h.values[key]
+	if !exists {
+		value = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			value.counts[i]++
+			break
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.metricName, h.help, h.metricName)
+	keys := make(map[string]bool)
+	for key := range h.values {
+		keys[key] = true
+	}
+	for _, key := range sortedKeys(keys) {
+		value := h.values[key]
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			cumulative += value.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName,
+				formatLabels(h.labelNames, key, "le", fmt.Sprint(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, formatLabels(h.labelNames, key, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.metricName, formatLabels(h.labelNames, key), value.sum)
+		fmt.Fprintf(w, "%v_count%v %v\n", h.metricName, formatLabels(h.labelNames, key), value.count)
+	}
+}
+
+// WriteText writes all registered metrics in the Prometheus text format
+func WriteText(w io.Writer) {
+	registryMtx.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = registry[name]
+	}
+	registryMtx.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteText(w)
+}
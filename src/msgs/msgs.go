@@ -3,28 +3,178 @@ package msgs
 import (
 	"../elevio"
 	"../fsm"
+	"fmt"
 )
 
 type Order struct {
-	ID 			int 				`json:"order_id"`
-	MasterID 	string 				`json:"master_id"`
+	ID       string `json:"order_id"` // unique for every placement, see orderhandler
+	MasterID string `json:"master_id"`
 	//assignedElevatorID String		`json:"assigned_elevator_id"`
-	Floor 		int               	`json:"floor"`
-	Type  		elevio.ButtonType 	`json:"button_type"`
+	Floor int               `json:"floor"`
+	Type  elevio.ButtonType `json:"button_type"`
 }
 
 type OrderMsg struct {
 	SenderID   string `json:"sender_id"`
 	ReceiverID string `json:"reciever_id"`
+	Seq        uint64 `json:"seq"`     // numbered per sender, retransmissions keep the number
+	AckSeq     uint64 `json:"ack_seq"` // number of the message an ack acknowledges
+	Clock      uint64 `json:"clock"`   // logical time when first sent, see commhandler/clock.go
 	Order      Order  `json:"order"`
 }
 
 type Heartbeat struct {
-	SenderID               string         `json:"sender_id"`
-	Status                 fsm.Elevator   `json:"elevator_status"`
-	AcceptedOrders         map[int]Order  `json:"accepted_orders"`
-	ChosenElevatorForOrder map[int]string `json:"chosen_elevator_for_orders"`
-	TakenOrders            map[int]Order  `json:"taken_orders"`
+	SenderID               string            `json:"sender_id"`
+	Status                 fsm.Elevator      `json:"elevator_status"`
+	AcceptedOrders         map[string]Order  `json:"accepted_orders"`
+	ChosenElevatorForOrder map[string]string `json:"chosen_elevator_for_orders"`
+	TakenOrders            map[string]Order  `json:"taken_orders"`
+	HallCalls              *HallCalls        `json:"hall_calls,omitempty"` // -replication=crdt only
+	Boot                   int64             `json:"boot"`                 // set by peers.Transmitter, see Beacon
+	Version                uint64            `json:"version"`              // set by peers.Transmitter, see Beacon
+	Clock                  uint64            `json:"clock"`                // logical time of the sender, see commhandler/clock.go
+}
+
+// Sent by peers.Transmitter between full heartbeats to show that the sender is
+// alive. Boot and Version identify the last heartbeat sent, a receiver that
+// has an older one sends a ResyncRequest.
+type Beacon struct {
+	SenderID string `json:"sender_id"`
+	Boot     int64  `json:"boot"`
+	Version  uint64 `json:"version"`
+}
+
+// Asks the target to send its full heartbeat now
+type ResyncRequest struct {
+	TargetID string `json:"target_id"`
+}
+
+// Changes to a heartbeat since the version Base, see peers/delta.go. Nil
+// fields and missing entries are unchanged, a nil entry is removed.
+type HeartbeatDelta struct {
+	SenderID               string                             `json:"sender_id"`
+	Boot                   int64                              `json:"boot"`
+	Base                   uint64                             `json:"base"`
+	Version                uint64                             `json:"version"`
+	Clock                  uint64                             `json:"clock"`
+	Floor                  *int                               `json:"floor,omitempty"`
+	Dir                    *elevio.MotorDirection             `json:"dir,omitempty"`
+	Orders                 *[fsm.N_FLOORS][fsm.N_BUTTONS]bool `json:"orders,omitempty"`
+	CompletedOrders        *[fsm.N_FLOORS][fsm.N_BUTTONS]bool `json:"completed_orders,omitempty"`
+	Lights                 *[fsm.N_FLOORS][fsm.N_BUTTONS]bool `json:"lights,omitempty"`
+	State                  *fsm.State                         `json:"state,omitempty"`
+	AcceptedOrders         map[string]*Order                  `json:"accepted_orders,omitempty"`
+	ChosenElevatorForOrder map[string]*string                 `json:"chosen_elevator_for_orders,omitempty"`
+	TakenOrders            map[string]*Order                  `json:"taken_orders,omitempty"`
+	HallCalls              *HallCalls                         `json:"hall_calls,omitempty"`
+}
+
+// Part of a full heartbeat too large for one datagram, see peers.Transmitter.
+// The receiver joins the Data of all Count parts of the same version.
+type HeartbeatChunk struct {
+	SenderID string `json:"sender_id"`
+	Boot     int64  `json:"boot"`
+	Version  uint64 `json:"version"`
+	Index    int    `json:"index"`
+	Count    int    `json:"count"`
+	Data     []byte `json:"data"`
+}
+
+// Sent by a receiver of a heartbeat or delta, deltas are only sent relative to
+// a version all peers have acknowledged
+type VersionAck struct {
+	SenderID string `json:"sender_id"`
+	TargetID string `json:"target_id"`
+	Boot     int64  `json:"boot"`
+	Version  uint64 `json:"version"`
+}
+
+// Replicated state of one hall button with -replication=crdt. The counter is
+// only ever increased and is odd while there is an order, so two states are
+// merged by taking the higher counter. SeenBy are the nodes that have seen
+// the current counter.
+type HallCall struct {
+	Counter uint64   `json:"counter"`
+	SeenBy  []string `json:"seen_by"`
+}
+
+type HallCalls [fsm.N_FLOORS][2]HallCall
+
+// An order event in the replicated log of -replication=raft, see raft/raft.go.
+// Term and Index are set by the leader that appends it.
+type RaftEntry struct {
+	Term       uint64 `json:"term"`
+	Index      uint64 `json:"index"`
+	Event      string `json:"event"` // noop, placed, assigned or completed
+	Order      Order  `json:"order"`
+	ElevatorID string `json:"elevator_id,omitempty"` // assigned to, or completed by
+}
+
+type RaftVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RaftVoteReply struct {
+	Term     uint64 `json:"term"`
+	SenderID string `json:"sender_id"`
+	TargetID string `json:"target_id"`
+	Granted  bool   `json:"granted"`
+}
+
+type RaftAppend struct {
+	Term         uint64      `json:"term"`
+	LeaderID     string      `json:"leader_id"`
+	TargetID     string      `json:"target_id"`
+	PrevLogIndex uint64      `json:"prev_log_index"`
+	PrevLogTerm  uint64      `json:"prev_log_term"`
+	Entries      []RaftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader_commit"`
+}
+
+// MatchIndex is the last entry known to match the leader, on failure the
+// leader continues from there
+type RaftAppendReply struct {
+	Term       uint64 `json:"term"`
+	SenderID   string `json:"sender_id"`
+	TargetID   string `json:"target_id"`
+	Success    bool   `json:"success"`
+	MatchIndex uint64 `json:"match_index"`
+}
+
+// Cab orders of OwnerID, sent by the owner whenever they change and kept by
+// every peer, see commhandler/cab.go. Seq is the owner's message number, a
+// backup with a higher one replaces the one kept. A peer answering a
+// CabRestoreRequest sends the backup it keeps to TargetID.
+type CabBackupMsg struct {
+	SenderID  string             `json:"sender_id"`
+	OwnerID   string             `json:"owner_id"`
+	TargetID  string             `json:"target_id,omitempty"`
+	Seq       uint64             `json:"seq"`
+	Clock     uint64             `json:"clock"`
+	CabOrders [fsm.N_FLOORS]bool `json:"cab_orders"`
+}
+
+type CabBackupAck struct {
+	SenderID   string `json:"sender_id"`
+	ReceiverID string `json:"reciever_id"`
+	AckSeq     uint64 `json:"ack_seq"`
+	Clock      uint64 `json:"clock"`
+}
+
+// Sent by a node that just started, for the cab orders its peers keep
+type CabRestoreRequest struct {
+	SenderID string `json:"sender_id"`
+	Clock    uint64 `json:"clock"`
+}
+
+// An entry proposed by a follower, forwarded to the leader
+type RaftProposal struct {
+	SenderID string    `json:"sender_id"`
+	TargetID string    `json:"target_id"`
+	Entry    RaftEntry `json:"entry"`
 }
 
 type PlacedOrderMsg OrderMsg
@@ -34,7 +184,7 @@ type TakeOrderAck OrderMsg
 type RedundantOrderMsg OrderMsg
 type CompleteOrderMsg OrderMsg
 type CompleteOrderAck OrderMsg
-type HeartbeatAck Heartbeat
+type RescueOrderMsg OrderMsg // to all elevators, not acknowledged, see orderhandler/escalation.go
 
 // sort.Interface for heartbeat slices
 type HeartbeatSlice []Heartbeat
@@ -72,3 +222,34 @@ func Equal(a, b Heartbeat) bool {
 	}
 	return true
 }
+
+// Policy for hall orders no other elevator has acknowledged, set with -redundancy
+type Redundancy int
+
+const (
+	RED_Strict    Redundancy = iota // ignored, as in specification 2.8
+	RED_Lenient                     // served after repeated presses, with the light off
+	RED_Persisted                   // served and lit if written to the state dir
+)
+
+func (r Redundancy) String() string {
+	switch r {
+	case RED_Strict:
+		return "strict"
+	case RED_Lenient:
+		return "lenient"
+	case RED_Persisted:
+		return "persisted"
+	default:
+		return "someredundancy"
+	}
+}
+
+func ParseRedundancy(s string) (Redundancy, error) {
+	for r := RED_Strict; r <= RED_Persisted; r++ {
+		if r.String() == s {
+			return r, nil
+		}
+	}
+	return RED_Strict, fmt.Errorf("unknown redundancy %q, expected strict, lenient or persisted", s)
+}
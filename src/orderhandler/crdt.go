@@ -0,0 +1,309 @@
+package orderhandler
+
+import (
+	"../elevio"
+	"../fsm"
+	"../go-nonblockingchan"
+	"../msgs"
+	"../statefile"
+	"sort"
+	"sync"
+)
+
+// Order replication without masters or acks (-replication=crdt). Every node
+// holds a msgs.HallCalls, sends it with its heartbeat and merges the ones it
+// receives, so all nodes converge to the same hall orders, also after a
+// partition. A press makes the counter of the button odd and a completion
+// makes it even. A call is confirmed when all alive nodes have seen it, then
+// every node computes the same assignment from the heartbeats and only the
+// chosen elevator serves it.
+//
+// A node that is alone follows -redundancy: strict ignores presses, lenient
+// serves them with the light off until another node has seen them, and
+// persisted writes the calls to the state dir and lights them.
+
+func isActive(call msgs.HallCall) bool {
+	return call.Counter%2 == 1
+}
+
+func hasSeen(call msgs.HallCall, id string) bool {
+	for _, seenID := range call.SeenBy {
+		if seenID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// advance starts a new order or completes the current one
+func advance(call *msgs.HallCall, thisID string) {
+	call.Counter++
+	call.SeenBy = []string{thisID}
+}
+
+// merge takes the higher counter, or the union of seen by for equal counters,
+// and marks the result as seen by this node. Reports if local changed.
+func merge(local *msgs.HallCall, remote msgs.HallCall, thisID string) bool {
+	changed := false
+	switch {
+	case remote.Counter > local.Counter:
+		local.Counter = remote.Counter
+		local.SeenBy = append([]string(nil), remote.SeenBy...)
+		changed = true
+	case remote.Counter == local.Counter:
+		for _, id := range remote.SeenBy {
+			if !hasSeen(*local, id) {
+				local.SeenBy = append(local.SeenBy, id)
+				changed = true
+			}
+		}
+	}
+	if !hasSeen(*local, thisID) {
+		local.SeenBy = append(local.SeenBy, thisID)
+		changed = true
+	}
+	sort.Strings(local.SeenBy)
+	return changed
+}
+
+// the seen by slices are appended to by merge
+func copyHallCalls(hallCalls msgs.HallCalls) msgs.HallCalls {
+	hallCallsCopy := hallCalls
+	for floor := range hallCallsCopy {
+		for button := range hallCallsCopy[floor] {
+			hallCallsCopy[floor][button].SeenBy = append([]string(nil), hallCalls[floor][button].SeenBy...)
+		}
+	}
+	return hallCallsCopy
+}
+
+func isConfirmed(call msgs.HallCall, elevators map[string]msgs.Heartbeat) bool {
+	if !isActive(call) {
+		return false
+	}
+	for id := range elevators {
+		if !hasSeen(call, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// chooseElevator is deterministic given the same heartbeats. An elevator that
+// already has the order keeps it, otherwise the one with the lowest estimated
+// completion time is chosen, not counting suspected elevators. Ties go to the
+// lowest ID. Suspicion is local, so nodes may disagree until it is resolved.
+func chooseElevator(floor int, button elevio.ButtonType, elevators map[string]msgs.Heartbeat,
+	suspected map[string]bool) string {
+	ids := make([]string, 0, len(elevators))
+	for id := range elevators {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if elevators[id].Status.Orders[floor][button] {
+			return id
+		}
+	}
+	bestID := ""
+	bestTime := 0.0
+	for _, id := range ids {
+		if suspected[id] {
+			continue
+		}
+		t := fsm.EstimatedCompletionTime(elevators[id].Status, fsm.OrderEvent{Floor: floor, Button: button})
+		if bestID == "" || t < bestTime {
+			bestID, bestTime = id, t
+		}
+	}
+	return bestID
+}
+
+func CRDTOrderHandler(thisID string, redundancy msgs.Redundancy, stateDir string,
+	/* Read channels */
+	placedHallOrder_fsmCh *nbc.NonBlockingChan,
+	completedHallOrdersThisElev_fsmCh *nbc.NonBlockingChan,
+	downedElevators_commhandlerCh *nbc.NonBlockingChan,
+	elevatorStatus_fsmCh *nbc.NonBlockingChan,
+	allElevatorsHeartbeat_commhandlerCh *nbc.NonBlockingChan,
+	lastKnownOrders_commhandlerCh *nbc.NonBlockingChan,
+	suspectedElevators_commhandlerCh *nbc.NonBlockingChan,
+	statusRequest_apiCh *nbc.NonBlockingChan,
+	/* Write channels */
+	addOrder_fsmCh *nbc.NonBlockingChan,
+	deleteHallOrder_fsmCh *nbc.NonBlockingChan,
+	thisElevatorHeartbeat_commhandlerCh *nbc.NonBlockingChan,
+	updateLights_fsmCh *nbc.NonBlockingChan,
+	/* Sync */
+	wg *sync.WaitGroup) {
+
+	var hallCalls msgs.HallCalls
+	var servingCalls [fsm.N_FLOORS][2]bool       // calls given to the fsm of this elevator
+	elevators := make(map[string]msgs.Heartbeat) // alive elevators, this one included
+	suspected := make(map[string]bool)           // alive elevators that are not given new calls
+	thisHeartbeat := msgs.Heartbeat{SenderID: thisID}
+	warnedMasterMode := make(map[string]bool)
+	persistedFile := statefile.New(stateDir, "hallcalls", thisID)
+
+	// Wait until all modules are initialized
+	wg.Done()
+	Log.Println("initialized (crdt replication)")
+	wg.Wait()
+	Log.Println("starting")
+
+	if redundancy == msgs.RED_Persisted {
+		if err := persistedFile.Load(&hallCalls); err != nil {
+			Log.Errorf("could not restore persisted hall calls: %v\n", err)
+		}
+	}
+	persist := func() {
+		if redundancy == msgs.RED_Persisted {
+			if err := persistedFile.Save(hallCalls); err != nil {
+				Log.Errorf("could not persist hall calls: %v\n", err)
+			}
+		}
+	}
+
+	// assign confirmed calls, drop calls completed or taken elsewhere and set
+	// the lights of confirmed calls
+	update := func() {
+		elevators[thisID] = thisHeartbeat
+		var updateLights [fsm.N_FLOORS][fsm.N_BUTTONS]bool
+		for floor := 0; floor < fsm.N_FLOORS; floor++ {
+			for button := elevio.BT_HallUp; button <= elevio.BT_HallDown; button++ {
+				call := hallCalls[floor][button]
+				serve := false
+				if isConfirmed(call, elevators) {
+					updateLights[floor][button] = len(call.SeenBy) > 1 || redundancy == msgs.RED_Persisted
+					serve = chooseElevator(floor, button, elevators, suspected) == thisID
+				}
+				if serve && !servingCalls[floor][button] {
+					Log.Printf("serving hall call %v floor %v (counter %v)\n", button, floor, call.Counter)
+					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: button}
+				} else if !serve && servingCalls[floor][button] {
+					Log.Printf("dropping hall call %v floor %v (counter %v)\n", button, floor, call.Counter)
+					deleteHallOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: button}
+				}
+				servingCalls[floor][button] = serve
+			}
+		}
+		updateLights_fsmCh.Send <- updateLights
+	}
+
+	sendHeartbeat := func() {
+		hallCallsCopy := copyHallCalls(hallCalls)
+		thisHeartbeat.HallCalls = &hallCallsCopy
+		thisElevatorHeartbeat_commhandlerCh.Send <- thisHeartbeat
+	}
+
+	for {
+		select {
+
+		case msg, _ := <-placedHallOrder_fsmCh.Recv:
+			buttonEvent := msg.(fsm.OrderEvent)
+
+			call := &hallCalls[buttonEvent.Floor][buttonEvent.Button]
+			if isActive(*call) {
+				Log.Printf("merged with outstanding hall call (counter %v)\n", call.Counter)
+				break
+			}
+			if redundancy == msgs.RED_Strict && len(elevators) < 2 {
+				Log.Warnf("hall call %v floor %v ignored, no other node can see it\n", buttonEvent.Button, buttonEvent.Floor)
+				break
+			}
+			advance(call, thisID)
+			Log.Printf("placed hall call %v floor %v (counter %v)\n", buttonEvent.Button, buttonEvent.Floor, call.Counter)
+			persist()
+			sendHeartbeat()
+			update()
+
+		case msg, _ := <-completedHallOrdersThisElev_fsmCh.Recv:
+			completedOrders := msg.([]fsm.OrderEvent)
+
+			for _, completedOrder := range completedOrders {
+				call := &hallCalls[completedOrder.Floor][completedOrder.Button]
+				servingCalls[completedOrder.Floor][completedOrder.Button] = false
+				if isActive(*call) {
+					advance(call, thisID)
+					Log.Printf("completed hall call %v floor %v (counter %v)\n",
+						completedOrder.Button, completedOrder.Floor, call.Counter)
+				}
+			}
+			persist()
+			sendHeartbeat()
+			update()
+
+		case msg, _ := <-downedElevators_commhandlerCh.Recv:
+			for _, lastHeartbeat := range msg.([]msgs.Heartbeat) {
+				Log.Printf("down: %v, its calls are reassigned\n", lastHeartbeat.SenderID)
+				delete(elevators, lastHeartbeat.SenderID)
+			}
+			update()
+
+		case msg, _ := <-lastKnownOrders_commhandlerCh.Recv:
+			lastOrders := msg.([fsm.N_FLOORS][fsm.N_BUTTONS]bool)
+
+			for floor := 0; floor < fsm.N_FLOORS; floor++ {
+				if lastOrders[floor][elevio.BT_Cab] {
+					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: elevio.BT_Cab, TurnLightOn: true}
+				}
+			}
+
+		case msg, _ := <-suspectedElevators_commhandlerCh.Recv:
+			suspected = make(map[string]bool)
+			for _, id := range msg.([]string) {
+				if id != thisID {
+					suspected[id] = true
+				}
+			}
+			update()
+
+		case msg, _ := <-elevatorStatus_fsmCh.Recv:
+			thisHeartbeat.Status = msg.(fsm.Elevator)
+			sendHeartbeat()
+
+		case msg, _ := <-statusRequest_apiCh.Recv:
+			replyCh := msg.(chan Snapshot)
+
+			hallCallsCopy := copyHallCalls(hallCalls)
+			snapshot := Snapshot{Elevators: make(map[string]msgs.Heartbeat), HallCalls: &hallCallsCopy}
+			for k, v := range elevators {
+				snapshot.Elevators[k] = v
+			}
+			replyCh <- snapshot
+
+		case msg, _ := <-allElevatorsHeartbeat_commhandlerCh.Recv:
+			allElevatorsHeartbeat := msg.([]msgs.Heartbeat)
+
+			changed := false
+			elevators = make(map[string]msgs.Heartbeat)
+			for _, heartbeat := range allElevatorsHeartbeat {
+				if heartbeat.SenderID == thisID {
+					continue
+				}
+				elevators[heartbeat.SenderID] = heartbeat
+				if heartbeat.HallCalls == nil {
+					if !warnedMasterMode[heartbeat.SenderID] {
+						Log.Warnf("heartbeat from %v without hall calls, is it running -replication=master?\n",
+							heartbeat.SenderID)
+						warnedMasterMode[heartbeat.SenderID] = true
+					}
+					continue
+				}
+				for floor := range hallCalls {
+					for button := range hallCalls[floor] {
+						if merge(&hallCalls[floor][button], heartbeat.HallCalls[floor][button], thisID) {
+							changed = true
+						}
+					}
+				}
+			}
+			if changed {
+				persist()
+				sendHeartbeat()
+			}
+			update()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package orderhandler
+
+import (
+	"../msgs"
+	"reflect"
+	"testing"
+)
+
+// permutations returns every order of the indexes 0..n-1
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var result [][]int
+	for _, rest := range permutations(n - 1) {
+		for i := 0; i <= len(rest); i++ {
+			perm := append(append(append([]int(nil), rest[:i]...), n-1), rest[i:]...)
+			result = append(result, perm)
+		}
+	}
+	return result
+}
+
+func TestMergeOrderIndependent(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  msgs.HallCall
+		remote []msgs.HallCall
+		want   msgs.HallCall
+	}{
+		{"same counter, seen by grows",
+			msgs.HallCall{Counter: 1, SeenBy: []string{"A"}},
+			[]msgs.HallCall{{Counter: 1, SeenBy: []string{"B"}}, {Counter: 1, SeenBy: []string{"C", "B"}}},
+			msgs.HallCall{Counter: 1, SeenBy: []string{"A", "B", "C"}}},
+		{"higher counter wins",
+			msgs.HallCall{Counter: 1, SeenBy: []string{"A"}},
+			[]msgs.HallCall{{Counter: 3, SeenBy: []string{"B"}}, {Counter: 2, SeenBy: []string{"C"}},
+				{Counter: 3, SeenBy: []string{"D"}}, {Counter: 1, SeenBy: []string{"E"}}},
+			msgs.HallCall{Counter: 3, SeenBy: []string{"A", "B", "D"}}},
+		{"completion overtakes the press",
+			msgs.HallCall{},
+			[]msgs.HallCall{{Counter: 1, SeenBy: []string{"B"}}, {Counter: 2, SeenBy: []string{"C"}},
+				{Counter: 1, SeenBy: []string{"B", "C"}}},
+			msgs.HallCall{Counter: 2, SeenBy: []string{"A", "C"}}},
+		{"local is newest",
+			msgs.HallCall{Counter: 4, SeenBy: []string{"A"}},
+			[]msgs.HallCall{{Counter: 3, SeenBy: []string{"B", "C"}}, {}, {Counter: 4, SeenBy: []string{"C"}}},
+			msgs.HallCall{Counter: 4, SeenBy: []string{"A", "C"}}},
+		{"nothing anywhere",
+			msgs.HallCall{},
+			[]msgs.HallCall{{}, {}},
+			msgs.HallCall{Counter: 0, SeenBy: []string{"A"}}},
+	}
+
+	for _, test := range tests {
+		for _, perm := range permutations(len(test.remote)) {
+			local := msgs.HallCall{Counter: test.local.Counter, SeenBy: append([]string(nil), test.local.SeenBy...)}
+			for _, i := range perm {
+				merge(&local, test.remote[i], "A")
+			}
+			if !reflect.DeepEqual(local, test.want) {
+				t.Errorf("%v: merged in order %v: %+v, want %+v", test.name, perm, local, test.want)
+			}
+
+			// merging again changes nothing
+			for _, i := range perm {
+				if merge(&local, test.remote[i], "A") {
+					t.Errorf("%v: merged in order %v: changed by merging %+v again", test.name, perm, test.remote[i])
+				}
+			}
+		}
+	}
+}
+
+// every node ends with the same hall calls, whatever order the heartbeats of
+// the others arrive in
+func TestMergeConverges(t *testing.T) {
+	ids := []string{"A", "B", "C"}
+	initial := make([]msgs.HallCalls, len(ids))
+	for i, id := range ids {
+		for floor := range initial[i] {
+			for button := range initial[i][floor] {
+				if counter := uint64((floor + button + i) % 3); counter > 0 {
+					initial[i][floor][button] = msgs.HallCall{Counter: counter, SeenBy: []string{id}}
+				}
+			}
+		}
+	}
+
+	var want *msgs.HallCalls
+	for _, perm := range permutations(len(ids)) {
+		nodes := make([]msgs.HallCalls, len(ids))
+		for i := range nodes {
+			nodes[i] = copyHallCalls(initial[i])
+		}
+		// heartbeats are sent until nothing changes, node perm[0] first
+		for changed := true; changed; {
+			changed = false
+			for _, receiver := range perm {
+				for sender := range nodes {
+					if sender == receiver {
+						continue
+					}
+					heartbeat := copyHallCalls(nodes[sender])
+					for floor := range heartbeat {
+						for button := range heartbeat[floor] {
+							if merge(&nodes[receiver][floor][button], heartbeat[floor][button], ids[receiver]) {
+								changed = true
+							}
+						}
+					}
+				}
+			}
+		}
+		for i := range nodes {
+			if want == nil {
+				want = &nodes[i]
+			}
+			if !reflect.DeepEqual(nodes[i], *want) {
+				t.Errorf("node %v in order %v: %+v, want %+v", ids[i], perm, nodes[i], *want)
+			}
+		}
+	}
+	for floor := range want {
+		for button := range want[floor] {
+			if call := want[floor][button]; call.Counter != 2 || !reflect.DeepEqual(call.SeenBy, ids) {
+				t.Errorf("floor %v button %v: %+v, want counter 2 seen by all", floor, button, call)
+			}
+		}
+	}
+}
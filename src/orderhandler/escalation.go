@@ -0,0 +1,84 @@
+package orderhandler
+
+import (
+	"../metrics"
+	"../msgs"
+	"fmt"
+	"time"
+)
+
+var escalations = metrics.NewCounter("elevator_order_escalations_total",
+	"Accepted orders not served within the service deadline (-deadline), by escalation step", "step")
+
+// An accepted order that is not completed within the service deadline is
+// escalated by its master, one step every deadline:
+//   - reassigned: a new take to the best elevator other than the chosen one,
+//     which keeps it until the new one acknowledges, see rebalance.go
+//   - rescued: a msgs.RescueOrderMsg asks every elevator to serve it, this
+//     one included. It is not acknowledged, but sent again every
+//     escalationCheckInterval until the order is completed.
+//   - alarmed: logged as an error, the rescue goes on
+// The deadline is counted from when this node became the master of the
+// order, by acceptance or by taking over the orders of a lost elevator.
+
+const escalationCheckInterval = 1 * time.Second
+
+type EscalationStep int
+
+const (
+	ESC_None       EscalationStep = iota // within the deadline
+	ESC_Reassigned                       // given to the next best elevator
+	ESC_Rescued                          // sent to all elevators
+	ESC_Alarmed                          // logged as an alarm
+)
+
+func (s EscalationStep) String() string {
+	switch s {
+	case ESC_None:
+		return "none"
+	case ESC_Reassigned:
+		return "reassigned"
+	case ESC_Rescued:
+		return "rescued"
+	case ESC_Alarmed:
+		return "alarmed"
+	default:
+		return "somestep"
+	}
+}
+
+func (s EscalationStep) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *EscalationStep) UnmarshalText(text []byte) error {
+	for step := ESC_None; step <= ESC_Alarmed; step++ {
+		if step.String() == string(text) {
+			*s = step
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown escalation step %q", text)
+}
+
+// Escalation of an accepted order, shown in the status api
+type Escalation struct {
+	Step  EscalationStep `json:"step"`
+	Since time.Time      `json:"since"` // accepted, or escalated to the step
+}
+
+// nextBestElevator is the best unsuspected elevator other than the chosen
+// one, "" if there is none
+func nextBestElevator(thisID string, chosenID string, order msgs.Order,
+	elevators map[string]msgs.Heartbeat, suspected map[string]bool) string {
+	others := make(map[string]msgs.Heartbeat)
+	for id, heartbeat := range elevators {
+		if id != chosenID && !suspected[id] {
+			others[id] = heartbeat
+		}
+	}
+	if len(others) == 0 {
+		return ""
+	}
+	return bestElevator(thisID, order, others, suspected)
+}
@@ -0,0 +1,73 @@
+package orderhandler
+
+import (
+	"../fsm"
+	"../metrics"
+	"../msgs"
+	"sort"
+)
+
+var leaderChanges = metrics.NewCounter("elevator_leader_changes_total",
+	"Times the leader seen by this node changed, -assign=leader only")
+
+// With -assign=leader the master of an order (the elevator it was placed at)
+// accepts it as before, but only the leader chooses the elevator to serve it.
+// The leader is the alive, unsuspected elevator with the lowest ID, so every
+// node elects the same one from its heartbeat view (bully with lowest ID).
+// Accepted orders without a chosen elevator are pending, the leader finds
+// them in the heartbeats and sends the take, and the master records the
+// choice when it sees the take. When the leader is lost the next lowest ID
+// takes over and assigns what is still pending, and the orders of any lost
+// elevator are reassigned by the leader only.
+
+func electLeader(thisID string, elevators map[string]msgs.Heartbeat, suspected map[string]bool) string {
+	leader := thisID
+	for id := range elevators {
+		if !suspected[id] && id < leader {
+			leader = id
+		}
+	}
+	return leader
+}
+
+// bestElevator has the lowest estimated completion time of the unsuspected
+// elevators, ties go to this elevator and then to the lowest ID
+func bestElevator(thisID string, order msgs.Order, elevators map[string]msgs.Heartbeat, suspected map[string]bool) string {
+	ids := make([]string, 0, len(elevators))
+	for id := range elevators {
+		if !suspected[id] || id == thisID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	bestID := ""
+	bestTime := 0.0
+	for _, id := range ids {
+		t := fsm.EstimatedCompletionTime(elevators[id].Status, fsm.OrderEvent{Floor: order.Floor, Button: order.Type})
+		if bestID == "" || t < bestTime || (t == bestTime && id == thisID) {
+			bestID, bestTime = id, t
+		}
+	}
+	if bestID == "" {
+		bestID = thisID
+	}
+	return bestID
+}
+
+// pendingOrders are accepted orders of other elevators that no elevator has
+// been chosen for
+func pendingOrders(thisID string, elevators map[string]msgs.Heartbeat) map[string]msgs.Order {
+	pending := make(map[string]msgs.Order)
+	for id, heartbeat := range elevators {
+		if id == thisID {
+			continue
+		}
+		for orderID, order := range heartbeat.AcceptedOrders {
+			if heartbeat.ChosenElevatorForOrder[orderID] == "" {
+				pending[orderID] = order
+			}
+		}
+	}
+	return pending
+}
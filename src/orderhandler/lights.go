@@ -0,0 +1,190 @@
+package orderhandler
+
+import (
+	"../elevio"
+	"../fsm"
+	"../metrics"
+	"../msgs"
+	"fmt"
+	"time"
+)
+
+var hallLightChanges = metrics.NewCounter("elevator_hall_light_changes_total",
+	"Hall lights turned on or off by their acceptance state, -replication=master only", "change")
+
+// With -replication=master the hall lights follow an acceptance state per
+// hall call, which every node derives from the heartbeats of all elevators,
+// so all panels agree within a heartbeat:
+//   - off: no accepted order for the call
+//   - on: a master has accepted an order for the call, and the elevator it
+//     chose has taken it. Turned on at once
+//   - lingering: still accepted, but not taken since. An order is untaken
+//     for a moment when it is moved to another elevator, and the heartbeats
+//     of the master and the new elevator may arrive in any order, so the
+//     light stays on for lightOffDelay before it is turned off
+// A call no master has accepted any more is turned off at once. So is a
+// completed call, by the fsm of the elevator that served it and by the
+// others when they receive the completion, which may come before the
+// heartbeats. The orders of the call are remembered as completed for
+// completedMemory, so a heartbeat that still has them does not turn the
+// light on again, while a new press is a new order and is lit as soon as it
+// is taken.
+
+const lightCheckInterval = 100 * time.Millisecond
+const lightOffDelay = 500 * time.Millisecond
+const completedMemory = 30 * time.Second
+
+type LightState int
+
+const (
+	LIGHT_Off       LightState = iota // no accepted order
+	LIGHT_On                          // accepted and taken
+	LIGHT_Lingering                   // on, but not confirmed for a moment
+)
+
+func (s LightState) String() string {
+	switch s {
+	case LIGHT_Off:
+		return "off"
+	case LIGHT_On:
+		return "on"
+	case LIGHT_Lingering:
+		return "lingering"
+	default:
+		return "somestate"
+	}
+}
+
+func (s LightState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *LightState) UnmarshalText(text []byte) error {
+	for state := LIGHT_Off; state <= LIGHT_Lingering; state++ {
+		if state.String() == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown light state %q", text)
+}
+
+// Acceptance state of one hall call, shown in the status api
+type HallLight struct {
+	State     LightState `json:"state"`
+	Since     time.Time  `json:"since"`
+	Confirmed time.Time  `json:"confirmed"` // last seen accepted and taken
+}
+
+type HallLights [fsm.N_FLOORS][2]HallLight
+
+type hallLightTracker struct {
+	calls     HallLights
+	orderIDs  [fsm.N_FLOORS][2]map[string]bool // accepted orders of each call in the last heartbeats
+	completed map[string]time.Time             // orders completed within completedMemory
+}
+
+func newHallLightTracker() *hallLightTracker {
+	return &hallLightTracker{completed: make(map[string]time.Time)}
+}
+
+// update moves every call to its new state from the heartbeats of all alive
+// elevators, and returns the lights. Orders accepted alone and not lit are
+// left out while this elevator is alone.
+func (t *hallLightTracker) update(heartbeats []msgs.Heartbeat, unlit map[string]bool, now time.Time) [fsm.N_FLOORS][fsm.N_BUTTONS]bool {
+	for orderID, completedAt := range t.completed {
+		if now.Sub(completedAt) > completedMemory {
+			delete(t.completed, orderID)
+		}
+	}
+
+	var accepted, confirmed [fsm.N_FLOORS][2]bool
+	t.orderIDs = [fsm.N_FLOORS][2]map[string]bool{}
+	for _, heartbeat := range heartbeats {
+		for orderID, order := range heartbeat.AcceptedOrders {
+			if _, completed := t.completed[orderID]; completed || order.Type == elevio.BT_Cab {
+				continue
+			}
+			if t.orderIDs[order.Floor][order.Type] == nil {
+				t.orderIDs[order.Floor][order.Type] = make(map[string]bool)
+			}
+			t.orderIDs[order.Floor][order.Type][orderID] = true
+			if unlit[orderID] && len(heartbeats) < 2 {
+				continue
+			}
+			accepted[order.Floor][order.Type] = true
+			if isTaken(orderID, order, heartbeat.ChosenElevatorForOrder[orderID], heartbeats) {
+				confirmed[order.Floor][order.Type] = true
+			}
+		}
+	}
+
+	var lights [fsm.N_FLOORS][fsm.N_BUTTONS]bool
+	for floor := 0; floor < fsm.N_FLOORS; floor++ {
+		for button := elevio.BT_HallUp; button <= elevio.BT_HallDown; button++ {
+			call := &t.calls[floor][button]
+			switch {
+			case confirmed[floor][button]:
+				if call.State != LIGHT_On {
+					if call.State == LIGHT_Off {
+						hallLightChanges.Inc("on")
+					}
+					call.State = LIGHT_On
+					call.Since = now
+				}
+				call.Confirmed = now
+			case call.State == LIGHT_Off:
+			case !accepted[floor][button]:
+				hallLightChanges.Inc("off")
+				call.State = LIGHT_Off
+				call.Since = now
+			case call.State == LIGHT_On:
+				call.State = LIGHT_Lingering
+				call.Since = now
+			case now.Sub(call.Confirmed) >= lightOffDelay:
+				Log.Printf("hall light %v floor %v off, not taken for %v\n", button, floor, lightOffDelay)
+				hallLightChanges.Inc("off")
+				call.State = LIGHT_Off
+				call.Since = now
+			}
+			if call.Since == now {
+				Log.Debugf("hall light %v floor %v %v\n", button, floor, call.State)
+			}
+			lights[floor][button] = call.State != LIGHT_Off
+		}
+	}
+	return lights
+}
+
+// complete turns the call off, and remembers its orders as completed
+func (t *hallLightTracker) complete(floor int, button elevio.ButtonType, now time.Time, orderIDs ...string) {
+	if button == elevio.BT_Cab {
+		return
+	}
+	for orderID := range t.orderIDs[floor][button] {
+		t.completed[orderID] = now
+	}
+	for _, orderID := range orderIDs {
+		t.completed[orderID] = now
+	}
+	t.orderIDs[floor][button] = nil
+	call := &t.calls[floor][button]
+	if call.State != LIGHT_Off {
+		Log.Debugf("hall light %v floor %v completed\n", button, floor)
+		hallLightChanges.Inc("completed")
+		call.State = LIGHT_Off
+		call.Since = now
+	}
+}
+
+// isTaken reports if the chosen elevator has taken the order and has it in
+// its fsm
+func isTaken(orderID string, order msgs.Order, chosenID string, heartbeats []msgs.Heartbeat) bool {
+	for _, heartbeat := range heartbeats {
+		if heartbeat.SenderID == chosenID {
+			_, taken := heartbeat.TakenOrders[orderID]
+			return taken && heartbeat.Status.Orders[order.Floor][order.Type]
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package orderhandler
+
+import (
+	"../elevio"
+	"../msgs"
+	"testing"
+	"time"
+)
+
+var testCall = msgs.Order{ID: "A-1", MasterID: "A", Floor: 2, Type: elevio.BT_HallUp}
+
+// accepting is the heartbeat of master A with the orders accepted and
+// chosen to be served by chosenID
+func accepting(chosenID string, orders ...msgs.Order) msgs.Heartbeat {
+	heartbeat := msgs.Heartbeat{SenderID: "A",
+		AcceptedOrders:         make(map[string]msgs.Order),
+		ChosenElevatorForOrder: make(map[string]string)}
+	for _, order := range orders {
+		heartbeat.AcceptedOrders[order.ID] = order
+		heartbeat.ChosenElevatorForOrder[order.ID] = chosenID
+	}
+	return heartbeat
+}
+
+// taking is the heartbeat of elevator senderID with the orders taken and in
+// its fsm
+func taking(senderID string, orders ...msgs.Order) msgs.Heartbeat {
+	heartbeat := msgs.Heartbeat{SenderID: senderID, TakenOrders: make(map[string]msgs.Order)}
+	for _, order := range orders {
+		heartbeat.TakenOrders[order.ID] = order
+		heartbeat.Status.Orders[order.Floor][order.Type] = true
+	}
+	return heartbeat
+}
+
+func TestHallLightTracker(t *testing.T) {
+	newCall := msgs.Order{ID: "A-2", MasterID: "A", Floor: testCall.Floor, Type: testCall.Type}
+
+	type step struct {
+		at         time.Duration
+		heartbeats []msgs.Heartbeat // the last heartbeat of every alive elevator
+		complete   []string         // completes the call with these orders instead of an update
+		want       LightState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"accepted and taken is on at once", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B")}, nil, LIGHT_Off},
+			{100 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+		}},
+		{"dropped heartbeats of the chosen elevator linger", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+			{100 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall)}, nil, LIGHT_Lingering},
+			{400 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall)}, nil, LIGHT_Lingering},
+			{450 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+		}},
+		{"master heartbeat before the new elevator's lingers", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall), taking("C")}, nil, LIGHT_On},
+			{100 * time.Millisecond, []msgs.Heartbeat{accepting("C", testCall), taking("B", testCall), taking("C")}, nil, LIGHT_Lingering},
+			{200 * time.Millisecond, []msgs.Heartbeat{accepting("C", testCall), taking("B"), taking("C")}, nil, LIGHT_Lingering},
+			{300 * time.Millisecond, []msgs.Heartbeat{accepting("C", testCall), taking("B"), taking("C", testCall)}, nil, LIGHT_On},
+		}},
+		{"untaken turns off at lightOffDelay", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+			{100 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B")}, nil, LIGHT_Lingering},
+			{lightOffDelay - time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B")}, nil, LIGHT_Lingering},
+			{lightOffDelay, []msgs.Heartbeat{accepting("B", testCall), taking("B")}, nil, LIGHT_Off},
+		}},
+		{"no longer accepted turns off at once", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+			{100 * time.Millisecond, []msgs.Heartbeat{accepting("B"), taking("B", testCall)}, nil, LIGHT_Off},
+		}},
+		{"late accept after the completion stays off", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+			{100 * time.Millisecond, nil, []string{testCall.ID}, LIGHT_Off},
+			{200 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_Off},
+		}},
+		{"completion before the accept stays off", []step{
+			{0, nil, []string{testCall.ID}, LIGHT_Off},
+			{100 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_Off},
+		}},
+		{"new press after the completion is lit", []step{
+			{0, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+			{100 * time.Millisecond, nil, []string{testCall.ID}, LIGHT_Off},
+			{200 * time.Millisecond, []msgs.Heartbeat{accepting("B", testCall, newCall), taking("B", testCall, newCall)}, nil, LIGHT_On},
+		}},
+		{"completed orders are forgotten after completedMemory", []step{
+			{0, nil, []string{testCall.ID}, LIGHT_Off},
+			{completedMemory, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_Off},
+			{completedMemory + time.Millisecond, []msgs.Heartbeat{accepting("B", testCall), taking("B", testCall)}, nil, LIGHT_On},
+		}},
+	}
+
+	start := time.Unix(1000, 0)
+	for _, test := range tests {
+		tracker := newHallLightTracker()
+		for i, step := range test.steps {
+			now := start.Add(step.at)
+			var lit bool
+			if step.complete != nil {
+				tracker.complete(testCall.Floor, testCall.Type, now, step.complete...)
+				lit = false
+			} else {
+				lit = tracker.update(step.heartbeats, nil, now)[testCall.Floor][testCall.Type]
+			}
+			got := tracker.calls[testCall.Floor][testCall.Type].State
+			if got != step.want {
+				t.Errorf("%v: step %v: state %v, want %v", test.name, i, got, step.want)
+			}
+			if lit != (step.want != LIGHT_Off) {
+				t.Errorf("%v: step %v: light %v in state %v", test.name, i, lit, got)
+			}
+		}
+	}
+}
+
+func TestHallLightTrackerAloneUnlit(t *testing.T) {
+	tracker := newHallLightTracker()
+	unlit := map[string]bool{testCall.ID: true}
+	now := time.Unix(1000, 0)
+
+	heartbeat := accepting("A", testCall)
+	heartbeat.TakenOrders = taking("A", testCall).TakenOrders
+	heartbeat.Status = taking("A", testCall).Status
+
+	if tracker.update([]msgs.Heartbeat{heartbeat}, unlit, now)[testCall.Floor][testCall.Type] {
+		t.Errorf("unlit order accepted alone is lit")
+	}
+	if !tracker.update([]msgs.Heartbeat{heartbeat, taking("B")}, unlit, now.Add(time.Second))[testCall.Floor][testCall.Type] {
+		t.Errorf("unlit order is not lit when no longer alone")
+	}
+}
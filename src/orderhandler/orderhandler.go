@@ -4,22 +4,90 @@ import (
 	"../elevio"
 	"../fsm"
 	"../go-nonblockingchan"
+	"../logging"
+	"../metrics"
 	"../msgs"
-	"log"
-	"os"
+	"../raft"
+	"../statefile"
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 )
 
-var Info *log.Logger
+var Log = logging.New("orderhandler")
+
+var hallOrderAcceptTime = metrics.NewHistogram("elevator_hall_order_accept_seconds",
+	"Time from a hall order is placed at this elevator until it is accepted (light on)",
+	[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+var hallOrderServiceTime = metrics.NewHistogram("elevator_hall_order_service_seconds",
+	"Time from a hall order is placed at this elevator until any elevator opens its door at the floor",
+	[]float64{1, 2.5, 5, 10, 20, 30, 60, 120})
+
+// Snapshot of the orderhandler state for the status api
+type Snapshot struct {
+	PlacedOrders           map[string]msgs.Order     `json:"placed_orders"`
+	AcceptedOrders         map[string]msgs.Order     `json:"accepted_orders"`
+	ChosenElevatorForOrder map[string]string         `json:"chosen_elevator_for_orders"`
+	AssignedOrders         map[string]msgs.Order     `json:"assigned_orders"`
+	Elevators              map[string]msgs.Heartbeat `json:"elevators"`
+	HallCalls              *msgs.HallCalls           `json:"hall_calls,omitempty"` // -replication=crdt only
+	Leader                 string                    `json:"leader,omitempty"`     // -assign=leader or -replication=raft
+	Raft                   *raft.Status              `json:"raft,omitempty"`       // -replication=raft only
+	Escalations            map[string]Escalation     `json:"escalations,omitempty"`
+	HallLights             *HallLights               `json:"hall_lights,omitempty"` // -replication=master only
+}
+
+// Every placement is a new order, identified by the node it was placed at,
+// the boot of that node and a counter, e.g. "2-kf3x9q1c-7"
+type orderIDGenerator struct {
+	origin  string
+	boot    string
+	counter int
+}
+
+func newOrderIDGenerator(origin string) *orderIDGenerator {
+	bootMillis := time.Now().UnixNano() / int64(time.Millisecond)
+	return &orderIDGenerator{origin: origin, boot: strconv.FormatInt(bootMillis, 36)}
+}
+
+func (g *orderIDGenerator) next() string {
+	g.counter++
+	return fmt.Sprintf("%v-%v-%v", g.origin, g.boot, g.counter)
+}
+
+// A hall button pressed while an order for the same floor and direction is
+// outstanding is merged with that order instead of placing a new one
+func findOutstandingOrder(floor int, button elevio.ButtonType, orderMaps ...map[string]msgs.Order) (msgs.Order, bool) {
+	for _, orders := range orderMaps {
+		for _, order := range orders {
+			if order.Floor == floor && order.Type == button {
+				return order, true
+			}
+		}
+	}
+	return msgs.Order{}, false
+}
 
-func createOrderID(floor int, button elevio.ButtonType, num_floors int) int {
-	return num_floors*int(button) + floor
+// all orders for the floor and direction, there may be several when the
+// button was pressed on different elevators at the same time
+func findEquivalentOrders(floor int, button elevio.ButtonType, orderMaps ...map[string]msgs.Order) map[string]msgs.Order {
+	equivalent := make(map[string]msgs.Order)
+	for _, orders := range orderMaps {
+		for id, order := range orders {
+			if order.Floor == floor && order.Type == button {
+				equivalent[id] = order
+			}
+		}
+	}
+	return equivalent
 }
 
-func OrderHandler(thisID string,
+func OrderHandler(thisID string, redundancy msgs.Redundancy, leaderAssigns bool, stateDir string, serviceDeadline time.Duration,
 	/* Read channels */
 	placedHallOrder_fsmCh *nbc.NonBlockingChan,
 	redundantOrder_commhandlerCh *nbc.NonBlockingChan,
+	ignoredOrder_commhandlerCh *nbc.NonBlockingChan,
 	takeOrder_commhandlerCh *nbc.NonBlockingChan,
 	completedHallOrdersThisElev_fsmCh *nbc.NonBlockingChan,
 	completedHallOrderOtherElevCh *nbc.NonBlockingChan,
@@ -27,29 +95,171 @@ func OrderHandler(thisID string,
 	elevatorStatus_fsmCh *nbc.NonBlockingChan,
 	allElevatorsHeartbeat_commhandlerCh *nbc.NonBlockingChan,
 	lastKnownOrders_commhandlerCh *nbc.NonBlockingChan,
+	rejoinedElevator_commhandlerCh *nbc.NonBlockingChan,
+	suspectedElevators_commhandlerCh *nbc.NonBlockingChan,
+	statusRequest_apiCh *nbc.NonBlockingChan,
 	/* Write channels */
 	placedOrder_commhandlerCh *nbc.NonBlockingChan,
 	assignOrder_commhandlerCh *nbc.NonBlockingChan,
 	addOrder_fsmCh *nbc.NonBlockingChan,
 	completedOrder_commhandlerCh *nbc.NonBlockingChan,
+	rescueOrder_commhandlerCh *nbc.NonBlockingChan,
 	deleteHallOrder_fsmCh *nbc.NonBlockingChan,
 	thisElevatorHeartbeat_commhandlerCh *nbc.NonBlockingChan,
 	updateLights_fsmCh *nbc.NonBlockingChan,
 	/* Sync */
 	wg *sync.WaitGroup) {
 
-	placedOrders := make(map[int]msgs.Order)       // placed orders at this elevator
-	acceptedOrders := make(map[int]msgs.Order)     // accepted orders of this elevator (master)
-	chosenElevatorForOrder := make(map[int]string) // chosen elevator (slave) to complete an accepted order
-	assignedOrders := make(map[int]msgs.Order)     // assigned orders to this elevator (slave)
-	elevators := make(map[string]msgs.Heartbeat)   // storage of the last received elevator heartbeats
+	placedOrders := make(map[string]msgs.Order)       // placed orders at this elevator
+	acceptedOrders := make(map[string]msgs.Order)     // accepted orders of this elevator (master)
+	chosenElevatorForOrder := make(map[string]string) // chosen elevator (slave) to complete an accepted order
+	assignedOrders := make(map[string]msgs.Order)     // assigned orders to this elevator (slave)
+	elevators := make(map[string]msgs.Heartbeat)      // storage of the last received elevator heartbeats
+	placedAt := make(map[string]time.Time)            // time of the first press of each placed order
+	unlitOrders := make(map[string]bool)              // accepted alone, not lit here until another elevator is alive
+	persistedOrders := make(map[string]msgs.Order)    // accepted alone and written to the state dir
+	suspected := make(map[string]bool)                // alive elevators that are not given new orders
+	leader := thisID                                  // elevator that assigns all orders with -assign=leader
+	leaderAssigned := make(map[string]bool)           // orders this elevator has assigned as leader
+	handedOffAt := make(map[string]time.Time)         // orders this elevator moved to a faster elevator, see rebalance.go
+	idleElevators := make(map[string]bool)            // elevators idle in their last heartbeat
+	orderEscalations := make(map[string]Escalation)   // accepted orders, see escalation.go
+	hallLights := newHallLightTracker()               // acceptance state of the hall calls, see lights.go
+	var lastHeartbeats []msgs.Heartbeat               // of all alive elevators, for the hall lights
+	var lastLights [fsm.N_FLOORS][fsm.N_BUTTONS]bool  // last sent to the fsm
+	escalationTicker := time.NewTicker(escalationCheckInterval)
+	lightTicker := time.NewTicker(lightCheckInterval)
+	persistedFile := statefile.New(stateDir, "orders", thisID)
+	orderIDs := newOrderIDGenerator(thisID)
 
-	Info = log.New(os.Stdout, "[orderhandler]: ", 0)
 	// Wait until all modules are initialized
 	wg.Done()
-	Info.Println("initialized")
+	Log.Println("initialized")
 	wg.Wait()
-	Info.Println("starting")
+	Log.Println("starting")
+
+	// With -redundancy=persisted, orders this node accepts without another
+	// elevator's acknowledgement are written to the state dir before they are
+	// lit, so a restarted node still serves them
+	if redundancy == msgs.RED_Persisted {
+		if err := persistedFile.Load(&persistedOrders); err != nil {
+			Log.Errorf("could not restore persisted orders: %v\n", err)
+		}
+		for orderID, order := range persistedOrders {
+			Log.Printf("restored persisted order %v\n", orderID)
+			acceptedOrders[orderID] = order
+			chosenElevatorForOrder[orderID] = thisID
+			assignedOrders[orderID] = order
+			addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
+		}
+	}
+
+	// completed orders are no longer persisted
+	forget := func(orderID string) {
+		delete(unlitOrders, orderID)
+		if _, exists := persistedOrders[orderID]; exists {
+			delete(persistedOrders, orderID)
+			if err := persistedFile.Save(persistedOrders); err != nil {
+				Log.Errorf("could not persist orders: %v\n", err)
+			}
+		}
+	}
+
+	// give an accepted order to an elevator, by its master or the leader
+	assignTo := func(order msgs.Order, bestID string) {
+		if _, accepted := acceptedOrders[order.ID]; accepted {
+			chosenElevatorForOrder[order.ID] = bestID
+		}
+		if leaderAssigns {
+			leaderAssigned[order.ID] = true
+		}
+
+		// broadcast
+		Log.Printf("elevator %v should take order %v\n", bestID, order.ID)
+		takeOrderMsg := msgs.TakeOrderMsg{SenderID: thisID, ReceiverID: bestID, Order: order}
+		assignOrder_commhandlerCh.Send <- takeOrderMsg
+
+		if bestID == thisID {
+			assignedOrders[order.ID] = order
+			addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
+		}
+	}
+
+	// choose the elevator for an accepted order
+	assign := func(order msgs.Order) {
+		assignTo(order, bestElevator(thisID, order, elevators, suspected))
+	}
+
+	// move unserved orders this elevator assigns to elevators that complete
+	// them sooner, see rebalance.go
+	rebalance := func(reason string) {
+		if leaderAssigns && leader != thisID {
+			return
+		}
+		orders := acceptedOrders
+		chosen := chosenElevatorForOrder
+		if leaderAssigns {
+			orders = make(map[string]msgs.Order)
+			chosen = make(map[string]string)
+			for _, heartbeat := range elevators {
+				for orderID, order := range heartbeat.AcceptedOrders {
+					orders[orderID] = order
+					chosen[orderID] = heartbeat.ChosenElevatorForOrder[orderID]
+				}
+			}
+			for orderID, order := range acceptedOrders {
+				orders[orderID] = order
+				chosen[orderID] = chosenElevatorForOrder[orderID]
+			}
+		}
+		for orderID, handedOff := range handedOffAt {
+			if time.Since(handedOff) > reassignHoldoff {
+				delete(handedOffAt, orderID)
+			}
+		}
+		for orderID, bestID := range handoffCandidates(thisID, orders, chosen, elevators, suspected) {
+			if _, recently := handedOffAt[orderID]; recently {
+				continue
+			}
+			Log.Printf("order %v moved from %v to %v (%v)\n", orderID, chosen[orderID], bestID, reason)
+			handoffs.Inc(reason)
+			handedOffAt[orderID] = time.Now()
+			assignTo(orders[orderID], bestID)
+		}
+	}
+
+	// elect the leader and let it assign pending orders, see leader.go
+	updateLeader := func() {
+		if !leaderAssigns {
+			return
+		}
+		if newLeader := electLeader(thisID, elevators, suspected); newLeader != leader {
+			Log.Printf("leader is %v, was %v\n", newLeader, leader)
+			leaderChanges.Inc()
+			leader = newLeader
+		}
+		if leader != thisID {
+			return
+		}
+		pending := pendingOrders(thisID, elevators)
+		for orderID := range leaderAssigned {
+			_, stillPending := pending[orderID]
+			_, accepted := acceptedOrders[orderID]
+			if !stillPending && !accepted {
+				delete(leaderAssigned, orderID)
+			}
+		}
+		for orderID, order := range acceptedOrders {
+			if chosenElevatorForOrder[orderID] == "" && !leaderAssigned[orderID] {
+				assign(order)
+			}
+		}
+		for orderID, order := range pending {
+			if !leaderAssigned[orderID] {
+				assign(order)
+			}
+		}
+	}
 
 	for {
 		select {
@@ -57,129 +267,224 @@ func OrderHandler(thisID string,
 		case msg, _ := <-placedHallOrder_fsmCh.Recv:
 			buttonEvent := msg.(fsm.OrderEvent)
 
-			orderID := createOrderID(buttonEvent.Floor, buttonEvent.Button, fsm.N_FLOORS)
-			order := msgs.Order{ID: orderID, MasterID: thisID, Floor: buttonEvent.Floor, Type: buttonEvent.Button}
-			placedOrders[orderID] = order
+			// an unacknowledged order is placed again, see commhandler
+			if order, exists := findOutstandingOrder(buttonEvent.Floor, buttonEvent.Button, placedOrders); exists {
+				if _, accepted := acceptedOrders[order.ID]; !accepted {
+					placedOrder_commhandlerCh.Send <- order
+					break
+				}
+			}
+			otherAcceptedOrders := make([]map[string]msgs.Order, 0, len(elevators))
+			for _, heartbeat := range elevators {
+				otherAcceptedOrders = append(otherAcceptedOrders, heartbeat.AcceptedOrders)
+			}
+			if order, exists := findOutstandingOrder(buttonEvent.Floor, buttonEvent.Button,
+				append(otherAcceptedOrders, acceptedOrders, assignedOrders)...); exists {
+				Log.Printf("merged with outstanding order %v\n", order.ID)
+				break
+			}
+
+			order := msgs.Order{ID: orderIDs.next(), MasterID: thisID, Floor: buttonEvent.Floor, Type: buttonEvent.Button}
+			placedOrders[order.ID] = order
+			placedAt[order.ID] = time.Now()
 			placedOrder_commhandlerCh.Send <- order
 
 		case msg, _ := <-redundantOrder_commhandlerCh.Recv:
 			orderMsg := msg.(msgs.RedundantOrderMsg)
 
 			if order, exists := placedOrders[orderMsg.Order.ID]; exists {
+				// the sender is the elevator that acknowledged the order, or this
+				// one when it gave up waiting for acknowledgements
+				if orderMsg.SenderID == thisID {
+					if redundancy == msgs.RED_Persisted {
+						persistedOrders[order.ID] = order
+						if err := persistedFile.Save(persistedOrders); err != nil {
+							Log.Errorf("could not persist order %v, it is served without light: %v\n", order.ID, err)
+							delete(persistedOrders, order.ID)
+							unlitOrders[order.ID] = true
+						}
+					} else {
+						unlitOrders[order.ID] = true
+					}
+				}
 				acceptedOrders[order.ID] = order
-
-				// calculate scores
-				scoreMap := make(map[string]float64)
-				for _, elevator := range elevators {
-					scoreMap[elevator.SenderID] = fsm.EstimatedCompletionTime(elevator.Status,
-						fsm.OrderEvent{Floor: order.Floor, Button: order.Type})
+				if t, exists := placedAt[order.ID]; exists {
+					hallOrderAcceptTime.Observe(time.Since(t).Seconds())
 				}
 
-				// find elevator ID with lowest score
-				bestID := thisID
-				for i, score := range scoreMap {
-					if score < scoreMap[bestID] {
-						bestID = i
-					}
+				if leaderAssigns && leader != thisID {
+					Log.Printf("order %v is pending until leader %v assigns it\n", order.ID, leader)
+					break
 				}
-				chosenElevatorForOrder[order.ID] = bestID
+				assign(order)
+			} else {
+				Log.Warnf("redundant order %v didn't exist\n", orderMsg.Order.ID)
+			}
 
-				// broadcast
-				Info.Printf("elevator %v should take order %v\n", bestID, order.ID)
-				takeOrderMsg := msgs.TakeOrderMsg{SenderID: thisID, ReceiverID: bestID, Order: order}
-				assignOrder_commhandlerCh.Send <- takeOrderMsg
+		case msg, _ := <-ignoredOrder_commhandlerCh.Recv:
+			order := msg.(msgs.Order)
 
-				if bestID == thisID {
-					assignedOrders[order.ID] = order
-					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor,
-						Button: order.Type, TurnLightOn: true}
+			// the commhandler stopped placing it, the next press places a new order
+			if _, accepted := acceptedOrders[order.ID]; !accepted {
+				if _, exists := placedOrders[order.ID]; exists {
+					Log.Printf("placed order %v ignored\n", order.ID)
 				}
-			} else {
-				Info.Print("redundant order %v didn't exist\n", orderMsg.Order.ID)
+				delete(placedOrders, order.ID)
+				delete(placedAt, order.ID)
 			}
 
 		case msg, _ := <-takeOrder_commhandlerCh.Recv:
 			order := msg.(msgs.TakeOrderMsg)
 
+			// the leader chose an elevator for an order of this master
+			if _, accepted := acceptedOrders[order.Order.ID]; accepted {
+				chosenElevatorForOrder[order.Order.ID] = order.ReceiverID
+			}
+			if order.ReceiverID != thisID {
+				// a newer take gave it to another elevator
+				if _, exists := assignedOrders[order.Order.ID]; exists {
+					Log.Printf("order %v dropped, taken by %v\n", order.Order.ID, order.ReceiverID)
+					delete(assignedOrders, order.Order.ID)
+					deleteHallOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Order.Floor, Button: order.Order.Type}
+				}
+				break
+			}
 			if order.SenderID == thisID {
-				Info.Printf("takeOrder_commhandlerCh: assigned order to itself: %v\n", order)
-				addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Order.Floor,
-					Button: order.Order.Type, TurnLightOn: true}
-			} else {
-				addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Order.Floor,
-					Button: order.Order.Type, TurnLightOn: false}
+				Log.Debugf("takeOrder_commhandlerCh: assigned order to itself: %v\n", order)
 			}
+			addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Order.Floor, Button: order.Order.Type}
 			assignedOrders[order.Order.ID] = order.Order
 
 		case msg, _ := <-completedHallOrdersThisElev_fsmCh.Recv:
 			completedOrders := msg.([]fsm.OrderEvent)
 
-			// find and remove all equivalent placedOrders
+			// find and remove all equivalent orders
 			for _, completedOrder := range completedOrders {
-				orderID := createOrderID(completedOrder.Floor, completedOrder.Button, fsm.N_FLOORS)
-
-				completedOrder_commhandlerCh.Send <- msgs.Order{ID: orderID, Floor: completedOrder.Floor, Type: completedOrder.Button}
-				Info.Printf("completed order %v\n", orderID)
-
-				//delete order
-				delete(assignedOrders, orderID)
-				delete(acceptedOrders, orderID)
-				delete(chosenElevatorForOrder, orderID)
-				delete(placedOrders, orderID)
+				equivalentOrders := findEquivalentOrders(completedOrder.Floor, completedOrder.Button,
+					assignedOrders, acceptedOrders, placedOrders)
+				completedIDs := make([]string, 0, len(equivalentOrders))
+				for orderID := range equivalentOrders {
+					completedIDs = append(completedIDs, orderID)
+				}
+				hallLights.complete(completedOrder.Floor, completedOrder.Button, time.Now(), completedIDs...)
+				for orderID, order := range equivalentOrders {
+					completedOrder_commhandlerCh.Send <- order
+					Log.Printf("completed order %v\n", orderID)
+
+					//delete order
+					delete(assignedOrders, orderID)
+					delete(acceptedOrders, orderID)
+					delete(chosenElevatorForOrder, orderID)
+					delete(placedOrders, orderID)
+					if t, exists := placedAt[orderID]; exists {
+						hallOrderServiceTime.Observe(time.Since(t).Seconds())
+						delete(placedAt, orderID)
+					}
+					forget(orderID)
+				}
 			}
 
 		case msg, _ := <-completedHallOrderOtherElevCh.Recv:
 			completedOrder := msg.(msgs.Order)
 
-			for _, order := range placedOrders {
-				if order.Floor == completedOrder.Floor &&
-					order.Type == completedOrder.Type {
-					delete(placedOrders, order.ID)
-				}
-			}
-			for _, order := range acceptedOrders {
-				if order.Floor == completedOrder.Floor &&
-					order.Type == completedOrder.Type {
-					delete(acceptedOrders, order.ID)
-					delete(chosenElevatorForOrder, order.ID)
-				}
+			hallLights.complete(completedOrder.Floor, completedOrder.Type, time.Now(), completedOrder.ID)
+
+			// the commhandler sends every equivalent order it completes, those
+			// placed after the completion are new calls and stay
+			delete(placedOrders, completedOrder.ID)
+			if t, exists := placedAt[completedOrder.ID]; exists {
+				hallOrderServiceTime.Observe(time.Since(t).Seconds())
+				delete(placedAt, completedOrder.ID)
 			}
+			delete(acceptedOrders, completedOrder.ID)
+			delete(chosenElevatorForOrder, completedOrder.ID)
+			forget(completedOrder.ID)
+			delete(assignedOrders, completedOrder.ID)
+
+			stillAssigned := false
 			for _, order := range assignedOrders {
-				if order.Floor == completedOrder.Floor &&
-					order.Type == completedOrder.Type {
-					delete(assignedOrders, order.ID)
+				if order.Floor == completedOrder.Floor && order.Type == completedOrder.Type {
+					stillAssigned = true
 				}
 			}
-
+			if stillAssigned {
+				break
+			}
 			deleteHallOrder_fsmCh.Send <- fsm.OrderEvent{Floor: completedOrder.Floor, Button: completedOrder.Type}
 
 		case msg, _ := <-downedElevators_commhandlerCh.Recv:
 			downedElevators := msg.([]msgs.Heartbeat)
 
+			if leaderAssigns {
+				// only the leader reassigns, it may be a new one
+				for _, lastHeartbeat := range downedElevators {
+					Log.Printf("down: %+v %v %v\n", lastHeartbeat.SenderID, lastHeartbeat.AcceptedOrders, lastHeartbeat.TakenOrders)
+					delete(elevators, lastHeartbeat.SenderID)
+				}
+				updateLeader()
+				if leader != thisID {
+					break
+				}
+				for _, lastHeartbeat := range downedElevators {
+					for orderID, order := range lastHeartbeat.AcceptedOrders {
+						acceptedOrders[orderID] = order
+						if chosenID := lastHeartbeat.ChosenElevatorForOrder[orderID]; chosenID != "" && chosenID != lastHeartbeat.SenderID {
+							if _, alive := elevators[chosenID]; alive {
+								chosenElevatorForOrder[orderID] = chosenID
+								continue
+							}
+						}
+						assign(order)
+					}
+					for orderID, order := range lastHeartbeat.TakenOrders {
+						if _, adopted := lastHeartbeat.AcceptedOrders[orderID]; !adopted {
+							assign(order)
+						}
+					}
+				}
+				break
+			}
+
 			for _, lastHeartbeat := range downedElevators {
 				// elevator is down
-				Info.Printf("down: %+v %v %v\n", lastHeartbeat.SenderID, lastHeartbeat.AcceptedOrders, lastHeartbeat.TakenOrders)
+				Log.Printf("down: %+v %v %v\n", lastHeartbeat.SenderID, lastHeartbeat.AcceptedOrders, lastHeartbeat.TakenOrders)
 				// Add taken orders
 				for orderID, order := range lastHeartbeat.TakenOrders {
 					assignedOrders[orderID] = order
 					chosenElevatorForOrder[orderID] = thisID
-					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type, 
-						TurnLightOn: elevators[lastHeartbeat.SenderID].Status.Lights[order.Floor][order.Type]}
+					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
 				}
 				// Add accepted orders
 				for orderID, order := range lastHeartbeat.AcceptedOrders {
 					acceptedOrders[orderID] = order
 					chosenElevatorForOrder[orderID] = thisID
-					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type, TurnLightOn: true}
+					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
 				}
 
 				delete(elevators, lastHeartbeat.SenderID)
 			}
 
+		case msg, _ := <-rejoinedElevator_commhandlerCh.Recv:
+			heartbeat := msg.(msgs.Heartbeat)
+
+			for _, order := range reconcile(thisID, heartbeat, acceptedOrders, chosenElevatorForOrder, assignedOrders) {
+				deleteHallOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
+			}
+			elevators[heartbeat.SenderID] = heartbeat
+			updateLeader()
+			rebalance("rejoined")
+
+		case msg, _ := <-suspectedElevators_commhandlerCh.Recv:
+			suspected = make(map[string]bool)
+			for _, id := range msg.([]string) {
+				suspected[id] = true
+			}
+			updateLeader()
+
 		case msg, _ := <-lastKnownOrders_commhandlerCh.Recv:
 			lastOrders := msg.([fsm.N_FLOORS][fsm.N_BUTTONS]bool)
 
-			for floor :=0; floor < fsm.N_FLOORS; floor++ {
+			for floor := 0; floor < fsm.N_FLOORS; floor++ {
 				if lastOrders[floor][elevio.BT_Cab] {
 					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: elevio.BT_Cab, TurnLightOn: true}
 				}
@@ -189,17 +494,17 @@ func OrderHandler(thisID string,
 			elevatorStatus := msg.(fsm.Elevator)
 
 			// make deep copy of accepted and taken orders
-			acceptedOrdersDeepCopy := make(map[int]msgs.Order)
+			acceptedOrdersDeepCopy := make(map[string]msgs.Order)
 			for k, v := range acceptedOrders {
 				acceptedOrdersDeepCopy[k] = v
 			}
 			// make deep copy of chosenElevatorForOrder
-			chosenElevatorForOrderDeepCopy := make(map[int]string)
+			chosenElevatorForOrderDeepCopy := make(map[string]string)
 			for k, v := range chosenElevatorForOrder {
 				chosenElevatorForOrderDeepCopy[k] = v
 			}
 
-			takenOrdersDeepCopy := make(map[int]msgs.Order)
+			takenOrdersDeepCopy := make(map[string]msgs.Order)
 			for k, v := range assignedOrders {
 				takenOrdersDeepCopy[k] = v
 			}
@@ -213,32 +518,104 @@ func OrderHandler(thisID string,
 
 			thisElevatorHeartbeat_commhandlerCh.Send <- heartbeat
 
+		case <-escalationTicker.C:
+			for orderID := range orderEscalations {
+				if _, accepted := acceptedOrders[orderID]; !accepted {
+					delete(orderEscalations, orderID)
+				}
+			}
+			for orderID, order := range acceptedOrders {
+				escalation, exists := orderEscalations[orderID]
+				if !exists {
+					orderEscalations[orderID] = Escalation{Step: ESC_None, Since: time.Now()}
+					continue
+				}
+				if escalation.Step >= ESC_Rescued {
+					rescueOrder_commhandlerCh.Send <- order
+				}
+				if escalation.Step == ESC_Alarmed || time.Since(escalation.Since) < serviceDeadline {
+					continue
+				}
+				escalation.Step++
+				escalation.Since = time.Now()
+				orderEscalations[orderID] = escalation
+				escalations.Inc(escalation.Step.String())
+
+				switch escalation.Step {
+				case ESC_Reassigned:
+					chosenID := chosenElevatorForOrder[orderID]
+					if nextID := nextBestElevator(thisID, chosenID, order, elevators, suspected); nextID != "" {
+						Log.Warnf("order %v not served by %v within %v, reassigned to %v\n", orderID, chosenID, serviceDeadline, nextID)
+						assignTo(order, nextID)
+					} else {
+						Log.Warnf("order %v not served by %v within %v, no other elevator to reassign it to\n", orderID, chosenID, serviceDeadline)
+					}
+				case ESC_Rescued:
+					Log.Warnf("order %v still not served, all elevators are asked to rescue it\n", orderID)
+					rescueOrder_commhandlerCh.Send <- order
+					if _, assigned := assignedOrders[orderID]; !assigned {
+						assignedOrders[orderID] = order
+						addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
+					}
+				case ESC_Alarmed:
+					Log.Errorf("ALARM: order %v not served %v after it was accepted\n", orderID, 3*serviceDeadline)
+				}
+			}
+
+		case msg, _ := <-statusRequest_apiCh.Recv:
+			replyCh := msg.(chan Snapshot)
+
+			snapshot := Snapshot{PlacedOrders: make(map[string]msgs.Order),
+				AcceptedOrders:         make(map[string]msgs.Order),
+				ChosenElevatorForOrder: make(map[string]string),
+				AssignedOrders:         make(map[string]msgs.Order),
+				Elevators:              make(map[string]msgs.Heartbeat),
+				Escalations:            make(map[string]Escalation)}
+			for k, v := range orderEscalations {
+				snapshot.Escalations[k] = v
+			}
+			for k, v := range placedOrders {
+				snapshot.PlacedOrders[k] = v
+			}
+			for k, v := range acceptedOrders {
+				snapshot.AcceptedOrders[k] = v
+			}
+			for k, v := range chosenElevatorForOrder {
+				snapshot.ChosenElevatorForOrder[k] = v
+			}
+			for k, v := range assignedOrders {
+				snapshot.AssignedOrders[k] = v
+			}
+			for k, v := range elevators {
+				snapshot.Elevators[k] = v
+			}
+			if leaderAssigns {
+				snapshot.Leader = leader
+			}
+			calls := hallLights.calls
+			snapshot.HallLights = &calls
+			replyCh <- snapshot
+
 		case msg, _ := <-allElevatorsHeartbeat_commhandlerCh.Recv:
 			allElevatorsHeartbeat := msg.([]msgs.Heartbeat)
 			// update elevators
 			for _, elevatorHeartbeat := range allElevatorsHeartbeat {
 				elevators[elevatorHeartbeat.SenderID] = elevatorHeartbeat
 			}
-			// update lights
-			var updateLights [fsm.N_FLOORS][fsm.N_BUTTONS]bool
-			for _, elevatorHeartbeat := range allElevatorsHeartbeat {
-				for _, acceptedOrder := range elevatorHeartbeat.AcceptedOrders {
-					chosenElevatorID := elevatorHeartbeat.ChosenElevatorForOrder[acceptedOrder.ID]
-					// find heartbeat for chosenElevatorID in allElevatorsHeartbeat
-					for _, chosenElevatorHeartbeat := range allElevatorsHeartbeat {
-						if chosenElevatorHeartbeat.SenderID == chosenElevatorID {
-							chosenElevatorTakenOrder := chosenElevatorHeartbeat.TakenOrders
-							chosenElevatorStatus := chosenElevatorHeartbeat.Status
-							if _, exists := chosenElevatorTakenOrder[acceptedOrder.ID]; exists &&
-								chosenElevatorStatus.Orders[acceptedOrder.Floor][acceptedOrder.Type] {
-								updateLights[acceptedOrder.Floor][acceptedOrder.Type] = true
-								break
-							}
-						}
-					}
-				}
+			updateLeader()
+			if len(becameIdle(allElevatorsHeartbeat, idleElevators)) > 0 {
+				rebalance("idle")
+			}
+			// update lights, sent every time so a light the fsm turned off is set again
+			lastHeartbeats = allElevatorsHeartbeat
+			lastLights = hallLights.update(lastHeartbeats, unlitOrders, time.Now())
+			updateLights_fsmCh.Send <- lastLights
+
+		case <-lightTicker.C:
+			if lights := hallLights.update(lastHeartbeats, unlitOrders, time.Now()); lights != lastLights {
+				lastLights = lights
+				updateLights_fsmCh.Send <- lastLights
 			}
-			updateLights_fsmCh.Send <- updateLights
 
 		}
 	}
@@ -0,0 +1,314 @@
+package orderhandler
+
+import (
+	"../elevio"
+	"../fsm"
+	"../go-nonblockingchan"
+	"../msgs"
+	"../raft"
+	"sync"
+	"time"
+)
+
+// Order replication through the raft log (-replication=raft). A press is
+// proposed as a placed entry and only lit once it is committed, so an order
+// is never lit unless a majority of the cluster has stored it (spec 1.8 and
+// 2.8). The raft leader proposes an assigned entry for every committed order
+// without an elevator, or whose elevator is down, and the completing elevator
+// proposes a completed entry. Every node applies the committed entries in log
+// order, so all nodes agree on the orders, their elevators and their lights.
+// -redundancy has no effect, an order placed in a minority is not committed.
+//
+// Proposals are sent again until they are committed, as they are lost when
+// there is no leader or the packet is dropped. Placed orders not committed
+// within proposalGiveupTimeout are given up, the press was in a minority.
+
+const proposalRetryInterval = 1 * time.Second
+const proposalGiveupTimeout = 10 * time.Second
+
+type proposal struct {
+	Entry    msgs.RaftEntry
+	Proposed time.Time
+	Sent     time.Time
+}
+
+func proposalKey(event string, orderID string) string {
+	return event + " " + orderID
+}
+
+func RaftOrderHandler(thisID string,
+	/* Read channels */
+	placedHallOrder_fsmCh *nbc.NonBlockingChan,
+	completedHallOrdersThisElev_fsmCh *nbc.NonBlockingChan,
+	downedElevators_commhandlerCh *nbc.NonBlockingChan,
+	elevatorStatus_fsmCh *nbc.NonBlockingChan,
+	allElevatorsHeartbeat_commhandlerCh *nbc.NonBlockingChan,
+	lastKnownOrders_commhandlerCh *nbc.NonBlockingChan,
+	suspectedElevators_commhandlerCh *nbc.NonBlockingChan,
+	committedEntry_raftCh *nbc.NonBlockingChan,
+	raftStatus_raftCh *nbc.NonBlockingChan,
+	statusRequest_apiCh *nbc.NonBlockingChan,
+	/* Write channels */
+	addOrder_fsmCh *nbc.NonBlockingChan,
+	deleteHallOrder_fsmCh *nbc.NonBlockingChan,
+	proposeEntry_raftCh *nbc.NonBlockingChan,
+	thisElevatorHeartbeat_commhandlerCh *nbc.NonBlockingChan,
+	updateLights_fsmCh *nbc.NonBlockingChan,
+	/* Sync */
+	wg *sync.WaitGroup) {
+
+	orders := make(map[string]msgs.Order)             // committed and not completed
+	chosenElevatorForOrder := make(map[string]string) // committed assignments
+	completedOrders := make(map[string]bool)          // committed completions, later entries for them are ignored
+	proposals := make(map[string]*proposal)           // by proposalKey, until committed
+	placedTimes := make(map[string]time.Time)         // orders placed at this elevator
+	var servingCalls [fsm.N_FLOORS][2]bool            // calls given to the fsm of this elevator
+	elevators := make(map[string]msgs.Heartbeat)      // alive elevators, this one included
+	suspected := make(map[string]bool)                // alive elevators that are not given new orders
+	downed := make(map[string]bool)                   // lost elevators whose orders are reassigned
+	var raftStatus raft.Status
+	thisHeartbeat := msgs.Heartbeat{SenderID: thisID}
+	idGenerator := newOrderIDGenerator(thisID)
+	retryTicker := time.NewTicker(proposalRetryInterval)
+
+	// Wait until all modules are initialized
+	wg.Done()
+	Log.Println("initialized (raft replication)")
+	wg.Wait()
+	Log.Println("starting")
+
+	propose := func(entry msgs.RaftEntry) {
+		key := proposalKey(entry.Event, entry.Order.ID)
+		if _, exists := proposals[key]; exists {
+			return
+		}
+		now := time.Now()
+		proposals[key] = &proposal{Entry: entry, Proposed: now, Sent: now}
+		proposeEntry_raftCh.Send <- entry
+	}
+
+	// completed here, but the completion is not committed yet
+	completing := func(orderID string) bool {
+		_, exists := proposals[proposalKey("completed", orderID)]
+		return exists
+	}
+
+	// the leader assigns committed orders, give the fsm the orders assigned
+	// to this elevator and set the lights of committed orders
+	update := func() {
+		elevators[thisID] = thisHeartbeat
+
+		if raftStatus.Role == raft.LEADER {
+			for id, order := range orders {
+				elevatorID := chosenElevatorForOrder[id]
+				if (elevatorID == "" || downed[elevatorID]) && !completing(id) {
+					propose(msgs.RaftEntry{Event: "assigned", Order: order,
+						ElevatorID: bestElevator(thisID, order, elevators, suspected)})
+				}
+			}
+		}
+
+		var serve [fsm.N_FLOORS][2]bool
+		var updateLights [fsm.N_FLOORS][fsm.N_BUTTONS]bool
+		for id, order := range orders {
+			if completing(id) {
+				continue
+			}
+			updateLights[order.Floor][order.Type] = true
+			if chosenElevatorForOrder[id] == thisID {
+				serve[order.Floor][order.Type] = true
+			}
+		}
+		for floor := 0; floor < fsm.N_FLOORS; floor++ {
+			for button := elevio.BT_HallUp; button <= elevio.BT_HallDown; button++ {
+				if serve[floor][button] && !servingCalls[floor][button] {
+					Log.Printf("serving hall order %v floor %v\n", button, floor)
+					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: button}
+				} else if !serve[floor][button] && servingCalls[floor][button] {
+					Log.Printf("dropping hall order %v floor %v\n", button, floor)
+					deleteHallOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: button}
+				}
+				servingCalls[floor][button] = serve[floor][button]
+			}
+		}
+		updateLights_fsmCh.Send <- updateLights
+	}
+
+	apply := func(entry msgs.RaftEntry) {
+		order := entry.Order
+		delete(proposals, proposalKey(entry.Event, order.ID))
+		if completedOrders[order.ID] {
+			return
+		}
+
+		switch entry.Event {
+		case "placed":
+			if _, exists := orders[order.ID]; exists {
+				return
+			}
+			Log.Printf("order %v committed\n", order.ID)
+			orders[order.ID] = order
+			if placedTime, exists := placedTimes[order.ID]; exists {
+				hallOrderAcceptTime.Observe(time.Since(placedTime).Seconds())
+			}
+
+		case "assigned":
+			if _, exists := orders[order.ID]; !exists {
+				return
+			}
+			Log.Printf("order %v assigned to %v\n", order.ID, entry.ElevatorID)
+			chosenElevatorForOrder[order.ID] = entry.ElevatorID
+
+		case "completed":
+			Log.Printf("order %v completed by %v\n", order.ID, entry.ElevatorID)
+			completedOrders[order.ID] = true
+			delete(orders, order.ID)
+			delete(chosenElevatorForOrder, order.ID)
+			delete(proposals, proposalKey("placed", order.ID))
+			delete(proposals, proposalKey("assigned", order.ID))
+			if placedTime, exists := placedTimes[order.ID]; exists {
+				hallOrderServiceTime.Observe(time.Since(placedTime).Seconds())
+				delete(placedTimes, order.ID)
+			}
+		}
+	}
+
+	for {
+		select {
+
+		case msg, _ := <-placedHallOrder_fsmCh.Recv:
+			buttonEvent := msg.(fsm.OrderEvent)
+
+			pendingOrders := make(map[string]msgs.Order)
+			for _, p := range proposals {
+				if p.Entry.Event == "placed" {
+					pendingOrders[p.Entry.Order.ID] = p.Entry.Order
+				}
+			}
+			if order, exists := findOutstandingOrder(buttonEvent.Floor, buttonEvent.Button, orders, pendingOrders); exists {
+				Log.Printf("merged with outstanding order %v\n", order.ID)
+				break
+			}
+			order := msgs.Order{ID: idGenerator.next(), MasterID: thisID, Floor: buttonEvent.Floor, Type: buttonEvent.Button}
+			Log.Printf("proposing order %v\n", order.ID)
+			placedTimes[order.ID] = time.Now()
+			propose(msgs.RaftEntry{Event: "placed", Order: order})
+
+		case msg, _ := <-completedHallOrdersThisElev_fsmCh.Recv:
+			completedButtons := msg.([]fsm.OrderEvent)
+
+			for _, completedButton := range completedButtons {
+				servingCalls[completedButton.Floor][completedButton.Button] = false
+				equivalentOrders := findEquivalentOrders(completedButton.Floor, completedButton.Button, orders)
+				for _, p := range proposals {
+					if p.Entry.Event == "placed" && p.Entry.Order.Floor == completedButton.Floor &&
+						p.Entry.Order.Type == completedButton.Button {
+						equivalentOrders[p.Entry.Order.ID] = p.Entry.Order
+					}
+				}
+				for _, order := range equivalentOrders {
+					propose(msgs.RaftEntry{Event: "completed", Order: order, ElevatorID: thisID})
+				}
+			}
+			update()
+
+		case msg, _ := <-committedEntry_raftCh.Recv:
+			apply(msg.(msgs.RaftEntry))
+			update()
+
+		case msg, _ := <-raftStatus_raftCh.Recv:
+			raftStatus = msg.(raft.Status)
+
+			if raftStatus.Role != raft.LEADER {
+				// the new leader decides
+				for key, p := range proposals {
+					if p.Entry.Event == "assigned" {
+						delete(proposals, key)
+					}
+				}
+			}
+			update()
+
+		case <-retryTicker.C:
+			for key, p := range proposals {
+				if p.Entry.Event == "placed" && time.Since(p.Proposed) > proposalGiveupTimeout {
+					Log.Warnf("order %v not committed, no majority has seen it\n", p.Entry.Order.ID)
+					delete(proposals, key)
+					delete(placedTimes, p.Entry.Order.ID)
+					continue
+				}
+				if time.Since(p.Sent) >= proposalRetryInterval {
+					Log.Debugf("proposing %v %v again\n", p.Entry.Event, p.Entry.Order.ID)
+					p.Sent = time.Now()
+					proposeEntry_raftCh.Send <- p.Entry
+				}
+			}
+
+		case msg, _ := <-downedElevators_commhandlerCh.Recv:
+			for _, lastHeartbeat := range msg.([]msgs.Heartbeat) {
+				Log.Printf("down: %v, its orders are reassigned by the leader\n", lastHeartbeat.SenderID)
+				delete(elevators, lastHeartbeat.SenderID)
+				downed[lastHeartbeat.SenderID] = true
+			}
+			update()
+
+		case msg, _ := <-lastKnownOrders_commhandlerCh.Recv:
+			lastOrders := msg.([fsm.N_FLOORS][fsm.N_BUTTONS]bool)
+
+			for floor := 0; floor < fsm.N_FLOORS; floor++ {
+				if lastOrders[floor][elevio.BT_Cab] {
+					addOrder_fsmCh.Send <- fsm.OrderEvent{Floor: floor, Button: elevio.BT_Cab, TurnLightOn: true}
+				}
+			}
+
+		case msg, _ := <-suspectedElevators_commhandlerCh.Recv:
+			suspected = make(map[string]bool)
+			for _, id := range msg.([]string) {
+				if id != thisID {
+					suspected[id] = true
+				}
+			}
+
+		case msg, _ := <-elevatorStatus_fsmCh.Recv:
+			thisHeartbeat.Status = msg.(fsm.Elevator)
+			thisElevatorHeartbeat_commhandlerCh.Send <- thisHeartbeat
+
+		case msg, _ := <-statusRequest_apiCh.Recv:
+			replyCh := msg.(chan Snapshot)
+
+			status := raftStatus
+			snapshot := Snapshot{PlacedOrders: make(map[string]msgs.Order),
+				AcceptedOrders:         make(map[string]msgs.Order),
+				ChosenElevatorForOrder: make(map[string]string),
+				Elevators:              make(map[string]msgs.Heartbeat),
+				Leader:                 raftStatus.LeaderID,
+				Raft:                   &status}
+			for _, p := range proposals {
+				if p.Entry.Event == "placed" {
+					snapshot.PlacedOrders[p.Entry.Order.ID] = p.Entry.Order
+				}
+			}
+			for k, v := range orders {
+				snapshot.AcceptedOrders[k] = v
+			}
+			for k, v := range chosenElevatorForOrder {
+				snapshot.ChosenElevatorForOrder[k] = v
+			}
+			for k, v := range elevators {
+				snapshot.Elevators[k] = v
+			}
+			replyCh <- snapshot
+
+		case msg, _ := <-allElevatorsHeartbeat_commhandlerCh.Recv:
+			elevators = make(map[string]msgs.Heartbeat)
+			for _, heartbeat := range msg.([]msgs.Heartbeat) {
+				if heartbeat.SenderID == thisID {
+					continue
+				}
+				elevators[heartbeat.SenderID] = heartbeat
+				delete(downed, heartbeat.SenderID)
+			}
+			update()
+		}
+	}
+}
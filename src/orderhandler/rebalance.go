@@ -0,0 +1,63 @@
+package orderhandler
+
+import (
+	"../fsm"
+	"../metrics"
+	"../msgs"
+	"time"
+)
+
+var handoffs = metrics.NewCounter("elevator_order_handoffs_total",
+	"Unserved hall orders this node moved to an elevator that completes them sooner, by reason", "reason")
+
+// An order stays with the elevator it was first given to, also when another
+// elevator comes back or runs out of orders and could be there sooner. When
+// an elevator rejoins or becomes idle, the elevator that assigns an order
+// (its master, or the leader with -assign=leader) sends a new take to the
+// best elevator if it is at least reassignMinGain faster than the chosen one.
+// The chosen elevator keeps serving the order until the new one has
+// acknowledged the take, see commhandler/clock.go, so an order lost in the
+// handoff is still served. An order is not moved again within
+// reassignHoldoff, which keeps two elevators from trading it back and forth
+// on estimates that change as they move.
+
+const reassignMinGain = 3.0 // seconds of estimated completion time
+const reassignHoldoff = 10 * time.Second
+
+// handoffCandidates returns the orders that should be moved, with the
+// elevator they should be moved to
+func handoffCandidates(thisID string, orders map[string]msgs.Order, chosenElevatorForOrder map[string]string,
+	elevators map[string]msgs.Heartbeat, suspected map[string]bool) map[string]string {
+	moves := make(map[string]string)
+	for orderID, order := range orders {
+		chosenID := chosenElevatorForOrder[orderID]
+		chosen, alive := elevators[chosenID]
+		if !alive {
+			continue
+		}
+		bestID := bestElevator(thisID, order, elevators, suspected)
+		if bestID == chosenID {
+			continue
+		}
+		event := fsm.OrderEvent{Floor: order.Floor, Button: order.Type}
+		gain := fsm.EstimatedCompletionTime(chosen.Status, event) -
+			fsm.EstimatedCompletionTime(elevators[bestID].Status, event)
+		if gain >= reassignMinGain {
+			moves[orderID] = bestID
+		}
+	}
+	return moves
+}
+
+// becameIdle reports the elevators that are idle now but were not before
+func becameIdle(heartbeats []msgs.Heartbeat, idle map[string]bool) []string {
+	var ids []string
+	for _, heartbeat := range heartbeats {
+		isIdle := heartbeat.Status.State == fsm.ST_Idle
+		if isIdle && !idle[heartbeat.SenderID] {
+			ids = append(ids, heartbeat.SenderID)
+		}
+		idle[heartbeat.SenderID] = isIdle
+	}
+	return ids
+}
@@ -0,0 +1,54 @@
+package orderhandler
+
+import (
+	"../metrics"
+	"../msgs"
+)
+
+var reconciledOrders = metrics.NewCounter("elevator_reconciled_orders_total",
+	"Orders changed when reconciling with an elevator that rejoined, by action", "action")
+
+// The orders of a lost elevator are taken over (see downedElevators), but an
+// elevator that was only cut off by a partition kept serving them on its side.
+// When it rejoins, both run this with the other's heartbeat:
+//   - accepted orders taken over from it that it is still master of are
+//     handed back
+//   - hall calls both elevators serve, with the same or another order ID, are
+//     kept by the lowest ID and dropped by the other
+//
+// Orders accepted on its side are known from its heartbeat, so new presses
+// are merged with them. reconcile returns the orders to drop from the fsm.
+func reconcile(thisID string, rejoined msgs.Heartbeat,
+	acceptedOrders map[string]msgs.Order,
+	chosenElevatorForOrder map[string]string,
+	assignedOrders map[string]msgs.Order) []msgs.Order {
+
+	for orderID, order := range acceptedOrders {
+		if order.MasterID == thisID {
+			continue
+		}
+		if _, exists := rejoined.AcceptedOrders[orderID]; exists {
+			Log.Printf("reconcile: order %v handed back to %v\n", orderID, rejoined.SenderID)
+			delete(acceptedOrders, orderID)
+			delete(chosenElevatorForOrder, orderID)
+			reconciledOrders.Inc("handed_back")
+		}
+	}
+
+	var dropped []msgs.Order
+	if thisID < rejoined.SenderID {
+		return dropped
+	}
+	for orderID, order := range assignedOrders {
+		if other, exists := findOutstandingOrder(order.Floor, order.Type, rejoined.TakenOrders); exists {
+			Log.Printf("reconcile: order %v dropped, %v serves it as %v\n", orderID, rejoined.SenderID, other.ID)
+			delete(assignedOrders, orderID)
+			if _, accepted := acceptedOrders[orderID]; accepted {
+				chosenElevatorForOrder[orderID] = rejoined.SenderID
+			}
+			dropped = append(dropped, order)
+			reconciledOrders.Inc("dropped_duplicate")
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,484 @@
+package raft
+
+import (
+	"../comm/bcast"
+	"../go-nonblockingchan"
+	"../logging"
+	"../metrics"
+	"../msgs"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var Log = logging.New("raft")
+
+var elections = metrics.NewCounter("elevator_raft_elections_total",
+	"Elections started by this node, -replication=raft only")
+var committedEntries = metrics.NewCounter("elevator_raft_committed_entries_total",
+	"Log entries committed, by event", "event")
+
+// Replicated log of order events for -replication=raft, using Raft (Ongaro
+// and Ousterhout) over the broadcast port. The cluster is fixed by -cluster,
+// an entry is committed when a majority of it has stored it, so a node that
+// is alone or in a minority commits nothing. The orderhandler proposes
+// entries and applies the committed ones in log order on every node.
+//
+// All messages are broadcast, replies and appends carry the ID of the node
+// they are for. Lost messages are not retransmitted as such: the leader sends
+// an append from the next index of every follower every heartbeatInterval,
+// and a proposal that is lost on the way to the leader is proposed again by
+// the orderhandler. Term, vote and log are written to the state dir before
+// anything that depends on them is sent, so a restarted node keeps its
+// promises, see storage.go. A node that cannot store a vote or entries does
+// not grant the vote or acknowledge the entries.
+//
+// A leader steps down when it has not heard from a majority of the cluster
+// for electionTimeoutMax, so a leader cut off in a minority stops assigning
+// orders the others do not see.
+//
+// Known limit: the log is never compacted or snapshotted. It grows by a few
+// entries per order and is read in full on start.
+
+const heartbeatInterval = 100 * time.Millisecond
+const electionTimeoutMin = 500 * time.Millisecond
+const electionTimeoutMax = 1000 * time.Millisecond
+const maxEntriesPerAppend = 64 // keeps an append for a node far behind within one packet
+
+type Role int
+
+const (
+	FOLLOWER Role = iota
+	CANDIDATE
+	LEADER
+)
+
+func (r Role) String() string {
+	switch r {
+	case FOLLOWER:
+		return "follower"
+	case CANDIDATE:
+		return "candidate"
+	case LEADER:
+		return "leader"
+	default:
+		return "somerole"
+	}
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	for role := FOLLOWER; role <= LEADER; role++ {
+		if role.String() == string(text) {
+			*r = role
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q", text)
+}
+
+// Sent to the orderhandler when any of it changes
+type Status struct {
+	Role        Role   `json:"role"`
+	Term        uint64 `json:"term"`
+	LeaderID    string `json:"leader_id"`
+	CommitIndex uint64 `json:"commit_index"`
+	LastIndex   uint64 `json:"last_index"`
+}
+
+// Persisted before any message that depends on it is sent, raft is only safe
+// if a node never forgets a vote or an entry it has acknowledged
+type persistentState struct {
+	Term     uint64           `json:"term"`
+	VotedFor string           `json:"voted_for"`
+	Log      []msgs.RaftEntry `json:"-"` // log[0] is a sentinel with term 0, stored in the log file
+}
+
+func electionTimeout() time.Duration {
+	return electionTimeoutMin + time.Duration(rand.Int63n(int64(electionTimeoutMax-electionTimeoutMin)))
+}
+
+func Raft(thisID string, cluster []string, commonPort int, storage *Storage,
+	/* read */
+	propose_orderhandlerCh *nbc.NonBlockingChan,
+	/* write */
+	committed_orderhandlerCh *nbc.NonBlockingChan,
+	status_orderhandlerCh *nbc.NonBlockingChan,
+	/* sync */
+	wg *sync.WaitGroup) {
+
+	voteRequestSend_bcastCh := make(chan msgs.RaftVoteRequest)
+	voteReplySend_bcastCh := make(chan msgs.RaftVoteReply)
+	appendSend_bcastCh := make(chan msgs.RaftAppend)
+	appendReplySend_bcastCh := make(chan msgs.RaftAppendReply)
+	proposalSend_bcastCh := make(chan msgs.RaftProposal)
+	go bcast.Transmitter(commonPort, voteRequestSend_bcastCh, voteReplySend_bcastCh,
+		appendSend_bcastCh, appendReplySend_bcastCh, proposalSend_bcastCh)
+
+	voteRequestRecv_bcastCh := make(chan msgs.RaftVoteRequest)
+	voteReplyRecv_bcastCh := make(chan msgs.RaftVoteReply)
+	appendRecv_bcastCh := make(chan msgs.RaftAppend)
+	appendReplyRecv_bcastCh := make(chan msgs.RaftAppendReply)
+	proposalRecv_bcastCh := make(chan msgs.RaftProposal)
+	go bcast.Receiver(commonPort, voteRequestRecv_bcastCh, voteReplyRecv_bcastCh,
+		appendRecv_bcastCh, appendReplyRecv_bcastCh, proposalRecv_bcastCh)
+
+	inCluster := make(map[string]bool)
+	for _, id := range cluster {
+		inCluster[id] = true
+	}
+	majority := len(cluster)/2 + 1
+
+	state := storage.restored
+	persist := func() bool {
+		if err := storage.saveState(state); err != nil {
+			Log.Errorf("could not persist raft state: %v\n", err)
+			return false
+		}
+		return true
+	}
+	// log is stored before it replaces state.Log, entries from first on are new
+	persistLog := func(log []msgs.RaftEntry, first uint64) bool {
+		if err := storage.saveLog(log, first); err != nil {
+			Log.Errorf("could not persist raft log: %v\n", err)
+			return false
+		}
+		state.Log = log
+		return true
+	}
+
+	role := FOLLOWER
+	leaderID := ""
+	var commitIndex, lastApplied uint64
+	votes := make(map[string]bool)
+	nextIndex := make(map[string]uint64)
+	matchIndex := make(map[string]uint64)
+	lastContact := make(map[string]time.Time) // last reply from each follower, while leader
+	var lastStatus Status
+
+	lastIndex := func() uint64 {
+		return uint64(len(state.Log) - 1)
+	}
+
+	// a node only votes for a candidate whose log is at least as up to date
+	upToDate := func(index, term uint64) bool {
+		lastTerm := state.Log[lastIndex()].Term
+		return term > lastTerm || (term == lastTerm && index >= lastIndex())
+	}
+
+	// false if the new term could not be stored, nothing is changed then
+	becomeFollower := func(term uint64, leader string) bool {
+		if term > state.Term {
+			oldTerm, oldVote := state.Term, state.VotedFor
+			state.Term = term
+			state.VotedFor = ""
+			if !persist() {
+				state.Term, state.VotedFor = oldTerm, oldVote
+				return false
+			}
+		}
+		if role != FOLLOWER {
+			Log.Printf("follower in term %v\n", state.Term)
+		}
+		role = FOLLOWER
+		leaderID = leader
+		return true
+	}
+
+	sendAppend := func(id string) {
+		prev := nextIndex[id] - 1
+		end := lastIndex() + 1
+		if end > prev+1+maxEntriesPerAppend {
+			end = prev + 1 + maxEntriesPerAppend
+		}
+		appendSend_bcastCh <- msgs.RaftAppend{Term: state.Term, LeaderID: thisID, TargetID: id,
+			PrevLogIndex: prev, PrevLogTerm: state.Log[prev].Term,
+			Entries: state.Log[prev+1 : end], LeaderCommit: commitIndex}
+	}
+
+	sendAppends := func() {
+		for _, id := range cluster {
+			if id != thisID {
+				sendAppend(id)
+			}
+		}
+	}
+
+	// entries of earlier terms are committed by committing one of this term
+	advanceCommit := func() {
+		for index := lastIndex(); index > commitIndex; index-- {
+			if state.Log[index].Term != state.Term {
+				break
+			}
+			replicas := 1
+			for _, id := range cluster {
+				if id != thisID && matchIndex[id] >= index {
+					replicas++
+				}
+			}
+			if replicas >= majority {
+				commitIndex = index
+				break
+			}
+		}
+	}
+
+	// an entry that cannot be stored is dropped, the orderhandler proposes it again
+	appendEntry := func(entry msgs.RaftEntry) {
+		entry.Term = state.Term
+		entry.Index = lastIndex() + 1
+		if !persistLog(append(state.Log, entry), entry.Index) {
+			return
+		}
+		Log.Debugf("appended %v %v at %v\n", entry.Event, entry.Order.ID, entry.Index)
+		advanceCommit()
+		sendAppends()
+	}
+
+	becomeLeader := func() {
+		Log.Printf("leader in term %v\n", state.Term)
+		role = LEADER
+		leaderID = thisID
+		for _, id := range cluster {
+			nextIndex[id] = lastIndex() + 1
+			matchIndex[id] = 0
+			lastContact[id] = time.Now()
+		}
+		appendEntry(msgs.RaftEntry{Event: "noop"})
+	}
+
+	startElection := func() {
+		oldTerm, oldVote := state.Term, state.VotedFor
+		state.Term++
+		state.VotedFor = thisID
+		if !persist() {
+			state.Term, state.VotedFor = oldTerm, oldVote
+			return
+		}
+		role = CANDIDATE
+		leaderID = ""
+		votes = map[string]bool{thisID: true}
+		elections.Inc()
+		Log.Printf("election for term %v\n", state.Term)
+		if len(votes) >= majority {
+			becomeLeader()
+			return
+		}
+		voteRequestSend_bcastCh <- msgs.RaftVoteRequest{Term: state.Term, CandidateID: thisID,
+			LastLogIndex: lastIndex(), LastLogTerm: state.Log[lastIndex()].Term}
+	}
+
+	electionTimer := time.NewTimer(electionTimeout())
+	resetElectionTimer := func() {
+		if !electionTimer.Stop() {
+			select {
+			case <-electionTimer.C:
+			default:
+			}
+		}
+		electionTimer.Reset(electionTimeout())
+	}
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+
+	// Wait until all modules are initialized
+	wg.Done()
+	Log.Printf("initialized, cluster %v, %v entries restored\n", cluster, lastIndex())
+	wg.Wait()
+	Log.Println("starting")
+
+	for {
+		select {
+
+		case msg, _ := <-propose_orderhandlerCh.Recv:
+			entry := msg.(msgs.RaftEntry)
+
+			switch {
+			case role == LEADER:
+				appendEntry(entry)
+			case leaderID != "":
+				proposalSend_bcastCh <- msgs.RaftProposal{SenderID: thisID, TargetID: leaderID, Entry: entry}
+			default:
+				Log.Debugf("no leader, proposal %v %v dropped\n", entry.Event, entry.Order.ID)
+			}
+
+		case msg := <-proposalRecv_bcastCh:
+			if msg.TargetID != thisID || !inCluster[msg.SenderID] {
+				break
+			}
+			if role == LEADER {
+				appendEntry(msg.Entry)
+			}
+
+		case msg := <-voteRequestRecv_bcastCh:
+			if msg.CandidateID == thisID || !inCluster[msg.CandidateID] {
+				break
+			}
+			if msg.Term > state.Term && !becomeFollower(msg.Term, "") {
+				break
+			}
+			granted := false
+			if msg.Term == state.Term && (state.VotedFor == "" || state.VotedFor == msg.CandidateID) &&
+				upToDate(msg.LastLogIndex, msg.LastLogTerm) {
+				granted = true
+				if state.VotedFor == "" {
+					state.VotedFor = msg.CandidateID
+					if !persist() {
+						state.VotedFor = ""
+						granted = false
+					} else {
+						Log.Printf("voted for %v in term %v\n", msg.CandidateID, state.Term)
+					}
+				}
+				if granted {
+					resetElectionTimer()
+				}
+			}
+			voteReplySend_bcastCh <- msgs.RaftVoteReply{Term: state.Term, SenderID: thisID,
+				TargetID: msg.CandidateID, Granted: granted}
+
+		case msg := <-voteReplyRecv_bcastCh:
+			if msg.TargetID != thisID || !inCluster[msg.SenderID] {
+				break
+			}
+			if msg.Term > state.Term {
+				becomeFollower(msg.Term, "")
+				break
+			}
+			if role == CANDIDATE && msg.Term == state.Term && msg.Granted {
+				votes[msg.SenderID] = true
+				if len(votes) >= majority {
+					becomeLeader()
+				}
+			}
+
+		case msg := <-appendRecv_bcastCh:
+			if msg.TargetID != thisID || !inCluster[msg.LeaderID] {
+				break
+			}
+			if msg.Term < state.Term {
+				appendReplySend_bcastCh <- msgs.RaftAppendReply{Term: state.Term, SenderID: thisID,
+					TargetID: msg.LeaderID}
+				break
+			}
+			newLeader := leaderID != msg.LeaderID
+			if !becomeFollower(msg.Term, msg.LeaderID) {
+				break
+			}
+			if newLeader {
+				Log.Printf("%v is leader in term %v\n", msg.LeaderID, msg.Term)
+			}
+			resetElectionTimer()
+
+			if msg.PrevLogIndex > lastIndex() || state.Log[msg.PrevLogIndex].Term != msg.PrevLogTerm {
+				matched := lastIndex()
+				if msg.PrevLogIndex <= matched {
+					matched = msg.PrevLogIndex - 1
+				}
+				appendReplySend_bcastCh <- msgs.RaftAppendReply{Term: state.Term, SenderID: thisID,
+					TargetID: msg.LeaderID, MatchIndex: matched}
+				break
+			}
+			// entries already in the log are skipped, the first that conflicts
+			// drops it and everything after it
+			entries := msg.Entries
+			for len(entries) > 0 && entries[0].Index <= lastIndex() &&
+				state.Log[entries[0].Index].Term == entries[0].Term {
+				entries = entries[1:]
+			}
+			if len(entries) > 0 {
+				first := entries[0].Index
+				var log []msgs.RaftEntry
+				if first <= lastIndex() {
+					Log.Warnf("dropping uncommitted entries from %v\n", first)
+					log = append(append([]msgs.RaftEntry(nil), state.Log[:first]...), entries...)
+				} else {
+					log = append(state.Log, entries...)
+				}
+				if !persistLog(log, first) {
+					// not acknowledged, the leader sends them again
+					break
+				}
+			}
+			// an append that is late or only partly new must not lower it
+			matched := msg.PrevLogIndex + uint64(len(msg.Entries))
+			newCommit := msg.LeaderCommit
+			if newCommit > matched {
+				newCommit = matched
+			}
+			if newCommit > commitIndex {
+				commitIndex = newCommit
+			}
+			appendReplySend_bcastCh <- msgs.RaftAppendReply{Term: state.Term, SenderID: thisID,
+				TargetID: msg.LeaderID, Success: true, MatchIndex: matched}
+
+		case msg := <-appendReplyRecv_bcastCh:
+			if msg.TargetID != thisID || !inCluster[msg.SenderID] {
+				break
+			}
+			if msg.Term > state.Term {
+				becomeFollower(msg.Term, "")
+				break
+			}
+			if role != LEADER || msg.Term != state.Term {
+				break
+			}
+			lastContact[msg.SenderID] = time.Now()
+			if msg.Success {
+				if msg.MatchIndex > matchIndex[msg.SenderID] {
+					matchIndex[msg.SenderID] = msg.MatchIndex
+				}
+				nextIndex[msg.SenderID] = matchIndex[msg.SenderID] + 1
+				advanceCommit()
+			} else if msg.MatchIndex+1 < nextIndex[msg.SenderID] {
+				nextIndex[msg.SenderID] = msg.MatchIndex + 1
+				sendAppend(msg.SenderID)
+			}
+
+		case <-electionTimer.C:
+			electionTimer.Reset(electionTimeout())
+			if role != LEADER {
+				startElection()
+			}
+
+		case <-heartbeatTicker.C:
+			if role != LEADER {
+				break
+			}
+			heard := 1
+			for _, id := range cluster {
+				if id != thisID && time.Since(lastContact[id]) < electionTimeoutMax {
+					heard++
+				}
+			}
+			if heard < majority {
+				Log.Warnf("no majority heard from for %v, stepping down in term %v\n", electionTimeoutMax, state.Term)
+				role = FOLLOWER
+				leaderID = ""
+				resetElectionTimer()
+				break
+			}
+			sendAppends()
+		}
+
+		for lastApplied < commitIndex {
+			lastApplied++
+			entry := state.Log[lastApplied]
+			committedEntries.Inc(entry.Event)
+			if entry.Event != "noop" {
+				Log.Debugf("committed %v %v at %v\n", entry.Event, entry.Order.ID, entry.Index)
+				committed_orderhandlerCh.Send <- entry
+			}
+		}
+
+		status := Status{Role: role, Term: state.Term, LeaderID: leaderID,
+			CommitIndex: commitIndex, LastIndex: lastIndex()}
+		if status != lastStatus {
+			status_orderhandlerCh.Send <- status
+			lastStatus = status
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"../msgs"
+	"../statefile"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Term and vote are kept in a state file, and the log in its own file in the
+// state dir, one JSON encoded entry per line. New entries are appended and
+// synced before anything that depends on them is sent, so storing an entry
+// costs the entry and not the whole log. The log file is rewritten when a
+// follower drops uncommitted entries that conflict with the leader's, and
+// after a failed write, which may have left part of an entry behind.
+//
+// A node that cannot read what it has stored does not start: it could vote
+// twice in a term or lose entries it has acknowledged. Only a partial last
+// line is dropped, it was never synced and so never acknowledged.
+
+type Storage struct {
+	stateFile statefile.File
+	logPath   string
+	file      *os.File
+	stored    uint64 // entries in the log file
+	broken    bool   // the log file must be rewritten before appending
+	restored  persistentState
+}
+
+// OpenStorage reads the term, vote and log this node has stored
+func OpenStorage(stateDir string, thisID string) (*Storage, error) {
+	s := &Storage{stateFile: statefile.New(stateDir, "raft", thisID),
+		logPath: filepath.Join(stateDir, fmt.Sprintf("raftlog-%v.jsonl", thisID))}
+	if err := s.stateFile.Load(&s.restored); err != nil {
+		return nil, fmt.Errorf("could not read raft state: %v", err)
+	}
+	entries, err := s.loadLog()
+	if err != nil {
+		return nil, fmt.Errorf("could not read raft log: %v", err)
+	}
+	s.restored.Log = append([]msgs.RaftEntry{{}}, entries...)
+	s.stored = uint64(len(entries))
+	return s, nil
+}
+
+func (s *Storage) loadLog() ([]msgs.RaftEntry, error) {
+	file, err := os.Open(s.logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []msgs.RaftEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry msgs.RaftEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			if scanner.Scan() {
+				return nil, fmt.Errorf("entry after index %v: %v", len(entries), err)
+			}
+			Log.Warnf("dropping partial log entry after index %v\n", len(entries))
+			s.broken = true
+			break
+		}
+		if entry.Index != uint64(len(entries)+1) {
+			return nil, fmt.Errorf("entry %v stored at index %v", entry.Index, len(entries)+1)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (s *Storage) saveState(state persistentState) error {
+	return s.stateFile.Save(state)
+}
+
+// saveLog stores log, in which the entries from index first on are new
+func (s *Storage) saveLog(log []msgs.RaftEntry, first uint64) error {
+	var err error
+	if s.broken || first <= s.stored {
+		err = s.rewrite(log[1:])
+	} else {
+		err = s.append(log[first:])
+	}
+	if err != nil {
+		s.broken = true
+		return err
+	}
+	s.broken = false
+	s.stored = uint64(len(log) - 1)
+	return nil
+}
+
+func (s *Storage) append(entries []msgs.RaftEntry) error {
+	if s.file == nil {
+		if err := os.MkdirAll(filepath.Dir(s.logPath), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(s.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rewrite replaces the log file atomically with entries
+func (s *Storage) rewrite(entries []msgs.RaftEntry) error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	return statefile.WriteAtomic(s.logPath, data)
+}
+
+func encodeEntries(entries []msgs.RaftEntry) ([]byte, error) {
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
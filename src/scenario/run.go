@@ -0,0 +1,329 @@
+package scenario
+
+import (
+	"../elevio"
+	"../sim"
+	"../spec"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var Info *log.Logger = log.New(os.Stdout, "[scenario]: ", 0)
+
+type Config struct {
+	NodeExec      string // elevator executable
+	BroadcastPort int
+	SimBasePort   int    // node n connects to its simulated elevator on SimBasePort+n
+	LogDir        string // node output is written to <LogDir>/<scenario>-node<n>.log, discarded if empty
+	Warmup        time.Duration
+}
+
+type Result struct {
+	Failures   []string
+	Violations []spec.Violation
+}
+
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+type press struct {
+	statement Statement
+	time      time.Time
+	servedAt  time.Time
+	deadline  time.Duration   // 0 if no expectation covers the press
+	lit       map[string]bool // panels whose lamp was on after the press
+}
+
+type node struct {
+	id       int
+	elevator *sim.Elevator
+	cmd      *exec.Cmd
+	ctl      io.WriteCloser
+	lossRate float64
+	isolated bool
+	stateDir string
+}
+
+type panelState struct {
+	floor    int
+	doorOpen bool
+	lamps    [][3]bool
+}
+
+// Run starts the scenario's nodes against simulated elevators, executes the
+// statements and checks the expectations
+func Run(sc Scenario, config Config) (Result, error) {
+	var result Result
+
+	// state persisted by the nodes survives restarts within the scenario
+	stateDir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(stateDir)
+
+	eventCh := make(chan spec.Event, 64)
+	nodes := make(map[int]*node)
+	for id := 1; id <= sc.Nodes; id++ {
+		n := &node{id: id, elevator: sim.New(strconv.Itoa(id), sc.Floors, eventCh),
+			stateDir: filepath.Join(stateDir, fmt.Sprintf("node%d", id))}
+		nodes[id] = n
+		addr := fmt.Sprintf("localhost:%d", config.SimBasePort+id)
+		go func() {
+			err := n.elevator.ListenAndServe(addr)
+			Info.Printf("simulated elevator %v: %v\n", n.id, err)
+		}()
+	}
+	defer func() {
+		for _, n := range nodes {
+			stopNode(n)
+			n.elevator.Close()
+		}
+		// unblock simulators that are still sending events
+		go func() {
+			for {
+				select {
+				case <-eventCh:
+				case <-time.After(time.Second):
+					return
+				}
+			}
+		}()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	for _, n := range nodes {
+		if err := startNode(n, sc, config); err != nil {
+			return result, err
+		}
+	}
+
+	checker := spec.NewChecker(spec.DefaultConfig(sc.Floors))
+	panels := make(map[string]*panelState)
+	var presses []*press
+	var ruleFilters [][]string
+	expectNoViolations := false
+
+	warmupEnd := time.After(config.Warmup)
+warmup:
+	for {
+		select {
+		case ev := <-eventCh:
+			checker.Feed(ev)
+			updatePanel(panels, sc.Floors, ev)
+		case <-warmupEnd:
+			break warmup
+		}
+	}
+
+	start := time.Now()
+	endTime := time.Duration(0)
+	for _, st := range sc.Statements {
+		if st.Time > endTime {
+			endTime = st.Time
+		}
+		if st.Action == ACT_ExpectServed && st.Time+st.Within > endTime {
+			endTime = st.Time + st.Within
+		}
+		if st.Action == ACT_End {
+			endTime = st.Time
+			break
+		}
+	}
+	Info.Printf("running %v for %v\n", sc.Name, endTime)
+
+	next := 0
+	for time.Since(start) <= endTime {
+		if next < len(sc.Statements) && time.Since(start) >= sc.Statements[next].Time {
+			st := sc.Statements[next]
+			next++
+			Info.Println(st.Text)
+
+			switch st.Action {
+			case ACT_Press:
+				nodes[st.Node].elevator.Press(st.Floor, st.Button)
+				p := &press{statement: st, time: time.Now(), lit: make(map[string]bool)}
+				for id, panel := range panels {
+					// the lamp of an order placed before is not set again
+					p.lit[id] = panel.lamps[st.Floor][st.Button]
+				}
+				presses = append(presses, p)
+			case ACT_Kill:
+				stopNode(nodes[st.Node])
+			case ACT_Start:
+				if err := startNode(nodes[st.Node], sc, config); err != nil {
+					return result, err
+				}
+			case ACT_Drop:
+				nodes[st.Node].lossRate = st.LossRate
+				setNetworkFaults(nodes[st.Node])
+			case ACT_Isolate, ACT_Reconnect:
+				nodes[st.Node].isolated = st.Action == ACT_Isolate
+				setNetworkFaults(nodes[st.Node])
+			case ACT_BlockMotor:
+				nodes[st.Node].elevator.SetMotorBlocked(true)
+			case ACT_UnblockMotor:
+				nodes[st.Node].elevator.SetMotorBlocked(false)
+			case ACT_ExpectServed:
+				for _, p := range presses {
+					if p.deadline == 0 || st.Within < p.deadline {
+						p.deadline = st.Within
+					}
+				}
+			case ACT_ExpectNoViolations:
+				expectNoViolations = true
+				ruleFilters = append(ruleFilters, st.Rules)
+			}
+			continue
+		}
+
+		select {
+		case ev := <-eventCh:
+			checker.Feed(ev)
+			updatePanel(panels, sc.Floors, ev)
+			markServed(panels, presses, ev)
+		case <-time.After(10 * time.Millisecond):
+			checker.Tick(time.Now())
+		}
+	}
+
+	for _, p := range presses {
+		if p.deadline == 0 {
+			continue
+		}
+		st := p.statement
+		if p.servedAt.IsZero() {
+			result.Failures = append(result.Failures,
+				fmt.Sprintf("line %v: %v order at floor %v on node %v was never served", st.Line, st.Button, st.Floor, st.Node))
+		} else if p.servedAt.Sub(p.time) > p.deadline {
+			result.Failures = append(result.Failures,
+				fmt.Sprintf("line %v: %v order at floor %v on node %v served after %v", st.Line, st.Button, st.Floor, st.Node, p.servedAt.Sub(p.time)))
+		}
+	}
+
+	result.Violations = checker.Violations()
+	if expectNoViolations {
+		for _, v := range result.Violations {
+			if matchesAnyRule(v.Rule, ruleFilters) {
+				result.Failures = append(result.Failures, "violation: "+v.String())
+			}
+		}
+	}
+	return result, nil
+}
+
+func startNode(n *node, sc Scenario, config Config) error {
+	args := []string{fmt.Sprintf("-id=%d", n.id),
+		fmt.Sprintf("-addr=localhost:%d", config.SimBasePort+n.id),
+		fmt.Sprintf("-bport=%d", config.BroadcastPort),
+		"-statedir=" + n.stateDir,
+		"-testctl"}
+	n.cmd = exec.Command(config.NodeExec, append(args, sc.NodeFlags...)...)
+	if config.LogDir != "" {
+		name := strings.TrimSuffix(filepath.Base(sc.Name), filepath.Ext(sc.Name))
+		logFile, err := os.OpenFile(filepath.Join(config.LogDir, fmt.Sprintf("%v-node%d.log", name, n.id)),
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		n.cmd.Stdout = logFile
+		n.cmd.Stderr = logFile
+	}
+	ctl, err := n.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	n.ctl = ctl
+	if err := n.cmd.Start(); err != nil {
+		return err
+	}
+	setNetworkFaults(n)
+	return nil
+}
+
+func stopNode(n *node) {
+	if n.cmd != nil && n.cmd.Process != nil {
+		n.cmd.Process.Kill()
+		n.cmd.Wait()
+	}
+	n.cmd = nil
+}
+
+func setNetworkFaults(n *node) {
+	if n.cmd != nil {
+		fmt.Fprintf(n.ctl, "loss %v\n", n.lossRate)
+		if n.isolated {
+			fmt.Fprintf(n.ctl, "isolate on\n")
+		} else {
+			fmt.Fprintf(n.ctl, "isolate off\n")
+		}
+	}
+}
+
+func updatePanel(panels map[string]*panelState, numFloors int, ev spec.Event) {
+	panel, exists := panels[ev.ElevatorID]
+	if !exists {
+		panel = &panelState{floor: -1, lamps: make([][3]bool, numFloors)}
+		panels[ev.ElevatorID] = panel
+	}
+	switch ev.Type {
+	case spec.EV_FloorSensor:
+		panel.floor = ev.Floor
+	case spec.EV_DoorLamp:
+		panel.doorOpen = ev.Value != 0
+	case spec.EV_ButtonLamp:
+		panel.lamps[ev.Floor][ev.Button] = ev.Value != 0
+	}
+}
+
+// spec 1.9: served when the light of the order, lit after the press, is
+// turned off while an elevator has its door open at the floor. An order that
+// is never lit, served at once or by an elevator that is alone, is served when
+// an elevator opens its door at the floor after the press. Cab orders can
+// only be served by the elevator they were placed in.
+func markServed(panels map[string]*panelState, presses []*press, ev spec.Event) {
+	panel := panels[ev.ElevatorID]
+	for _, p := range presses {
+		st := p.statement
+		if !p.servedAt.IsZero() || ev.Time.Before(p.time) {
+			continue
+		}
+		if st.Button == elevio.BT_Cab && strconv.Itoa(st.Node) != ev.ElevatorID {
+			continue
+		}
+		if panel.lamps[st.Floor][st.Button] {
+			p.lit[ev.ElevatorID] = true
+			continue
+		}
+		if !panel.doorOpen || panel.floor != st.Floor {
+			continue
+		}
+		doorOpened := ev.Type == spec.EV_DoorLamp
+		if p.lit[ev.ElevatorID] || doorOpened {
+			p.servedAt = ev.Time
+		}
+	}
+}
+
+func matchesAnyRule(rule string, filters [][]string) bool {
+	for _, rules := range filters {
+		if len(rules) == 0 {
+			return true
+		}
+		for _, r := range rules {
+			if r == rule {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package scenario
+
+import (
+	"../elevio"
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scenario files describe reproducible fault tolerance tests. Statements are
+// separated by newlines or ';', and everything after '#' is a comment:
+//
+//   nodes 3
+//   floors 4
+//   flags -replication=crdt
+//   t=0 press hall-up floor 2 on node 1
+//   t=3 kill node 2
+//   t=8 start node 2
+//   t=10 drop 30% packets on node 3
+//   t=10 isolate node 1
+//   t=15 reconnect node 1
+//   t=12 block motor on node 1
+//   t=20 unblock motor on node 1
+//   t=25 expect served within 20s
+//   t=25 expect no violations of 2.10 2.11
+//   t=60 end
+//
+// Time is seconds after all nodes have been started. Flags are passed to every
+// node. "expect served" applies to every press before it. "expect no
+// violations" is checked for the whole run, optionally limited to the listed
+// specification rules.
+
+type Action int
+
+const (
+	ACT_Press Action = iota
+	ACT_Kill
+	ACT_Start
+	ACT_Drop
+	ACT_Isolate
+	ACT_Reconnect
+	ACT_BlockMotor
+	ACT_UnblockMotor
+	ACT_ExpectServed
+	ACT_ExpectNoViolations
+	ACT_End
+)
+
+func (a Action) String() string {
+	switch a {
+	case ACT_Press:
+		return "press"
+	case ACT_Kill:
+		return "kill"
+	case ACT_Start:
+		return "start"
+	case ACT_Drop:
+		return "drop"
+	case ACT_Isolate:
+		return "isolate"
+	case ACT_Reconnect:
+		return "reconnect"
+	case ACT_BlockMotor:
+		return "block"
+	case ACT_UnblockMotor:
+		return "unblock"
+	case ACT_ExpectServed:
+		return "expect served"
+	case ACT_ExpectNoViolations:
+		return "expect no violations"
+	case ACT_End:
+		return "end"
+	default:
+		return "someaction"
+	}
+}
+
+type Statement struct {
+	Line     int
+	Text     string
+	Time     time.Duration
+	Action   Action
+	Node     int
+	Floor    int
+	Button   elevio.ButtonType
+	LossRate float64       // ACT_Drop
+	Within   time.Duration // ACT_ExpectServed
+	Rules    []string      // ACT_ExpectNoViolations, empty means all rules
+}
+
+type Scenario struct {
+	Name       string
+	Nodes      int
+	Floors     int
+	NodeFlags  []string
+	Statements []Statement // sorted by time
+}
+
+func Parse(name string, r io.Reader) (Scenario, error) {
+	sc := Scenario{Name: name, Nodes: 1, Floors: 4}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, text := range strings.Split(line, ";") {
+			fields := strings.Fields(text)
+			if len(fields) == 0 {
+				continue
+			}
+			if err := parseStatement(&sc, lineNum, fields); err != nil {
+				return sc, fmt.Errorf("%v:%v: %v", name, lineNum, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sc, err
+	}
+
+	for _, st := range sc.Statements {
+		if st.Action != ACT_Press && st.Action != ACT_ExpectServed &&
+			st.Action != ACT_ExpectNoViolations && st.Action != ACT_End &&
+			(st.Node < 1 || st.Node > sc.Nodes) {
+			return sc, fmt.Errorf("%v:%v: node %v not in 1-%v", name, st.Line, st.Node, sc.Nodes)
+		}
+		if st.Action == ACT_Press && (st.Node < 1 || st.Node > sc.Nodes || st.Floor < 0 || st.Floor >= sc.Floors) {
+			return sc, fmt.Errorf("%v:%v: invalid node or floor", name, st.Line)
+		}
+	}
+	sort.SliceStable(sc.Statements, func(i, j int) bool {
+		return sc.Statements[i].Time < sc.Statements[j].Time
+	})
+	return sc, nil
+}
+
+func parseStatement(sc *Scenario, lineNum int, fields []string) error {
+	var err error
+	switch fields[0] {
+	case "nodes":
+		if len(fields) != 2 {
+			return fmt.Errorf("expected: nodes <n>")
+		}
+		sc.Nodes, err = strconv.Atoi(fields[1])
+		return err
+	case "floors":
+		if len(fields) != 2 {
+			return fmt.Errorf("expected: floors <m>")
+		}
+		sc.Floors, err = strconv.Atoi(fields[1])
+		return err
+	case "flags":
+		sc.NodeFlags = append(sc.NodeFlags, fields[1:]...)
+		return nil
+	}
+
+	if !strings.HasPrefix(fields[0], "t=") {
+		return fmt.Errorf("statement must start with t=<seconds>, got %q", fields[0])
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimPrefix(fields[0], "t="), 64)
+	if err != nil {
+		return err
+	}
+	st := Statement{Line: lineNum, Text: strings.Join(fields, " "),
+		Time: time.Duration(seconds * float64(time.Second))}
+	words := fields[1:]
+
+	switch {
+	case match(words, "press", "*", "floor", "*", "on", "node", "*"):
+		st.Action = ACT_Press
+		switch words[1] {
+		case "hall-up":
+			st.Button = elevio.BT_HallUp
+		case "hall-down":
+			st.Button = elevio.BT_HallDown
+		case "cab":
+			st.Button = elevio.BT_Cab
+		default:
+			return fmt.Errorf("unknown button %q", words[1])
+		}
+		if st.Floor, err = strconv.Atoi(words[3]); err != nil {
+			return err
+		}
+		st.Node, err = strconv.Atoi(words[6])
+
+	case match(words, "kill", "node", "*"):
+		st.Action = ACT_Kill
+		st.Node, err = strconv.Atoi(words[2])
+
+	case match(words, "start", "node", "*"):
+		st.Action = ACT_Start
+		st.Node, err = strconv.Atoi(words[2])
+
+	case match(words, "drop", "*", "packets", "on", "node", "*"):
+		st.Action = ACT_Drop
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(words[1], "%"), 64)
+		if err != nil {
+			return err
+		}
+		st.LossRate = percent / 100
+		st.Node, err = strconv.Atoi(words[5])
+		if err != nil {
+			return err
+		}
+
+	case match(words, "isolate", "node", "*"):
+		st.Action = ACT_Isolate
+		st.Node, err = strconv.Atoi(words[2])
+
+	case match(words, "reconnect", "node", "*"):
+		st.Action = ACT_Reconnect
+		st.Node, err = strconv.Atoi(words[2])
+
+	case match(words, "block", "motor", "on", "node", "*"):
+		st.Action = ACT_BlockMotor
+		st.Node, err = strconv.Atoi(words[4])
+
+	case match(words, "unblock", "motor", "on", "node", "*"):
+		st.Action = ACT_UnblockMotor
+		st.Node, err = strconv.Atoi(words[4])
+
+	case match(words, "expect", "served", "within", "*"):
+		st.Action = ACT_ExpectServed
+		st.Within, err = parseSeconds(words[3])
+
+	case len(words) >= 3 && match(words[:3], "expect", "no", "violations"):
+		st.Action = ACT_ExpectNoViolations
+		if len(words) > 3 {
+			if words[3] != "of" || len(words) == 4 {
+				return fmt.Errorf("expected: expect no violations [of <rule>...]")
+			}
+			st.Rules = words[4:]
+		}
+
+	case match(words, "end"):
+		st.Action = ACT_End
+
+	default:
+		return fmt.Errorf("unknown statement %q", strings.Join(words, " "))
+	}
+	if err != nil {
+		return err
+	}
+	sc.Statements = append(sc.Statements, st)
+	return nil
+}
+
+// match compares words to a pattern where "*" matches any word
+func match(words []string, pattern ...string) bool {
+	if len(words) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != words[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	return time.Duration(seconds * float64(time.Second)), err
+}
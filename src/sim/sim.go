@@ -0,0 +1,220 @@
+package sim
+
+import (
+	"../elevio"
+	"../spec"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Simulated elevator speaking the same tcp protocol as the elevator server, so
+// that unmodified nodes can connect to it with -addr. Buttons are pressed from
+// code, and every change of motor, lamps, door and floor sensor is reported as
+// a spec.Event.
+
+const travelTime = 2 * time.Second // time to travel between two floors
+const floorSensorWidth = 0.1       // share of a floor distance where the sensor is active
+const buttonHoldTime = 200 * time.Millisecond
+const updatePeriod = 10 * time.Millisecond
+
+type Elevator struct {
+	id        string
+	numFloors int
+	eventCh   chan<- spec.Event
+
+	mtx          sync.Mutex
+	position     float64 // in floors
+	motor        elevio.MotorDirection
+	motorBlocked bool
+	sensorFloor  int
+	buttons      [][3]time.Time // time each button is released
+	lamps        [][3]bool
+	door         bool
+	events       []spec.Event // events not yet sent on eventCh
+	flushMtx     sync.Mutex   // keeps events in order when flushed from several goroutines
+
+	listener net.Listener
+	conns    []net.Conn
+	closed   bool
+}
+
+func New(id string, numFloors int, eventCh chan<- spec.Event) *Elevator {
+	return &Elevator{id: id,
+		numFloors:   numFloors,
+		eventCh:     eventCh,
+		sensorFloor: 0,
+		buttons:     make([][3]time.Time, numFloors),
+		lamps:       make([][3]bool, numFloors)}
+}
+
+// ListenAndServe simulates the elevator and accepts node connections on addr.
+// A node that reconnects (e.g. after a restart) continues where the previous
+// one left the elevator.
+func (e *Elevator) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	e.mtx.Lock()
+	e.listener = listener
+	e.addEvent(spec.Event{Type: spec.EV_FloorSensor, Floor: e.sensorFloor})
+	e.mtx.Unlock()
+	e.flush()
+
+	go e.simulate()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		e.mtx.Lock()
+		e.conns = append(e.conns, conn)
+		e.mtx.Unlock()
+		go e.serve(conn)
+	}
+}
+
+// Close stops the simulation and disconnects all nodes
+func (e *Elevator) Close() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.closed = true
+	if e.listener != nil {
+		e.listener.Close()
+	}
+	for _, conn := range e.conns {
+		conn.Close()
+	}
+}
+
+func (e *Elevator) Press(floor int, button elevio.ButtonType) {
+	e.mtx.Lock()
+	e.buttons[floor][button] = time.Now().Add(buttonHoldTime)
+	e.addEvent(spec.Event{Type: spec.EV_ButtonPress, Floor: floor, Button: button})
+	e.mtx.Unlock()
+}
+
+// SetFloor places the car at floor, must be called before ListenAndServe
+func (e *Elevator) SetFloor(floor int) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.position = float64(floor)
+	e.sensorFloor = floor
+}
+
+// SetMotorBlocked emulates a motor that has lost power or is held back
+func (e *Elevator) SetMotorBlocked(blocked bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.motorBlocked = blocked
+}
+
+func (e *Elevator) addEvent(ev spec.Event) {
+	ev.Time = time.Now()
+	ev.ElevatorID = e.id
+	e.events = append(e.events, ev)
+}
+
+// events are sent without holding the lock, so the receiver may call Press
+func (e *Elevator) flush() {
+	e.flushMtx.Lock()
+	defer e.flushMtx.Unlock()
+	e.mtx.Lock()
+	events := e.events
+	e.events = nil
+	e.mtx.Unlock()
+	for _, ev := range events {
+		e.eventCh <- ev
+	}
+}
+
+func (e *Elevator) simulate() {
+	for {
+		time.Sleep(updatePeriod)
+		e.mtx.Lock()
+		if e.closed {
+			e.mtx.Unlock()
+			return
+		}
+		if !e.motorBlocked {
+			e.position += float64(e.motor) * float64(updatePeriod) / float64(travelTime)
+			e.position = math.Max(0, math.Min(float64(e.numFloors-1), e.position))
+		}
+		floor := -1
+		nearest := math.Floor(e.position + 0.5)
+		if math.Abs(e.position-nearest) < floorSensorWidth/2 {
+			floor = int(nearest)
+		}
+		if floor != e.sensorFloor {
+			e.sensorFloor = floor
+			e.addEvent(spec.Event{Type: spec.EV_FloorSensor, Floor: floor})
+		}
+		e.mtx.Unlock()
+		e.flush()
+	}
+}
+
+func (e *Elevator) serve(conn net.Conn) {
+	defer conn.Close()
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return
+		}
+		reply := e.handle(buf)
+		e.flush()
+		if reply != nil {
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (e *Elevator) handle(cmd [4]byte) []byte {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	switch cmd[0] {
+	case 1:
+		dir := elevio.MotorDirection(int8(cmd[1]))
+		if dir != e.motor {
+			e.motor = dir
+			e.addEvent(spec.Event{Type: spec.EV_Motor, Value: int(dir)})
+		}
+	case 2:
+		button, floor, on := int(cmd[1]), int(cmd[2]), cmd[3] != 0
+		if floor < e.numFloors && button < 3 && e.lamps[floor][button] != on {
+			e.lamps[floor][button] = on
+			e.addEvent(spec.Event{Type: spec.EV_ButtonLamp, Floor: floor,
+				Button: elevio.ButtonType(button), Value: int(cmd[3])})
+		}
+	case 4:
+		on := cmd[1] != 0
+		if e.door != on {
+			e.door = on
+			e.addEvent(spec.Event{Type: spec.EV_DoorLamp, Value: int(cmd[1])})
+		}
+	case 6:
+		button, floor := int(cmd[1]), int(cmd[2])
+		pressed := floor < e.numFloors && button < 3 && time.Now().Before(e.buttons[floor][button])
+		return []byte{6, toByte(pressed), 0, 0}
+	case 7:
+		if e.sensorFloor == -1 {
+			return []byte{7, 0, 0, 0}
+		}
+		return []byte{7, 1, byte(e.sensorFloor), 0}
+	case 8, 9:
+		return []byte{cmd[0], 0, 0, 0}
+	}
+	return nil
+}
+
+func toByte(a bool) byte {
+	if a {
+		return 1
+	}
+	return 0
+}
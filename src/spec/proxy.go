@@ -0,0 +1,98 @@
+package spec
+
+import (
+	"../elevio"
+	"io"
+	"net"
+	"time"
+)
+
+// Proxy sits between an elevator node and the elevator server (simulator or
+// hardware), forwards the driver protocol unchanged and reports every motor,
+// lamp and sensor change of elevator `id` on `eventCh`.
+func Proxy(listenAddr string, upstreamAddr string, id string, eventCh chan<- Event) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	for {
+		node, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		server, err := net.Dial("tcp", upstreamAddr)
+		if err != nil {
+			node.Close()
+			return err
+		}
+		// requests that expect a reply, in the order they were sent
+		pendingCh := make(chan [4]byte, 16)
+		go forwardRequests(node, server, id, pendingCh, eventCh)
+		go forwardReplies(server, node, id, pendingCh, eventCh)
+	}
+}
+
+func forwardRequests(node net.Conn, server net.Conn, id string, pendingCh chan<- [4]byte, eventCh chan<- Event) {
+	defer server.Close()
+	defer close(pendingCh)
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(node, buf[:]); err != nil {
+			return
+		}
+		now := time.Now()
+		switch buf[0] {
+		case 1:
+			eventCh <- Event{Time: now, ElevatorID: id, Type: EV_Motor, Value: int(int8(buf[1]))}
+		case 2:
+			eventCh <- Event{Time: now, ElevatorID: id, Type: EV_ButtonLamp,
+				Button: elevio.ButtonType(buf[1]), Floor: int(buf[2]), Value: int(buf[3])}
+		case 4:
+			eventCh <- Event{Time: now, ElevatorID: id, Type: EV_DoorLamp, Value: int(buf[1])}
+		case 6, 7, 8, 9:
+			pendingCh <- buf
+		}
+		if _, err := server.Write(buf[:]); err != nil {
+			return
+		}
+	}
+}
+
+func forwardReplies(server net.Conn, node net.Conn, id string, pendingCh <-chan [4]byte, eventCh chan<- Event) {
+	defer node.Close()
+	buttons := make(map[[2]byte]bool)
+	floor := -2 // unknown
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(server, buf[:]); err != nil {
+			return
+		}
+		request, ok := <-pendingCh
+		if !ok {
+			return
+		}
+		now := time.Now()
+		switch request[0] {
+		case 6:
+			key := [2]byte{request[1], request[2]}
+			pressed := buf[1] != 0
+			if pressed && !buttons[key] {
+				eventCh <- Event{Time: now, ElevatorID: id, Type: EV_ButtonPress,
+					Button: elevio.ButtonType(request[1]), Floor: int(request[2])}
+			}
+			buttons[key] = pressed
+		case 7:
+			newFloor := -1
+			if buf[1] != 0 {
+				newFloor = int(buf[2])
+			}
+			if newFloor != floor {
+				floor = newFloor
+				eventCh <- Event{Time: now, ElevatorID: id, Type: EV_FloorSensor, Floor: floor}
+			}
+		}
+		if _, err := node.Write(buf[:]); err != nil {
+			return
+		}
+	}
+}
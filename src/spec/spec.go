@@ -0,0 +1,352 @@
+package spec
+
+import (
+	"../elevio"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Checks the hard rules in ProjectDescription/SPECIFICATION.md against the
+// motor/lamp/sensor event stream of every participating elevator. Events must
+// be fed in time order, either live or from a recorded trace.
+
+type EventType int
+
+const (
+	EV_Motor       EventType = iota // Value: motor direction
+	EV_ButtonLamp                   // Floor, Button, Value: lamp on (1) or off (0)
+	EV_DoorLamp                     // Value: door lamp on (1) or off (0)
+	EV_FloorSensor                  // Floor: floor the car is at, -1 between floors
+	EV_ButtonPress                  // Floor, Button: button pressed on panel
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EV_Motor:
+		return "motor"
+	case EV_ButtonLamp:
+		return "button_lamp"
+	case EV_DoorLamp:
+		return "door_lamp"
+	case EV_FloorSensor:
+		return "floor_sensor"
+	case EV_ButtonPress:
+		return "button_press"
+	default:
+		return "someeventtype"
+	}
+}
+
+type Event struct {
+	Time       time.Time         `json:"time"`
+	ElevatorID string            `json:"elevator_id"`
+	Type       EventType         `json:"type"`
+	Floor      int               `json:"floor"`
+	Button     elevio.ButtonType `json:"button"`
+	Value      int               `json:"value"`
+}
+
+type Violation struct {
+	Time        time.Time `json:"time"`
+	ElevatorID  string    `json:"elevator_id"`
+	Rule        string    `json:"rule"`
+	Description string    `json:"description"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%v [%v] elevator %v: %v",
+		v.Time.Format("15:04:05.000"), v.Rule, v.ElevatorID, v.Description)
+}
+
+type Config struct {
+	NumFloors          int
+	MinDoorOpen        time.Duration // spec 2.12
+	MaxDoorOpen        time.Duration // spec 2.13
+	ServiceTimeout     time.Duration // what is considered "reasonable time" in spec 2.2 and 2.3
+	LightSyncTolerance time.Duration // how long hall lamps may disagree between panels (spec 2.14)
+}
+
+func DefaultConfig(numFloors int) Config {
+	return Config{NumFloors: numFloors,
+		MinDoorOpen:        2 * time.Second,
+		MaxDoorOpen:        5 * time.Second,
+		ServiceTimeout:     60 * time.Second,
+		LightSyncTolerance: 1 * time.Second}
+}
+
+type hallCall struct {
+	Floor  int
+	Button elevio.ButtonType
+}
+
+type elevatorState struct {
+	motor          elevio.MotorDirection
+	floor          int
+	floorKnown     bool
+	doorOpen       bool
+	doorOpenedAt   time.Time
+	lastInputAt    time.Time // last press at the floor the door is open at
+	doorTimeoutHit bool
+	hallCleared    [2]bool // hall lamps at the door floor turned off while door was open
+	lamps          [][3]bool
+	litAt          [][3]time.Time // when each lamp was last turned on
+	cabAccepted    map[int]time.Time
+}
+
+type Checker struct {
+	config       Config
+	elevators    map[string]*elevatorState
+	hallAccepted map[hallCall]time.Time
+	overdue      map[string]bool // orders already reported as not served
+	unsynced     map[hallCall]time.Time
+	syncReported map[hallCall]bool
+	violations   []Violation
+}
+
+func NewChecker(config Config) *Checker {
+	return &Checker{config: config,
+		elevators:    make(map[string]*elevatorState),
+		hallAccepted: make(map[hallCall]time.Time),
+		overdue:      make(map[string]bool),
+		unsynced:     make(map[hallCall]time.Time),
+		syncReported: make(map[hallCall]bool)}
+}
+
+// Violations returns every violation reported so far
+func (c *Checker) Violations() []Violation {
+	return c.violations
+}
+
+// Feed processes one event and returns the violations it caused
+func (c *Checker) Feed(ev Event) []Violation {
+	n := len(c.violations)
+	c.checkTimeouts(ev.Time)
+
+	elev := c.elevator(ev.ElevatorID)
+	switch ev.Type {
+	case EV_Motor:
+		elev.motor = elevio.MotorDirection(ev.Value)
+		if elev.doorOpen && elev.motor != elevio.MD_Stop {
+			c.report(ev.Time, ev.ElevatorID, "2.10", "motor started while door is open")
+		}
+
+	case EV_FloorSensor:
+		elev.floor = ev.Floor
+		elev.floorKnown = true
+		if elev.doorOpen && elev.floor == -1 {
+			c.report(ev.Time, ev.ElevatorID, "2.11", "car left floor while door is open")
+		}
+
+	case EV_DoorLamp:
+		if ev.Value != 0 && !elev.doorOpen {
+			elev.doorOpen = true
+			elev.doorOpenedAt = ev.Time
+			elev.lastInputAt = ev.Time
+			elev.doorTimeoutHit = false
+			elev.hallCleared = [2]bool{false, false}
+			if elev.motor != elevio.MD_Stop {
+				c.report(ev.Time, ev.ElevatorID, "2.10", "door opened while moving")
+			}
+			if elev.floorKnown && elev.floor == -1 {
+				c.report(ev.Time, ev.ElevatorID, "2.11", "door opened between floors")
+			}
+			c.checkServed(ev.Time, ev.ElevatorID)
+		} else if ev.Value == 0 && elev.doorOpen {
+			elev.doorOpen = false
+			if open := ev.Time.Sub(elev.doorOpenedAt); open < c.config.MinDoorOpen {
+				c.report(ev.Time, ev.ElevatorID, "2.12",
+					fmt.Sprintf("door only open for %v", open))
+			}
+		}
+
+	case EV_ButtonPress:
+		if elev.doorOpen && ev.Floor == elev.floor {
+			elev.lastInputAt = ev.Time
+		}
+
+	case EV_ButtonLamp:
+		if !c.validButton(ev.Floor, ev.Button) {
+			break
+		}
+		on := ev.Value != 0
+		wasOn := elev.lamps[ev.Floor][ev.Button]
+		elev.lamps[ev.Floor][ev.Button] = on
+
+		if on && !wasOn {
+			elev.litAt[ev.Floor][ev.Button] = ev.Time
+			// spec 1.8: order is accepted when a light is turned on
+			if ev.Button == elevio.BT_Cab {
+				if _, exists := elev.cabAccepted[ev.Floor]; !exists {
+					elev.cabAccepted[ev.Floor] = ev.Time
+				}
+			} else {
+				call := hallCall{Floor: ev.Floor, Button: ev.Button}
+				if _, exists := c.hallAccepted[call]; !exists {
+					c.hallAccepted[call] = ev.Time
+				}
+			}
+		}
+		if !on && wasOn && elev.doorOpen && ev.Floor == elev.floor && ev.Button != elevio.BT_Cab {
+			elev.hallCleared[ev.Button] = true
+			if elev.hallCleared[elevio.BT_HallUp] && elev.hallCleared[elevio.BT_HallDown] {
+				c.report(ev.Time, ev.ElevatorID, "2.7",
+					fmt.Sprintf("served hall up and hall down at floor %v at the same time", ev.Floor))
+			}
+		}
+		c.checkServed(ev.Time, ev.ElevatorID)
+		c.checkLightSync(ev.Time, hallCall{Floor: ev.Floor, Button: ev.Button})
+	}
+
+	return c.violations[n:]
+}
+
+// Tick checks the time based rules without any new events. Must be called
+// periodically when checking live.
+func (c *Checker) Tick(now time.Time) []Violation {
+	n := len(c.violations)
+	c.checkTimeouts(now)
+	return c.violations[n:]
+}
+
+func (c *Checker) elevator(id string) *elevatorState {
+	if elev, exists := c.elevators[id]; exists {
+		return elev
+	}
+	elev := &elevatorState{floor: -1,
+		lamps:       make([][3]bool, c.config.NumFloors),
+		litAt:       make([][3]time.Time, c.config.NumFloors),
+		cabAccepted: make(map[int]time.Time)}
+	c.elevators[id] = elev
+	return elev
+}
+
+func (c *Checker) validButton(floor int, button elevio.ButtonType) bool {
+	return floor >= 0 && floor < c.config.NumFloors && button >= 0 && button < 3
+}
+
+func (c *Checker) report(t time.Time, id string, rule string, description string) {
+	c.violations = append(c.violations, Violation{Time: t, ElevatorID: id, Rule: rule, Description: description})
+}
+
+// spec 1.9: an order is completed when an elevator has its door open at the
+// floor and the corresponding light is off. A hall call is only completed by
+// an elevator whose lamp was lit for it, a panel that never showed the call
+// has not served it.
+func (c *Checker) checkServed(t time.Time, id string) {
+	elev := c.elevators[id]
+	if !elev.doorOpen || elev.floor < 0 {
+		return
+	}
+	if !elev.lamps[elev.floor][elevio.BT_Cab] {
+		if _, exists := elev.cabAccepted[elev.floor]; exists {
+			delete(elev.cabAccepted, elev.floor)
+			delete(c.overdue, cabKey(id, elev.floor))
+		}
+	}
+	for _, button := range []elevio.ButtonType{elevio.BT_HallUp, elevio.BT_HallDown} {
+		call := hallCall{Floor: elev.floor, Button: button}
+		acceptedTime, exists := c.hallAccepted[call]
+		if exists && !elev.lamps[elev.floor][button] && !elev.litAt[elev.floor][button].Before(acceptedTime) {
+			delete(c.hallAccepted, call)
+			delete(c.overdue, hallKey(call))
+		}
+	}
+}
+
+// spec 2.14: all panels should show the same hall lights
+func (c *Checker) checkLightSync(t time.Time, call hallCall) {
+	if call.Button == elevio.BT_Cab {
+		return
+	}
+	on, off := 0, 0
+	for _, elev := range c.elevators {
+		if elev.lamps[call.Floor][call.Button] {
+			on++
+		} else {
+			off++
+		}
+	}
+	if on > 0 && off > 0 {
+		if _, exists := c.unsynced[call]; !exists {
+			c.unsynced[call] = t
+		}
+	} else {
+		delete(c.unsynced, call)
+		delete(c.syncReported, call)
+	}
+}
+
+func (c *Checker) checkTimeouts(now time.Time) {
+	ids := make([]string, 0, len(c.elevators))
+	for id := range c.elevators {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		elev := c.elevators[id]
+		if elev.doorOpen && !elev.doorTimeoutHit && now.Sub(elev.lastInputAt) > c.config.MaxDoorOpen {
+			elev.doorTimeoutHit = true
+			c.report(now, id, "2.13",
+				fmt.Sprintf("door not closed %v after last input", c.config.MaxDoorOpen))
+		}
+		floors := make([]int, 0, len(elev.cabAccepted))
+		for floor := range elev.cabAccepted {
+			floors = append(floors, floor)
+		}
+		sort.Ints(floors)
+		for _, floor := range floors {
+			acceptedTime := elev.cabAccepted[floor]
+			key := cabKey(id, floor)
+			if !c.overdue[key] && now.Sub(acceptedTime) > c.config.ServiceTimeout {
+				c.overdue[key] = true
+				c.report(now, id, "2.3",
+					fmt.Sprintf("cab order at floor %v not served within %v", floor, c.config.ServiceTimeout))
+			}
+		}
+	}
+
+	for _, call := range sortedCalls(c.hallAccepted) {
+		acceptedTime := c.hallAccepted[call]
+		key := hallKey(call)
+		if !c.overdue[key] && now.Sub(acceptedTime) > c.config.ServiceTimeout {
+			c.overdue[key] = true
+			c.report(now, "-", "2.2",
+				fmt.Sprintf("hall order %v at floor %v not served within %v", call.Button, call.Floor, c.config.ServiceTimeout))
+		}
+	}
+
+	for _, call := range sortedCalls(c.unsynced) {
+		since := c.unsynced[call]
+		if !c.syncReported[call] && now.Sub(since) > c.config.LightSyncTolerance {
+			c.syncReported[call] = true
+			c.report(now, "-", "2.14",
+				fmt.Sprintf("%v lamp at floor %v differs between panels for more than %v", call.Button, call.Floor, c.config.LightSyncTolerance))
+		}
+	}
+}
+
+// sortedCalls returns the calls of the map by floor and button, so violations
+// are reported in the same order every run
+func sortedCalls(calls map[hallCall]time.Time) []hallCall {
+	sorted := make([]hallCall, 0, len(calls))
+	for call := range calls {
+		sorted = append(sorted, call)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Floor != sorted[j].Floor {
+			return sorted[i].Floor < sorted[j].Floor
+		}
+		return sorted[i].Button < sorted[j].Button
+	})
+	return sorted
+}
+
+func cabKey(id string, floor int) string {
+	return fmt.Sprintf("cab/%v/%v", id, floor)
+}
+
+func hallKey(call hallCall) string {
+	return fmt.Sprintf("hall/%v/%v", call.Floor, int(call.Button))
+}
@@ -0,0 +1,146 @@
+package spec
+
+import (
+	"../elevio"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testStart = time.Unix(1000, 0)
+
+func at(ms int, id string, evType EventType, floor int, button elevio.ButtonType, value int) Event {
+	return Event{Time: testStart.Add(time.Duration(ms) * time.Millisecond), ElevatorID: id,
+		Type: evType, Floor: floor, Button: button, Value: value}
+}
+
+func lamp(ms int, id string, floor int, button elevio.ButtonType, on int) Event {
+	return at(ms, id, EV_ButtonLamp, floor, button, on)
+}
+
+func door(ms int, id string, open int) Event {
+	return at(ms, id, EV_DoorLamp, 0, 0, open)
+}
+
+func floorSensor(ms int, id string, floor int) Event {
+	return at(ms, id, EV_FloorSensor, floor, 0, 0)
+}
+
+func motor(ms int, id string, dir elevio.MotorDirection) Event {
+	return at(ms, id, EV_Motor, 0, 0, int(dir))
+}
+
+func TestChecker(t *testing.T) {
+	config := Config{NumFloors: 4,
+		MinDoorOpen:        2 * time.Second,
+		MaxDoorOpen:        5 * time.Second,
+		ServiceTimeout:     10 * time.Second,
+		LightSyncTolerance: 1 * time.Second}
+
+	tests := []struct {
+		name   string
+		events []Event
+		tick   int      // ms, checks the timeouts after the events
+		want   []string // rules violated, in order
+	}{
+		{"served hall call", []Event{
+			floorSensor(0, "A", 1), floorSensor(0, "B", 1),
+			lamp(0, "A", 2, elevio.BT_HallUp, 1), lamp(0, "B", 2, elevio.BT_HallUp, 1),
+			floorSensor(3000, "A", 2), door(3000, "A", 1),
+			lamp(3000, "A", 2, elevio.BT_HallUp, 0), lamp(3000, "B", 2, elevio.BT_HallUp, 0),
+			door(6000, "A", 0),
+		}, 20000, nil},
+		{"door open at an unlit panel does not serve", []Event{
+			floorSensor(0, "A", 1), floorSensor(0, "B", 2),
+			lamp(0, "A", 2, elevio.BT_HallUp, 1),
+			door(100, "B", 1), door(3000, "B", 0),
+		}, 20000, []string{"2.14", "2.2"}},
+		{"lamp lit for an earlier call does not serve", []Event{
+			floorSensor(0, "A", 2), floorSensor(0, "B", 0),
+			lamp(0, "A", 2, elevio.BT_HallUp, 1), lamp(0, "B", 2, elevio.BT_HallUp, 1),
+			door(100, "A", 1), lamp(100, "A", 2, elevio.BT_HallUp, 0), lamp(100, "B", 2, elevio.BT_HallUp, 0),
+			door(3000, "A", 0),
+			lamp(4000, "B", 2, elevio.BT_HallUp, 1),
+			door(4100, "A", 1), door(7000, "A", 0),
+		}, 20000, []string{"2.14", "2.2"}},
+		{"cab order not served", []Event{
+			floorSensor(0, "A", 0),
+			lamp(0, "A", 3, elevio.BT_Cab, 1),
+		}, 20000, []string{"2.3"}},
+		{"door open too short and while moving", []Event{
+			floorSensor(0, "A", 0),
+			door(0, "A", 1), motor(500, "A", elevio.MD_Up), door(1000, "A", 0),
+		}, 1000, []string{"2.10", "2.12"}},
+		{"door open too long", []Event{
+			floorSensor(0, "A", 0), door(0, "A", 1),
+		}, 6000, []string{"2.13"}},
+		{"hall up and down served at once", []Event{
+			floorSensor(0, "A", 1),
+			lamp(0, "A", 1, elevio.BT_HallUp, 1), lamp(0, "A", 1, elevio.BT_HallDown, 1),
+			door(100, "A", 1),
+			lamp(100, "A", 1, elevio.BT_HallUp, 0), lamp(100, "A", 1, elevio.BT_HallDown, 0),
+			door(3000, "A", 0),
+		}, 3000, []string{"2.7"}},
+	}
+
+	for _, test := range tests {
+		checker := NewChecker(config)
+		for _, ev := range test.events {
+			checker.Feed(ev)
+		}
+		checker.Tick(testStart.Add(time.Duration(test.tick) * time.Millisecond))
+
+		var got []string
+		for _, violation := range checker.Violations() {
+			got = append(got, violation.Rule)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: violations %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckerTimeoutOrder(t *testing.T) {
+	config := DefaultConfig(4)
+	lamps := []Event{
+		lamp(0, "A", 3, elevio.BT_HallDown, 1), lamp(0, "A", 1, elevio.BT_HallUp, 1),
+		lamp(0, "A", 2, elevio.BT_HallDown, 1), lamp(0, "A", 2, elevio.BT_HallUp, 1),
+		lamp(0, "A", 3, elevio.BT_Cab, 1), lamp(0, "A", 1, elevio.BT_Cab, 1),
+		lamp(0, "B", 0, elevio.BT_Cab, 1),
+	}
+
+	var first []Violation
+	for run := 0; run < 20; run++ {
+		checker := NewChecker(config)
+		for _, ev := range lamps {
+			checker.Feed(ev)
+		}
+		violations := checker.Tick(testStart.Add(config.ServiceTimeout + time.Second))
+		if run == 0 {
+			first = violations
+			continue
+		}
+		if !reflect.DeepEqual(violations, first) {
+			t.Fatalf("run %v: violations\n%v\nwant the same order as\n%v", run, violations, first)
+		}
+	}
+
+	want := []string{
+		"cab order at floor 1 not served within 1m0s",
+		"cab order at floor 3 not served within 1m0s",
+		"cab order at floor 0 not served within 1m0s",
+		"hall order BtnHall↑ at floor 1 not served within 1m0s",
+		"hall order BtnHall↑ at floor 2 not served within 1m0s",
+		"hall order BtnHall↓ at floor 2 not served within 1m0s",
+		"hall order BtnHall↓ at floor 3 not served within 1m0s",
+	}
+	var got []string
+	for _, violation := range first {
+		if violation.Rule != "2.14" {
+			got = append(got, violation.Description)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("violations %q, want %q", got, want)
+	}
+}
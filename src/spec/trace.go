@@ -0,0 +1,47 @@
+package spec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// Traces are stored as one JSON encoded Event per line
+
+type TraceWriter struct {
+	encoder *json.Encoder
+}
+
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	return &TraceWriter{encoder: json.NewEncoder(w)}
+}
+
+func (t *TraceWriter) Write(ev Event) error {
+	return t.encoder.Encode(ev)
+}
+
+func ReadTrace(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return events, err
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// CheckTrace runs all events through a new checker and returns the violations
+// found, including time based violations up until the last event
+func CheckTrace(config Config, events []Event) []Violation {
+	checker := NewChecker(config)
+	for _, ev := range events {
+		checker.Feed(ev)
+	}
+	return checker.Violations()
+}
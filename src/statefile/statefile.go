@@ -0,0 +1,65 @@
+package statefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// State a node keeps across restarts in its -statedir, one JSON file per kind
+// of state. The file is replaced atomically and synced, a crash leaves either
+// the old or the new content.
+
+type File struct {
+	path string
+}
+
+func New(stateDir string, name string, thisID string) File {
+	return File{path: filepath.Join(stateDir, fmt.Sprintf("%v-%v.json", name, thisID))}
+}
+
+func (f File) Save(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(f.path, data)
+}
+
+// WriteAtomic replaces the file at path with data, synced
+func WriteAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load leaves v unchanged if nothing has been saved
+func (f File) Load(v interface{}) error {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
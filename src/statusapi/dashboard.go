@@ -0,0 +1,172 @@
+package statusapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Browser dashboard of the elevator bank. The page subscribes to /events, a
+// server-sent event stream with a full Status every dashboardPeriod. Peers are
+// drawn from the heartbeats the orderhandler has received, orders and the
+// assignment timeline from the commhandler.
+
+const dashboardPeriod = 500 * time.Millisecond
+
+func (s *server) status() (Status, error) {
+	status := Status{NodeID: s.nodeID}
+	var err error
+	if status.FSM, err = s.fsmStatus(); err != nil {
+		return status, err
+	}
+	if status.OrderHandler, err = s.orderhandlerStatus(); err != nil {
+		return status, err
+	}
+	status.CommHandler, err = s.commhandlerStatus()
+	return status, err
+}
+
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(dashboardPeriod)
+	defer ticker.Stop()
+	for {
+		status, err := s.status()
+		if err != nil {
+			fmt.Fprintf(w, "event: failure\ndata: %v\n\n", err)
+		} else {
+			data, _ := json.Marshal(status)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Elevator dashboard</title>
+<style>
+body { font-family: monospace; margin: 1em; background: #fafafa; }
+h2 { margin: 0.8em 0 0.3em 0; }
+.elevators { display: flex; flex-wrap: wrap; gap: 1em; }
+.elevator { border: 1px solid #888; padding: 0.5em; background: white; }
+.elevator.dead { opacity: 0.4; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: center; }
+td.car { background: #4a7; color: white; }
+td.car.open { background: #da3; }
+td.order { background: #9bd; }
+td.light { font-weight: bold; color: #c22; }
+#error { color: #c22; }
+</style>
+</head>
+<body>
+<h1>Elevator bank <span id="node"></span> <span id="error"></span></h1>
+<h2>Elevators</h2>
+<div class="elevators" id="elevators"></div>
+<h2>Orders</h2>
+<table id="orders"></table>
+<h2>Assignments</h2>
+<table id="timeline"></table>
+<script>
+var buttons = ["up", "down", "cab"];
+var directions = {"-1": "down", "0": "stop", "1": "up"};
+var states = ["idle", "moving", "door open"];
+
+function text(s) {
+	return String(s).replace(/[&<>"]/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+	});
+}
+
+function elevatorView(id, elev, alive) {
+	var html = '<div class="elevator' + (alive ? '' : ' dead') + '"><b>' + text(id) + '</b> ' +
+		directions[elev.Dir] + ', ' + states[elev.State] + (alive ? '' : ', lost') +
+		'<table><tr><th>floor</th><th>car</th>';
+	buttons.forEach(function(b) { html += '<th>' + b + '</th>'; });
+	html += '</tr>';
+	for (var floor = elev.Orders.length - 1; floor >= 0; floor--) {
+		var car = floor == elev.Floor ? (elev.State == 2 ? 'car open' : 'car') : '';
+		html += '<tr><td>' + floor + '</td><td class="' + car + '">' +
+			(floor == elev.Floor ? (elev.State == 2 ? '[ ]' : '[#]') : '') + '</td>';
+		for (var b = 0; b < buttons.length; b++) {
+			var cls = (elev.Orders[floor][b] ? 'order ' : '') + (elev.Lights[floor][b] ? 'light' : '');
+			html += '<td class="' + cls + '">' + (elev.Lights[floor][b] ? '*' : (elev.Orders[floor][b] ? 'o' : '')) + '</td>';
+		}
+		html += '</tr>';
+	}
+	return html + '</table></div>';
+}
+
+function render(status) {
+	document.getElementById("node").textContent = "(node " + status.node_id + ")";
+	document.getElementById("error").textContent = "";
+
+	var alive = {};
+	(status.commhandler.peers || []).forEach(function(p) { alive[p.id] = p.alive; });
+	var elevators = status.orderhandler.elevators || {};
+	var ids = Object.keys(elevators).sort();
+	var html = "";
+	ids.forEach(function(id) {
+		html += elevatorView(id, elevators[id].elevator_status, alive[id] !== false);
+	});
+	if (ids.length == 0) {
+		html = elevatorView(status.node_id, status.fsm, true);
+	}
+	document.getElementById("elevators").innerHTML = html;
+
+	var orders = status.commhandler.all_orders || {};
+	html = "<tr><th>id</th><th>floor</th><th>button</th><th>state</th><th>master</th><th>sender</th><th>receiver</th><th>transmits</th><th>since</th></tr>";
+	Object.keys(orders).sort().forEach(function(id) {
+		var o = orders[id];
+		var order = o.OrderMsg.order;
+		html += "<tr><td>" + id + "</td><td>" + order.floor + "</td><td>" + buttons[order.button_type] +
+			"</td><td>" + o.OrderState + "</td><td>" + text(order.master_id) + "</td><td>" + text(o.OrderMsg.sender_id) +
+			"</td><td>" + text(o.OrderMsg.reciever_id) + "</td><td>" + o.TransmitCount +
+			"</td><td>" + new Date(o.TimeStamp).toLocaleTimeString() + "</td></tr>";
+	});
+	document.getElementById("orders").innerHTML = html;
+
+	var timeline = (status.commhandler.timeline || []).slice().reverse();
+	html = "<tr><th>time</th><th>event</th><th>order</th><th>floor</th><th>button</th><th>master</th><th>elevator</th></tr>";
+	timeline.forEach(function(e) {
+		html += "<tr><td>" + new Date(e.time).toLocaleTimeString() + "</td><td>" + e.event + "</td><td>" + e.order.order_id +
+			"</td><td>" + e.order.floor + "</td><td>" + buttons[e.order.button_type] + "</td><td>" + text(e.master_id) +
+			"</td><td>" + text(e.elevator_id) + "</td></tr>";
+	});
+	document.getElementById("timeline").innerHTML = html;
+}
+
+var source = new EventSource("/events");
+source.onmessage = function(e) { render(JSON.parse(e.data)); };
+source.addEventListener("failure", function(e) { document.getElementById("error").textContent = e.data; });
+source.onerror = function() { document.getElementById("error").textContent = "disconnected"; };
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,253 @@
+package statusapi
+
+import (
+	"../commhandler"
+	"../elevio"
+	"../fsm"
+	"../go-nonblockingchan"
+	"../logging"
+	"../metrics"
+	"../orderhandler"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Local HTTP api exposing snapshots of the module states and accepting
+// remotely placed orders
+//   GET  /status                 all snapshots
+//   GET  /status/fsm             elevator state
+//   GET  /status/orderhandler    placed, accepted and assigned orders
+//   GET  /status/commhandler     order states and last heartbeats
+//   GET  /peers                  peers with last seen time
+//   POST /orders                 {"floor": 2, "button": "hall-up"} (hall-up, hall-down or cab)
+//   POST /orders/complete        complete an order of this elevator as if it was served
+//   POST /orders/cancel          drop an order of this elevator without serving it
+//   GET  /loglevel               log level of every module
+//   POST /loglevel               "warn,commhandler=debug"
+//   GET  /metrics                metrics in the Prometheus text format
+//   GET  /dashboard              live web dashboard of the elevator bank
+//   GET  /events                 status stream (server-sent events) used by the dashboard
+
+var Log = logging.New("statusapi")
+
+const replyTimeout = 1 * time.Second
+
+type Status struct {
+	NodeID       string                `json:"node_id"`
+	FSM          fsm.Elevator          `json:"fsm"`
+	OrderHandler orderhandler.Snapshot `json:"orderhandler"`
+	CommHandler  commhandler.Snapshot  `json:"commhandler"`
+}
+
+type OrderRequest struct {
+	Floor  int    `json:"floor"`
+	Button string `json:"button"`
+}
+
+type server struct {
+	nodeID                       string
+	statusRequest_fsmCh          *nbc.NonBlockingChan
+	statusRequest_orderhandlerCh *nbc.NonBlockingChan
+	statusRequest_commhandlerCh  *nbc.NonBlockingChan
+	injectButton_fsmCh           *nbc.NonBlockingChan
+	orderCommand_fsmCh           *nbc.NonBlockingChan
+}
+
+func Serve(addr string, nodeID string,
+	/* Write channels */
+	statusRequest_fsmCh *nbc.NonBlockingChan,
+	statusRequest_orderhandlerCh *nbc.NonBlockingChan,
+	statusRequest_commhandlerCh *nbc.NonBlockingChan,
+	injectButton_fsmCh *nbc.NonBlockingChan,
+	orderCommand_fsmCh *nbc.NonBlockingChan) {
+
+	s := &server{nodeID: nodeID,
+		statusRequest_fsmCh:          statusRequest_fsmCh,
+		statusRequest_orderhandlerCh: statusRequest_orderhandlerCh,
+		statusRequest_commhandlerCh:  statusRequest_commhandlerCh,
+		injectButton_fsmCh:           injectButton_fsmCh,
+		orderCommand_fsmCh:           orderCommand_fsmCh}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/status/fsm", s.handleStatus)
+	mux.HandleFunc("/status/orderhandler", s.handleStatus)
+	mux.HandleFunc("/status/commhandler", s.handleStatus)
+	mux.HandleFunc("/peers", s.handlePeers)
+	mux.HandleFunc("/orders", s.handleOrders)
+	mux.HandleFunc("/orders/complete", s.handleOrders)
+	mux.HandleFunc("/orders/cancel", s.handleOrders)
+	mux.HandleFunc("/loglevel", s.handleLogLevel)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.HandleFunc("/dashboard", s.handleDashboard)
+	mux.HandleFunc("/events", s.handleEvents)
+
+	Log.Printf("listening on %v\n", addr)
+	Log.Errorf("%v\n", http.ListenAndServe(addr, mux))
+}
+
+func (s *server) fsmStatus() (fsm.Elevator, error) {
+	replyCh := make(chan fsm.Elevator, 1)
+	s.statusRequest_fsmCh.Send <- replyCh
+	select {
+	case elevator := <-replyCh:
+		return elevator, nil
+	case <-time.After(replyTimeout):
+		return fsm.Elevator{}, fmt.Errorf("fsm did not reply")
+	}
+}
+
+func (s *server) orderhandlerStatus() (orderhandler.Snapshot, error) {
+	replyCh := make(chan orderhandler.Snapshot, 1)
+	s.statusRequest_orderhandlerCh.Send <- replyCh
+	select {
+	case snapshot := <-replyCh:
+		return snapshot, nil
+	case <-time.After(replyTimeout):
+		return orderhandler.Snapshot{}, fmt.Errorf("orderhandler did not reply")
+	}
+}
+
+func (s *server) commhandlerStatus() (commhandler.Snapshot, error) {
+	replyCh := make(chan commhandler.Snapshot, 1)
+	s.statusRequest_commhandlerCh.Send <- replyCh
+	select {
+	case snapshot := <-replyCh:
+		return snapshot, nil
+	case <-time.After(replyTimeout):
+		return commhandler.Snapshot{}, fmt.Errorf("commhandler did not reply")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := Status{NodeID: s.nodeID}
+	var err error
+	module := strings.TrimPrefix(r.URL.Path, "/status")
+	if module == "" || module == "/fsm" {
+		if status.FSM, err = s.fsmStatus(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if module == "" || module == "/orderhandler" {
+		if status.OrderHandler, err = s.orderhandlerStatus(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if module == "" || module == "/commhandler" {
+		if status.CommHandler, err = s.commhandlerStatus(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	switch module {
+	case "/fsm":
+		writeJSON(w, status.FSM)
+	case "/orderhandler":
+		writeJSON(w, status.OrderHandler)
+	case "/commhandler":
+		writeJSON(w, status.CommHandler)
+	default:
+		writeJSON(w, status)
+	}
+}
+
+func (s *server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot, err := s.commhandlerStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, snapshot.Peers)
+}
+
+func ParseButton(s string) (elevio.ButtonType, error) {
+	switch s {
+	case "hall-up":
+		return elevio.BT_HallUp, nil
+	case "hall-down":
+		return elevio.BT_HallDown, nil
+	case "cab":
+		return elevio.BT_Cab, nil
+	}
+	return elevio.BT_Cab, fmt.Errorf("unknown button %q, expected hall-up, hall-down or cab", s)
+}
+
+func (s *server) handleOrders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request OrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	button, err := ParseButton(request.Button)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Floor < 0 || request.Floor >= fsm.N_FLOORS {
+		http.Error(w, fmt.Sprintf("floor must be in 0-%v", fsm.N_FLOORS-1), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path == "/orders/cancel" && button != elevio.BT_Cab {
+		// a hall order is also held by the other nodes, which would reassign it
+		http.Error(w, "only cab orders can be cancelled", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/orders/complete", "/orders/cancel":
+		complete := r.URL.Path == "/orders/complete"
+		Log.Printf("order removed remotely (complete %v): %v at floor %v\n", complete, button, request.Floor)
+		s.orderCommand_fsmCh.Send <- fsm.OrderCommand{Floor: request.Floor, Button: button, Complete: complete}
+	default:
+		Log.Printf("order placed remotely: %v at floor %v\n", button, request.Floor)
+		s.injectButton_fsmCh.Send <- elevio.ButtonEvent{Floor: request.Floor, Button: button}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := logging.ParseLevels(strings.TrimSpace(string(body))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, logging.Levels())
+}